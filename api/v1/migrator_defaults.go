@@ -0,0 +1,43 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+// Default fills in the static defaults for a Migrator. Defaults which depend on the template pod are set
+// by the defaulting webhook.
+func (m *Migrator) Default() {
+	if m.Spec.TemplateSelector == nil && m.Spec.Selector != nil {
+		m.Spec.TemplateSelector = m.Spec.Selector.DeepCopy()
+	}
+	if m.Spec.Job.Sidecars.Mode == "" {
+		m.Spec.Job.Sidecars.Mode = SidecarModeNative
+	}
+	if m.Spec.Job.SuccessfulJobRetention == "" {
+		m.Spec.Job.SuccessfulJobRetention = JobRetentionDelete
+	}
+	if m.Spec.Job.SpecChangePolicy == "" {
+		m.Spec.Job.SpecChangePolicy = SpecChangePolicyIgnore
+	}
+	if m.Spec.Job.CancellationPolicy == "" {
+		m.Spec.Job.CancellationPolicy = CancellationPolicyWait
+	}
+	if m.Spec.Waiter.FailurePolicy == "" {
+		m.Spec.Waiter.FailurePolicy = WaiterPolicyWait
+	}
+	if m.Spec.Waiter.MissingMigratorPolicy == "" {
+		m.Spec.Waiter.MissingMigratorPolicy = WaiterPolicyWait
+	}
+}
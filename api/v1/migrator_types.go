@@ -0,0 +1,410 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"github.com/coderanger/controller-utils/conditions"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// MigratorSpec defines the desired state of Migrator
+type MigratorSpec struct {
+	// Selector picks which pods to watch for changes and inject migration waiters into. It must not be
+	// empty.
+	Selector *metav1.LabelSelector `json:"selector"`
+	// TemplateSelector picks which of the selected pods to use as a template. Defaults to Selector.
+	TemplateSelector *metav1.LabelSelector `json:"templateSelector,omitempty"`
+	// Container is the name of the container or init container in the template pod to run migrations
+	// from. Its image is used as the migration version. Defaults to the template pod's default container
+	// when one exists at admission.
+	// +kubebuilder:validation:MaxLength=63
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Container string `json:"container,omitempty"`
+	// Job controls how the migration Job is built from the template pod.
+	Job MigrationJobSpec `json:"job,omitempty"`
+	// Waiter controls how the migration waiters injected into matching pods behave.
+	Waiter WaiterSpec `json:"waiter,omitempty"`
+	// Suspend stops new migration Jobs from being started, or outdated ones replaced, until it is cleared.
+	// Pods keep waiting for migrations while the Migrator is suspended.
+	Suspend bool `json:"suspend,omitempty"`
+	// SuspendRunningJob also suspends a running migration Job while the Migrator is suspended, and resumes
+	// it afterwards.
+	SuspendRunningJob bool `json:"suspendRunningJob,omitempty"`
+}
+
+// MigrationJobSpec holds the settings for the migration Job.
+type MigrationJobSpec struct {
+	// Image replaces the migration container's image.
+	Image string `json:"image,omitempty"`
+	// Command replaces the migration container's command. An empty list clears the template's command so
+	// the image's entrypoint is used.
+	// +optional
+	Command []string `json:"command"`
+	// Args replaces the migration container's args. An empty list clears the template's args.
+	// +optional
+	Args []string `json:"args"`
+	// Env is a list of environment variables to set on the migration container. A variable with the same
+	// name as one from the template replaces it, anything else is added.
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// RemoveEnv is a list of environment variable names to remove from the migration container.
+	RemoveEnv []string `json:"removeEnv,omitempty"`
+	// EnvFrom is a list of sources to add to the migration container. A source referencing the same
+	// ConfigMap or Secret as one from the template replaces it.
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+	// RemoveEnvFrom is a list of ConfigMap or Secret names to remove from the migration container's envFrom.
+	RemoveEnvFrom []string `json:"removeEnvFrom,omitempty"`
+	// Resources replaces the migration container's resource requests and limits. Defaults to the template
+	// container's resources each time a Job is created.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// ServiceAccountName is the ServiceAccount to run the migration Job as. If not set, the template pod's
+	// ServiceAccount is used.
+	// +kubebuilder:validation:MaxLength=253
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// PodLabels are set on the migration Job's pod template.
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+	// PodAnnotations are set on the migration Job's pod template.
+	PodAnnotations map[string]string `json:"podAnnotations,omitempty"`
+	// InheritLabels controls which labels are copied from the template pod and its owner's pod template to
+	// the migration Job and its pod template. Nothing is copied by default.
+	InheritLabels *InheritRules `json:"inheritLabels,omitempty"`
+	// InheritAnnotations controls which annotations are copied from the template pod and its owner's pod
+	// template to the migration Job and its pod template. Nothing is copied by default.
+	InheritAnnotations *InheritRules `json:"inheritAnnotations,omitempty"`
+	// InitContainers controls which init containers from the template pod are kept in the migration Job.
+	// All are kept by default. Injected migration waiters are always removed.
+	InitContainers *InitContainerFilter `json:"initContainers,omitempty"`
+	// Sidecars controls which other containers from the template pod are kept and how they are run.
+	Sidecars SidecarSpec `json:"sidecars,omitempty"`
+	// DisableSanitizers is a list of sanitizer rules to skip when cloning the template pod spec for the
+	// migration Job. All rules are enabled by default.
+	DisableSanitizers []Sanitizer `json:"disableSanitizers,omitempty"`
+	// SuccessfulJobRetention controls what happens to a migration Job once it succeeds. Delete (the default)
+	// removes it as soon as the success is recorded, Keep leaves it until the next migration replaces it.
+	SuccessfulJobRetention JobRetention `json:"successfulJobRetention,omitempty"`
+	// SpecChangePolicy controls whether a change to the migration Job's pod spec reruns migrations for an
+	// image which already migrated successfully. Ignore (the default) only reruns for a new image, Rerun
+	// also reruns when the spec changes. A running or failed Job is always replaced when the spec changes.
+	SpecChangePolicy SpecChangePolicy `json:"specChangePolicy,omitempty"`
+	// CancellationPolicy controls what happens to a running migration Job once no pods want its image any
+	// more, such as after a rollback. Wait (the default) lets it finish, Cancel deletes it, and Suspend
+	// suspends it so it can resume if the image is wanted again.
+	CancellationPolicy CancellationPolicy `json:"cancellationPolicy,omitempty"`
+	// CancellationGracePeriodSeconds is the termination grace period for the migration pods when a Job is
+	// cancelled with the Cancel policy. Defaults to the pods' own terminationGracePeriodSeconds.
+	// +kubebuilder:validation:Minimum=0
+	CancellationGracePeriodSeconds *int64 `json:"cancellationGracePeriodSeconds,omitempty"`
+}
+
+// WaiterSpec controls the migration waiters injected into matching pods. By default a waiter keeps
+// waiting until migrations for its pod's image succeed.
+type WaiterSpec struct {
+	// FailurePolicy controls what a waiter does when the newest migration Job for its image failed. Wait
+	// (the default) keeps waiting for a retry, Fail exits with an error so the pod shows why it is stuck.
+	FailurePolicy WaiterPolicy `json:"failurePolicy,omitempty"`
+	// MissingMigratorPolicy controls what a waiter does when its Migrator doesn't exist. Wait (the default)
+	// keeps waiting for it to be created, Fail exits with an error.
+	MissingMigratorPolicy WaiterPolicy `json:"missingMigratorPolicy,omitempty"`
+	// Timeout is how long a waiter waits for migrations before exiting with an error. Waiters wait forever
+	// if not set.
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Mode controls how a waiter checks for migrations. API (the default) polls the operator's ready API,
+	// Direct watches the Migrator through the Kubernetes API as a ServiceAccount the operator creates which
+	// can only read this Migrator. If not set, the migrations.coderanger.net/waiter-mode annotation on the
+	// namespace is used.
+	Mode WaiterMode `json:"mode,omitempty"`
+}
+
+// SidecarSpec selects sidecar containers to keep in the migration Job.
+type SidecarSpec struct {
+	// Containers is a list of container names from the template pod to keep in the migration Job, such as
+	// a database proxy or mesh sidecar needed to reach the database.
+	// +kubebuilder:validation:items:MaxLength=63
+	// +kubebuilder:validation:items:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Containers []string `json:"containers,omitempty"`
+	// Mode controls how kept sidecars are run. Native (the default) converts them to native sidecars so
+	// the Job completes when the migrations exit. Legacy keeps them as normal containers for clusters
+	// without native sidecar support, usually combined with ShutdownURL.
+	Mode SidecarMode `json:"mode,omitempty"`
+	// ShutdownURL is an HTTP endpoint to POST to once the migration command exits, for example
+	// http://localhost:15020/quitquitquit for Istio. This requires a shell and curl or wget in the
+	// migration image, and a known command.
+	// +kubebuilder:validation:Pattern=`^https?://`
+	ShutdownURL string `json:"shutdownURL,omitempty"`
+}
+
+// InitContainerFilter selects init containers by name or glob pattern.
+type InitContainerFilter struct {
+	// Include is a list of init container names or patterns to keep. If empty, all are kept.
+	Include []string `json:"include,omitempty"`
+	// Exclude is a list of init container names or patterns to remove, even if they match Include.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// InheritRules is a set of glob patterns for metadata keys. A * matches any sequence of characters,
+// including slashes.
+type InheritRules struct {
+	// Include is a list of patterns for keys to copy. If empty, all keys are included.
+	Include []string `json:"include,omitempty"`
+	// Exclude is a list of patterns for keys to skip, even if they match Include.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// +kubebuilder:validation:Enum=Native;Legacy
+type SidecarMode string
+
+const (
+	SidecarModeNative SidecarMode = "Native"
+	SidecarModeLegacy SidecarMode = "Legacy"
+)
+
+// JobRetention is what to do with a finished migration Job.
+// +kubebuilder:validation:Enum=Delete;Keep
+type JobRetention string
+
+const (
+	JobRetentionDelete JobRetention = "Delete"
+	JobRetentionKeep   JobRetention = "Keep"
+)
+
+// SpecChangePolicy is what to do when the migration Job's pod spec changes after a successful migration.
+// +kubebuilder:validation:Enum=Ignore;Rerun
+type SpecChangePolicy string
+
+const (
+	SpecChangePolicyIgnore SpecChangePolicy = "Ignore"
+	SpecChangePolicyRerun  SpecChangePolicy = "Rerun"
+)
+
+// CancellationPolicy is what to do with a running migration Job which nothing wants any more.
+// +kubebuilder:validation:Enum=Wait;Cancel;Suspend
+type CancellationPolicy string
+
+const (
+	CancellationPolicyWait    CancellationPolicy = "Wait"
+	CancellationPolicyCancel  CancellationPolicy = "Cancel"
+	CancellationPolicySuspend CancellationPolicy = "Suspend"
+)
+
+// WaiterPolicy is what a migration waiter does when migrations can't currently succeed.
+// +kubebuilder:validation:Enum=Wait;Fail
+type WaiterPolicy string
+
+const (
+	WaiterPolicyWait WaiterPolicy = "Wait"
+	WaiterPolicyFail WaiterPolicy = "Fail"
+)
+
+// WaiterMode is how a migration waiter checks whether migrations are done.
+// +kubebuilder:validation:Enum=API;Direct
+type WaiterMode string
+
+const (
+	WaiterModeAPI    WaiterMode = "API"
+	WaiterModeDirect WaiterMode = "Direct"
+)
+
+// Sanitizer is a rule for removing fields from the cloned pod spec which don't make sense for a batch Job
+// and can leave the migration pod unschedulable or hanging on termination.
+// +kubebuilder:validation:Enum=Probes;Ports;HostPorts;Lifecycle;TopologySpread;SelfAntiAffinity;ReadWriteOnceVolumes;UnusedVolumes
+type Sanitizer string
+
+const (
+	// SanitizerProbes removes readiness, liveness and startup probes from the migration container.
+	SanitizerProbes Sanitizer = "Probes"
+	// SanitizerPorts removes container ports from the migration container.
+	SanitizerPorts Sanitizer = "Ports"
+	// SanitizerHostPorts removes hostPort from every container in the Job, including sidecars.
+	SanitizerHostPorts Sanitizer = "HostPorts"
+	// SanitizerLifecycle removes postStart and preStop hooks from the migration container.
+	SanitizerLifecycle Sanitizer = "Lifecycle"
+	// SanitizerTopologySpread removes pod topology spread constraints.
+	SanitizerTopologySpread Sanitizer = "TopologySpread"
+	// SanitizerSelfAntiAffinity removes pod anti-affinity terms matching the template pod's own labels.
+	SanitizerSelfAntiAffinity Sanitizer = "SelfAntiAffinity"
+	// SanitizerReadWriteOnceVolumes removes volumes backed by ReadWriteOnce PVCs, which are usually already
+	// attached to the application's node, along with their mounts.
+	SanitizerReadWriteOnceVolumes Sanitizer = "ReadWriteOnceVolumes"
+	// SanitizerUnusedVolumes removes volumes which no remaining container mounts.
+	SanitizerUnusedVolumes Sanitizer = "UnusedVolumes"
+)
+
+// Condition types set on a Migrator.
+const (
+	// ConditionReady is true when all other conditions in the readiness set are true.
+	ConditionReady = "Ready"
+	// ConditionMigrationsReady is true when migrations have succeeded for the current template image.
+	ConditionMigrationsReady = "MigrationsReady"
+	// ConditionServiceAccountMismatch is true when the migration Job runs as a different ServiceAccount
+	// than the template pod.
+	ConditionServiceAccountMismatch = "ServiceAccountMismatch"
+	// ConditionMigrationCancelled is true when a running migration Job was cancelled because no pods want
+	// its image any more.
+	ConditionMigrationCancelled = "MigrationCancelled"
+	// ConditionSuspended is true when the Migrator is suspended.
+	ConditionSuspended = "Suspended"
+)
+
+// Condition reasons set on a Migrator.
+const (
+	ReasonMigrationsUpToDate       = "MigrationsUpToDate"
+	ReasonMigrationsRunning        = "MigrationsRunning"
+	ReasonMigrationsSucceeded      = "MigrationsSucceeded"
+	ReasonMigrationsFailed         = "MigrationsFailed"
+	ReasonStaleJob                 = "StaleJob"
+	ReasonSpecChanged              = "SpecChanged"
+	ReasonJobDeleted               = "JobDeleted"
+	ReasonJobSuspended             = "JobSuspended"
+	ReasonJobLeftToFinish          = "JobLeftToFinish"
+	ReasonJobResumed               = "JobResumed"
+	ReasonSuspended                = "Suspended"
+	ReasonNotSuspended             = "NotSuspended"
+	ReasonGloballyFrozen           = "GloballyFrozen"
+	ReasonServiceAccountOverridden = "ServiceAccountOverridden"
+	ReasonServiceAccountMatches    = "ServiceAccountMatches"
+)
+
+// MigrationResult is the outcome of a finished migration Job.
+// +kubebuilder:validation:Enum=Succeeded;Failed
+type MigrationResult string
+
+const (
+	MigrationResultSucceeded MigrationResult = "Succeeded"
+	MigrationResultFailed    MigrationResult = "Failed"
+)
+
+// MigrationRecord is one finished migration Job.
+type MigrationRecord struct {
+	// Image is the migration image the Job ran.
+	Image string `json:"image"`
+	// Result is whether the Job succeeded or failed.
+	Result MigrationResult `json:"result"`
+	// JobName is the name of the migration Job.
+	JobName string `json:"jobName,omitempty"`
+	// SpecHash is the hash of the Job's pod spec, from its spec-hash annotation.
+	SpecHash string `json:"specHash,omitempty"`
+	// StartTime is when the Job started running.
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+	// CompletionTime is when the Job finished.
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+// The number of migration records kept in the status.
+const MaxHistory = 10
+
+// MigratorStatus defines the observed state of Migrator
+type MigratorStatus struct {
+	// Represents the observations of a Migrator's current state.
+	// Known .status.conditions.type are: Ready, MigrationsReady, ServiceAccountMismatch, MigrationCancelled,
+	// Suspended
+	// +patchMergeKey=type
+	// +patchStrategy=merge
+	// +listType=map
+	// +listMapKey=type
+	Conditions []conditions.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
+	// History is the most recent finished migrations, newest first.
+	History []MigrationRecord `json:"history,omitempty"`
+	// ServiceAccountName is the ServiceAccount the migration Job runs as.
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// ObservedGeneration is the .metadata.generation the status was last computed from.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// CurrentTarget is the image being migrated right now, if a migration Job is running.
+	CurrentTarget string `json:"currentTarget,omitempty"`
+	// CurrentJob is the name of the running migration Job.
+	CurrentJob string `json:"currentJob,omitempty"`
+	// LastAttemptTime is when the most recent migration Job was started.
+	LastAttemptTime *metav1.Time `json:"lastAttemptTime,omitempty"`
+	// LastSuccessTime is when the most recent successful migration Job finished.
+	LastSuccessTime *metav1.Time `json:"lastSuccessTime,omitempty"`
+	// LastDuration is how long the most recent finished migration Job ran for.
+	LastDuration *metav1.Duration `json:"lastDuration,omitempty"`
+	// BlockedPods is the number of matching pods currently held back by a migration waiter.
+	BlockedPods int32 `json:"blockedPods,omitempty"`
+}
+
+// LastSuccessfulRecord returns the newest successful migration, or nil.
+func (s *MigratorStatus) LastSuccessfulRecord() *MigrationRecord {
+	for i := range s.History {
+		if s.History[i].Result == MigrationResultSucceeded {
+			return &s.History[i]
+		}
+	}
+	return nil
+}
+
+// LastSuccessfulMigration returns the image of the newest successful migration, or an empty string.
+func (s *MigratorStatus) LastSuccessfulMigration() string {
+	record := s.LastSuccessfulRecord()
+	if record == nil {
+		return ""
+	}
+	return record.Image
+}
+
+// RecordMigration adds a finished migration to the history, unless it is already the newest record.
+func (s *MigratorStatus) RecordMigration(record MigrationRecord) {
+	if len(s.History) != 0 {
+		newest := s.History[0]
+		if newest.JobName == record.JobName && newest.Image == record.Image && newest.Result == record.Result && newest.StartTime.Equal(record.StartTime) {
+			return
+		}
+	}
+	s.History = append([]MigrationRecord{record}, s.History...)
+	if len(s.History) > MaxHistory {
+		s.History = s.History[:MaxHistory]
+	}
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:storageversion
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="MigrationsReady")].status`
+// +kubebuilder:printcolumn:name="Target",type=string,JSONPath=`.status.currentTarget`
+// +kubebuilder:printcolumn:name="Job",type=string,JSONPath=`.status.currentJob`
+// +kubebuilder:printcolumn:name="Blocked",type=integer,JSONPath=`.status.blockedPods`
+// +kubebuilder:printcolumn:name="Last Success",type=date,JSONPath=`.status.lastSuccessTime`
+// +kubebuilder:printcolumn:name="Duration",type=string,JSONPath=`.status.lastDuration`,priority=1
+// +kubebuilder:printcolumn:name="Suspended",type=boolean,JSONPath=`.spec.suspend`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// Migrator is the Schema for the migrators API
+type Migrator struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MigratorSpec   `json:"spec,omitempty"`
+	Status MigratorStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MigratorList contains a list of Migrator
+type MigratorList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Migrator `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Migrator{}, &MigratorList{})
+}
+
+// TODO code generator for this.
+func (o *Migrator) GetConditions() *[]conditions.Condition {
+	return &o.Status.Conditions
+}
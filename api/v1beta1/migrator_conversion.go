@@ -0,0 +1,202 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+// The annotation used to carry the v1 migration history, which v1beta1 can't represent, through a round
+// trip.
+const HISTORY_ANNOTATION = "migrations.coderanger.net/v1-history"
+
+// ConvertTo converts this Migrator to the hub version.
+func (src *Migrator) ConvertTo(dstRaw conversion.Hub) error {
+	dst := dstRaw.(*migrationsv1.Migrator)
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+
+	src = src.DeepCopy()
+	dst.Spec = migrationsv1.MigratorSpec{
+		Selector:          src.Spec.Selector,
+		TemplateSelector:  src.Spec.TemplateSelector,
+		Container:         src.Spec.Container,
+		Suspend:           src.Spec.Suspend,
+		SuspendRunningJob: src.Spec.SuspendRunningJob,
+		Job: migrationsv1.MigrationJobSpec{
+			Image:              src.Spec.Image,
+			Env:                src.Spec.Env,
+			RemoveEnv:          src.Spec.RemoveEnv,
+			EnvFrom:            src.Spec.EnvFrom,
+			RemoveEnvFrom:      src.Spec.RemoveEnvFrom,
+			Resources:          src.Spec.Resources,
+			ServiceAccountName: src.Spec.ServiceAccountName,
+			PodLabels:          src.Spec.Labels,
+			PodAnnotations:     src.Spec.Annotations,
+			InheritLabels:      (*migrationsv1.InheritRules)(src.Spec.InheritLabels),
+			InheritAnnotations: (*migrationsv1.InheritRules)(src.Spec.InheritAnnotations),
+			InitContainers:     (*migrationsv1.InitContainerFilter)(src.Spec.InitContainers),
+			Sidecars: migrationsv1.SidecarSpec{
+				Containers:  src.Spec.Sidecars,
+				Mode:        migrationsv1.SidecarMode(src.Spec.SidecarMode),
+				ShutdownURL: src.Spec.SidecarShutdownURL,
+			},
+			SuccessfulJobRetention:         migrationsv1.JobRetention(src.Spec.SuccessfulJobRetention),
+			SpecChangePolicy:               migrationsv1.SpecChangePolicy(src.Spec.SpecChangePolicy),
+			CancellationPolicy:             migrationsv1.CancellationPolicy(src.Spec.CancellationPolicy),
+			CancellationGracePeriodSeconds: src.Spec.CancellationGracePeriodSeconds,
+		},
+		Waiter: migrationsv1.WaiterSpec{
+			FailurePolicy:         migrationsv1.WaiterPolicy(src.Spec.Waiter.FailurePolicy),
+			MissingMigratorPolicy: migrationsv1.WaiterPolicy(src.Spec.Waiter.MissingMigratorPolicy),
+			Timeout:               src.Spec.Waiter.Timeout,
+			Mode:                  migrationsv1.WaiterMode(src.Spec.Waiter.Mode),
+		},
+	}
+	if src.Spec.Command != nil {
+		dst.Spec.Job.Command = *src.Spec.Command
+	}
+	if src.Spec.Args != nil {
+		dst.Spec.Job.Args = *src.Spec.Args
+	}
+	if src.Spec.DisableSanitizers != nil {
+		dst.Spec.Job.DisableSanitizers = make([]migrationsv1.Sanitizer, len(src.Spec.DisableSanitizers))
+		for i, s := range src.Spec.DisableSanitizers {
+			dst.Spec.Job.DisableSanitizers[i] = migrationsv1.Sanitizer(s)
+		}
+	}
+
+	dst.Status = migrationsv1.MigratorStatus{
+		Conditions:         src.Status.Conditions,
+		ServiceAccountName: src.Status.ServiceAccountName,
+		ObservedGeneration: src.Status.ObservedGeneration,
+		CurrentTarget:      src.Status.CurrentTarget,
+		CurrentJob:         src.Status.CurrentJob,
+		LastAttemptTime:    src.Status.LastAttemptTime,
+		LastSuccessTime:    src.Status.LastSuccessTime,
+		LastDuration:       src.Status.LastDuration,
+		BlockedPods:        src.Status.BlockedPods,
+	}
+	// Restore the full history if this object came from v1, otherwise all we know is the last success.
+	data, ok := dst.Annotations[HISTORY_ANNOTATION]
+	if ok {
+		err := json.Unmarshal([]byte(data), &dst.Status.History)
+		if err != nil {
+			return errors.Wrapf(err, "error decoding %s annotation", HISTORY_ANNOTATION)
+		}
+		delete(dst.Annotations, HISTORY_ANNOTATION)
+		if len(dst.Annotations) == 0 {
+			dst.Annotations = nil
+		}
+	}
+	if dst.Status.LastSuccessfulMigration() != src.Status.LastSuccessfulMigration && src.Status.LastSuccessfulMigration != "" {
+		dst.Status.History = append([]migrationsv1.MigrationRecord{{
+			Image:  src.Status.LastSuccessfulMigration,
+			Result: migrationsv1.MigrationResultSucceeded,
+		}}, dst.Status.History...)
+	}
+	return nil
+}
+
+// ConvertFrom converts from the hub version to this version.
+func (dst *Migrator) ConvertFrom(srcRaw conversion.Hub) error {
+	src := srcRaw.(*migrationsv1.Migrator).DeepCopy()
+	dst.ObjectMeta = src.ObjectMeta
+
+	dst.Spec = MigratorSpec{
+		Selector:                       src.Spec.Selector,
+		TemplateSelector:               src.Spec.TemplateSelector,
+		Suspend:                        src.Spec.Suspend,
+		SuspendRunningJob:              src.Spec.SuspendRunningJob,
+		Image:                          src.Spec.Job.Image,
+		Container:                      src.Spec.Container,
+		Labels:                         src.Spec.Job.PodLabels,
+		Annotations:                    src.Spec.Job.PodAnnotations,
+		Sidecars:                       src.Spec.Job.Sidecars.Containers,
+		SidecarMode:                    SidecarMode(src.Spec.Job.Sidecars.Mode),
+		SidecarShutdownURL:             src.Spec.Job.Sidecars.ShutdownURL,
+		InheritLabels:                  (*InheritRules)(src.Spec.Job.InheritLabels),
+		InheritAnnotations:             (*InheritRules)(src.Spec.Job.InheritAnnotations),
+		InitContainers:                 (*InitContainerFilter)(src.Spec.Job.InitContainers),
+		Env:                            src.Spec.Job.Env,
+		RemoveEnv:                      src.Spec.Job.RemoveEnv,
+		EnvFrom:                        src.Spec.Job.EnvFrom,
+		RemoveEnvFrom:                  src.Spec.Job.RemoveEnvFrom,
+		ServiceAccountName:             src.Spec.Job.ServiceAccountName,
+		Resources:                      src.Spec.Job.Resources,
+		SuccessfulJobRetention:         JobRetention(src.Spec.Job.SuccessfulJobRetention),
+		SpecChangePolicy:               SpecChangePolicy(src.Spec.Job.SpecChangePolicy),
+		CancellationPolicy:             CancellationPolicy(src.Spec.Job.CancellationPolicy),
+		CancellationGracePeriodSeconds: src.Spec.Job.CancellationGracePeriodSeconds,
+		Waiter: WaiterSpec{
+			FailurePolicy:         WaiterPolicy(src.Spec.Waiter.FailurePolicy),
+			MissingMigratorPolicy: WaiterPolicy(src.Spec.Waiter.MissingMigratorPolicy),
+			Timeout:               src.Spec.Waiter.Timeout,
+			Mode:                  WaiterMode(src.Spec.Waiter.Mode),
+		},
+	}
+	if src.Spec.Job.Command != nil {
+		dst.Spec.Command = &src.Spec.Job.Command
+	}
+	if src.Spec.Job.Args != nil {
+		dst.Spec.Args = &src.Spec.Job.Args
+	}
+	if src.Spec.Job.DisableSanitizers != nil {
+		dst.Spec.DisableSanitizers = make([]Sanitizer, len(src.Spec.Job.DisableSanitizers))
+		for i, s := range src.Spec.Job.DisableSanitizers {
+			dst.Spec.DisableSanitizers[i] = Sanitizer(s)
+		}
+	}
+
+	dst.Status = MigratorStatus{
+		Conditions:              src.Status.Conditions,
+		LastSuccessfulMigration: src.Status.LastSuccessfulMigration(),
+		ServiceAccountName:      src.Status.ServiceAccountName,
+		ObservedGeneration:      src.Status.ObservedGeneration,
+		CurrentTarget:           src.Status.CurrentTarget,
+		CurrentJob:              src.Status.CurrentJob,
+		LastAttemptTime:         src.Status.LastAttemptTime,
+		LastSuccessTime:         src.Status.LastSuccessTime,
+		LastDuration:            src.Status.LastDuration,
+		BlockedPods:             src.Status.BlockedPods,
+	}
+	// Stash the history unless it's exactly what ConvertTo would rebuild from the last success.
+	if !equality.Semantic.DeepEqual(src.Status.History, historyFor(dst.Status.LastSuccessfulMigration)) {
+		data, err := json.Marshal(src.Status.History)
+		if err != nil {
+			return errors.Wrap(err, "error encoding migration history")
+		}
+		if dst.Annotations == nil {
+			dst.Annotations = map[string]string{}
+		}
+		dst.Annotations[HISTORY_ANNOTATION] = string(data)
+	}
+	return nil
+}
+
+// historyFor builds the history implied by a v1beta1 status.
+func historyFor(lastSuccessfulMigration string) []migrationsv1.MigrationRecord {
+	if lastSuccessfulMigration == "" {
+		return nil
+	}
+	return []migrationsv1.MigrationRecord{{Image: lastSuccessfulMigration, Result: migrationsv1.MigrationResultSucceeded}}
+}
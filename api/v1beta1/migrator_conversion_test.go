@@ -0,0 +1,139 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1beta1
+
+import (
+	"math/rand"
+
+	fuzz "github.com/google/gofuzz"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/apitesting/fuzzer"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metafuzzer "k8s.io/apimachinery/pkg/apis/meta/fuzzer"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	runtimeserializer "k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/diff"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+// Normalize fields where nil and empty are the same on the wire, and drop the conversion annotation
+// since a random value for it can't round trip.
+func migratorFuzzerFuncs(_ runtimeserializer.CodecFactory) []interface{} {
+	return []interface{}{
+		func(m *Migrator, c fuzz.Continue) {
+			c.FuzzNoCustom(m)
+			normalizeObjectMeta(&m.ObjectMeta)
+			// A pointer to a nil slice is null on the wire, same as a nil pointer.
+			if m.Spec.Command != nil && *m.Spec.Command == nil {
+				m.Spec.Command = nil
+			}
+			if m.Spec.Args != nil && *m.Spec.Args == nil {
+				m.Spec.Args = nil
+			}
+		},
+		func(m *migrationsv1.Migrator, c fuzz.Continue) {
+			c.FuzzNoCustom(m)
+			normalizeObjectMeta(&m.ObjectMeta)
+			if len(m.Status.History) == 0 {
+				m.Status.History = nil
+			}
+		},
+		func(r *migrationsv1.MigrationResult, c fuzz.Continue) {
+			*r = []migrationsv1.MigrationResult{migrationsv1.MigrationResultSucceeded, migrationsv1.MigrationResultFailed}[c.Intn(2)]
+		},
+	}
+}
+
+func normalizeObjectMeta(meta *metav1.ObjectMeta) {
+	delete(meta.Annotations, HISTORY_ANNOTATION)
+	if len(meta.Annotations) == 0 {
+		meta.Annotations = nil
+	}
+}
+
+var _ = Describe("Migrator conversion", func() {
+	var f *fuzz.Fuzzer
+
+	BeforeEach(func() {
+		scheme := runtime.NewScheme()
+		Expect(AddToScheme(scheme)).To(Succeed())
+		Expect(migrationsv1.AddToScheme(scheme)).To(Succeed())
+		funcs := fuzzer.MergeFuzzerFuncs(metafuzzer.Funcs, migratorFuzzerFuncs)
+		f = fuzzer.FuzzerFor(funcs, rand.NewSource(GinkgoRandomSeed()), runtimeserializer.NewCodecFactory(scheme))
+	})
+
+	It("round trips v1beta1 through v1", func() {
+		for i := 0; i < 1000; i++ {
+			original := &Migrator{}
+			f.Fuzz(original)
+			hub := &migrationsv1.Migrator{}
+			Expect(original.DeepCopy().ConvertTo(hub)).To(Succeed())
+			result := &Migrator{}
+			Expect(result.ConvertFrom(hub)).To(Succeed())
+			Expect(equality.Semantic.DeepEqualWithNilDifferentFromEmpty(original, result)).To(BeTrue(), diff.ObjectReflectDiff(original, result))
+		}
+	})
+
+	It("round trips v1 through v1beta1", func() {
+		for i := 0; i < 1000; i++ {
+			original := &migrationsv1.Migrator{}
+			f.Fuzz(original)
+			spoke := &Migrator{}
+			Expect(spoke.ConvertFrom(original.DeepCopy())).To(Succeed())
+			result := &migrationsv1.Migrator{}
+			Expect(spoke.ConvertTo(result)).To(Succeed())
+			Expect(equality.Semantic.DeepEqualWithNilDifferentFromEmpty(original, result)).To(BeTrue(), diff.ObjectReflectDiff(original, result))
+		}
+	})
+
+	It("builds history from the last successful migration", func() {
+		spoke := &Migrator{Status: MigratorStatus{LastSuccessfulMigration: "myapp:v2"}}
+		hub := &migrationsv1.Migrator{}
+		Expect(spoke.ConvertTo(hub)).To(Succeed())
+		Expect(hub.Status.History).To(Equal([]migrationsv1.MigrationRecord{
+			{Image: "myapp:v2", Result: migrationsv1.MigrationResultSucceeded},
+		}))
+		Expect(hub.Annotations).To(BeNil())
+	})
+
+	It("keeps the full history through v1beta1", func() {
+		hub := &migrationsv1.Migrator{Status: migrationsv1.MigratorStatus{History: []migrationsv1.MigrationRecord{
+			{Image: "myapp:v3", Result: migrationsv1.MigrationResultFailed, JobName: "testing-migrations"},
+			{Image: "myapp:v2", Result: migrationsv1.MigrationResultSucceeded, JobName: "testing-migrations"},
+		}}}
+		spoke := &Migrator{}
+		Expect(spoke.ConvertFrom(hub)).To(Succeed())
+		Expect(spoke.Status.LastSuccessfulMigration).To(Equal("myapp:v2"))
+		Expect(spoke.Annotations).To(HaveKey(HISTORY_ANNOTATION))
+	})
+
+	It("records a success set through v1beta1", func() {
+		hub := &migrationsv1.Migrator{Status: migrationsv1.MigratorStatus{History: []migrationsv1.MigrationRecord{
+			{Image: "myapp:v2", Result: migrationsv1.MigrationResultSucceeded, JobName: "testing-migrations"},
+		}}}
+		spoke := &Migrator{}
+		Expect(spoke.ConvertFrom(hub)).To(Succeed())
+		spoke.Status.LastSuccessfulMigration = "myapp:v3"
+		result := &migrationsv1.Migrator{}
+		Expect(spoke.ConvertTo(result)).To(Succeed())
+		Expect(result.Status.LastSuccessfulMigration()).To(Equal("myapp:v3"))
+		Expect(result.Status.History).To(HaveLen(2))
+	})
+})
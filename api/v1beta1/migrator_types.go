@@ -18,21 +18,201 @@ package v1beta1
 
 import (
 	"github.com/coderanger/controller-utils/conditions"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // MigratorSpec defines the desired state of Migrator
 type MigratorSpec struct {
-	Selector         *metav1.LabelSelector `json:"selector"`
+	// Selector picks which pods to watch for changes and inject migration waiters into. It must not be
+	// empty.
+	Selector *metav1.LabelSelector `json:"selector"`
+	// TemplateSelector picks which of the selected pods to use as a template. Defaults to Selector.
 	TemplateSelector *metav1.LabelSelector `json:"templateSelector,omitempty"`
-	Command          *[]string             `json:"command,omitempty"`
-	Image            string                `json:"image,omitempty"`
-	Args             *[]string             `json:"args,omitempty"`
-	Container        string                `json:"container,omitempty"`
-	Labels           map[string]string     `json:"labels,omitempty"`
-	Annotations      map[string]string     `json:"annotations,omitempty"`
+	// Suspend stops new migration Jobs from being started until it is cleared.
+	Suspend bool `json:"suspend,omitempty"`
+	// SuspendRunningJob also suspends a running migration Job while the Migrator is suspended.
+	SuspendRunningJob bool      `json:"suspendRunningJob,omitempty"`
+	Command           *[]string `json:"command,omitempty"`
+	Image             string    `json:"image,omitempty"`
+	Args              *[]string `json:"args,omitempty"`
+	// Container is the name of the container or init container in the template pod to run migrations
+	// from. Defaults to the template pod's default container when one exists at admission.
+	// +kubebuilder:validation:MaxLength=63
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Container   string            `json:"container,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Sidecars is a list of container names from the template pod to keep in the migration Job, such as a
+	// database proxy or mesh sidecar needed to reach the database.
+	// +kubebuilder:validation:items:MaxLength=63
+	// +kubebuilder:validation:items:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	Sidecars []string `json:"sidecars,omitempty"`
+	// SidecarMode controls how kept sidecars are run. Native (the default) converts them to native sidecars
+	// so the Job completes when the migrations exit. Legacy keeps them as normal containers for clusters
+	// without native sidecar support, usually combined with SidecarShutdownURL.
+	SidecarMode SidecarMode `json:"sidecarMode,omitempty"`
+	// SidecarShutdownURL is an HTTP endpoint to POST to once the migration command exits, for example
+	// http://localhost:15020/quitquitquit for Istio. This requires a shell and curl or wget in the
+	// migration image, and a known command.
+	// +kubebuilder:validation:Pattern=`^https?://`
+	SidecarShutdownURL string `json:"sidecarShutdownURL,omitempty"`
+	// DisableSanitizers is a list of sanitizer rules to skip when cloning the template pod spec for the
+	// migration Job. All rules are enabled by default.
+	DisableSanitizers []Sanitizer `json:"disableSanitizers,omitempty"`
+	// InheritLabels controls which labels are copied from the template pod and its owner's pod template to
+	// the migration Job and its pod template. Nothing is copied by default.
+	InheritLabels *InheritRules `json:"inheritLabels,omitempty"`
+	// InheritAnnotations controls which annotations are copied from the template pod and its owner's pod
+	// template to the migration Job and its pod template. Nothing is copied by default.
+	InheritAnnotations *InheritRules `json:"inheritAnnotations,omitempty"`
+	// InitContainers controls which init containers from the template pod are kept in the migration Job.
+	// All are kept by default. Injected migration waiters are always removed.
+	InitContainers *InitContainerFilter `json:"initContainers,omitempty"`
+	// Env is a list of environment variables to set on the migration container. A variable with the same
+	// name as one from the template replaces it, anything else is added.
+	Env []corev1.EnvVar `json:"env,omitempty"`
+	// RemoveEnv is a list of environment variable names to remove from the migration container.
+	RemoveEnv []string `json:"removeEnv,omitempty"`
+	// EnvFrom is a list of sources to add to the migration container. A source referencing the same
+	// ConfigMap or Secret as one from the template replaces it.
+	EnvFrom []corev1.EnvFromSource `json:"envFrom,omitempty"`
+	// RemoveEnvFrom is a list of ConfigMap or Secret names to remove from the migration container's envFrom.
+	RemoveEnvFrom []string `json:"removeEnvFrom,omitempty"`
+	// ServiceAccountName is the ServiceAccount to run the migration Job as. If not set, the template pod's
+	// ServiceAccount is used.
+	// +kubebuilder:validation:MaxLength=253
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+	// Resources replaces the migration container's resource requests and limits. Defaults to the template
+	// container's resources when a template pod exists at admission.
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+	// SuccessfulJobRetention controls what happens to a migration Job once it succeeds. Delete (the default)
+	// removes it as soon as the success is recorded, Keep leaves it until the next migration replaces it.
+	SuccessfulJobRetention JobRetention `json:"successfulJobRetention,omitempty"`
+	// SpecChangePolicy controls whether a change to the migration Job's pod spec reruns migrations for an
+	// image which already migrated successfully.
+	SpecChangePolicy SpecChangePolicy `json:"specChangePolicy,omitempty"`
+	// CancellationPolicy controls what happens to a running migration Job once no pods want its image any
+	// more.
+	CancellationPolicy CancellationPolicy `json:"cancellationPolicy,omitempty"`
+	// CancellationGracePeriodSeconds is the termination grace period for the migration pods when a Job is
+	// cancelled with the Cancel policy.
+	// +kubebuilder:validation:Minimum=0
+	CancellationGracePeriodSeconds *int64 `json:"cancellationGracePeriodSeconds,omitempty"`
+	// Waiter controls how the migration waiters injected into matching pods behave.
+	Waiter WaiterSpec `json:"waiter,omitempty"`
+}
+
+// WaiterSpec controls the migration waiters injected into matching pods.
+type WaiterSpec struct {
+	// FailurePolicy controls what a waiter does when the newest migration Job for its image failed.
+	FailurePolicy WaiterPolicy `json:"failurePolicy,omitempty"`
+	// MissingMigratorPolicy controls what a waiter does when its Migrator doesn't exist.
+	MissingMigratorPolicy WaiterPolicy `json:"missingMigratorPolicy,omitempty"`
+	// Timeout is how long a waiter waits for migrations before exiting with an error.
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+	// Mode controls how a waiter checks for migrations, either through the operator's API or directly
+	// through the Kubernetes API.
+	Mode WaiterMode `json:"mode,omitempty"`
+}
+
+// InitContainerFilter selects init containers by name or glob pattern.
+type InitContainerFilter struct {
+	// Include is a list of init container names or patterns to keep. If empty, all are kept.
+	Include []string `json:"include,omitempty"`
+	// Exclude is a list of init container names or patterns to remove, even if they match Include.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// InheritRules is a set of glob patterns for metadata keys. A * matches any sequence of characters,
+// including slashes.
+type InheritRules struct {
+	// Include is a list of patterns for keys to copy. If empty, all keys are included.
+	Include []string `json:"include,omitempty"`
+	// Exclude is a list of patterns for keys to skip, even if they match Include.
+	Exclude []string `json:"exclude,omitempty"`
 }
 
+// +kubebuilder:validation:Enum=Native;Legacy
+type SidecarMode string
+
+const (
+	SidecarModeNative SidecarMode = "Native"
+	SidecarModeLegacy SidecarMode = "Legacy"
+)
+
+// JobRetention is what to do with a finished migration Job.
+// +kubebuilder:validation:Enum=Delete;Keep
+type JobRetention string
+
+const (
+	JobRetentionDelete JobRetention = "Delete"
+	JobRetentionKeep   JobRetention = "Keep"
+)
+
+// SpecChangePolicy is what to do when the migration Job's pod spec changes after a successful migration.
+// +kubebuilder:validation:Enum=Ignore;Rerun
+type SpecChangePolicy string
+
+const (
+	SpecChangePolicyIgnore SpecChangePolicy = "Ignore"
+	SpecChangePolicyRerun  SpecChangePolicy = "Rerun"
+)
+
+// CancellationPolicy is what to do with a running migration Job which nothing wants any more.
+// +kubebuilder:validation:Enum=Wait;Cancel;Suspend
+type CancellationPolicy string
+
+const (
+	CancellationPolicyWait    CancellationPolicy = "Wait"
+	CancellationPolicyCancel  CancellationPolicy = "Cancel"
+	CancellationPolicySuspend CancellationPolicy = "Suspend"
+)
+
+// WaiterPolicy is what a migration waiter does when migrations can't currently succeed.
+// +kubebuilder:validation:Enum=Wait;Fail
+type WaiterPolicy string
+
+const (
+	WaiterPolicyWait WaiterPolicy = "Wait"
+	WaiterPolicyFail WaiterPolicy = "Fail"
+)
+
+// +kubebuilder:validation:Enum=API;Direct
+type WaiterMode string
+
+const (
+	WaiterModeAPI    WaiterMode = "API"
+	WaiterModeDirect WaiterMode = "Direct"
+)
+
+// Sanitizer is a rule for removing fields from the cloned pod spec which don't make sense for a batch Job
+// and can leave the migration pod unschedulable or hanging on termination.
+// +kubebuilder:validation:Enum=Probes;Ports;HostPorts;Lifecycle;TopologySpread;SelfAntiAffinity;ReadWriteOnceVolumes;UnusedVolumes
+type Sanitizer string
+
+const (
+	// SanitizerProbes removes readiness, liveness and startup probes from the migration container.
+	SanitizerProbes Sanitizer = "Probes"
+	// SanitizerPorts removes container ports from the migration container.
+	SanitizerPorts Sanitizer = "Ports"
+	// SanitizerHostPorts removes hostPort from every container in the Job, including sidecars.
+	SanitizerHostPorts Sanitizer = "HostPorts"
+	// SanitizerLifecycle removes postStart and preStop hooks from the migration container.
+	SanitizerLifecycle Sanitizer = "Lifecycle"
+	// SanitizerTopologySpread removes pod topology spread constraints.
+	SanitizerTopologySpread Sanitizer = "TopologySpread"
+	// SanitizerSelfAntiAffinity removes pod anti-affinity terms matching the template pod's own labels.
+	SanitizerSelfAntiAffinity Sanitizer = "SelfAntiAffinity"
+	// SanitizerReadWriteOnceVolumes removes volumes backed by ReadWriteOnce PVCs, which are usually already
+	// attached to the application's node, along with their mounts.
+	SanitizerReadWriteOnceVolumes Sanitizer = "ReadWriteOnceVolumes"
+	// SanitizerUnusedVolumes removes volumes which no remaining container mounts.
+	SanitizerUnusedVolumes Sanitizer = "UnusedVolumes"
+)
+
 // MigratorStatus defines the observed state of Migrator
 type MigratorStatus struct {
 	// Represents the observations of a RabbitUsers's current state.
@@ -43,10 +223,20 @@ type MigratorStatus struct {
 	// +listMapKey=type
 	Conditions              []conditions.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
 	LastSuccessfulMigration string                 `json:"lastSuccessfulMigration,omitempty"`
+	// ServiceAccountName is the ServiceAccount the migration Job runs as.
+	ServiceAccountName string           `json:"serviceAccountName,omitempty"`
+	ObservedGeneration int64            `json:"observedGeneration,omitempty"`
+	CurrentTarget      string           `json:"currentTarget,omitempty"`
+	CurrentJob         string           `json:"currentJob,omitempty"`
+	LastAttemptTime    *metav1.Time     `json:"lastAttemptTime,omitempty"`
+	LastSuccessTime    *metav1.Time     `json:"lastSuccessTime,omitempty"`
+	LastDuration       *metav1.Duration `json:"lastDuration,omitempty"`
+	BlockedPods        int32            `json:"blockedPods,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:deprecatedversion:warning="migrations.coderanger.net/v1beta1 Migrator is deprecated, use migrations.coderanger.net/v1"
 
 // Migrator is the Schema for the migrators API
 type Migrator struct {
@@ -22,10 +22,61 @@ package v1beta1
 
 import (
 	"github.com/coderanger/controller-utils/conditions"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InheritRules) DeepCopyInto(out *InheritRules) {
+	*out = *in
+	if in.Include != nil {
+		in, out := &in.Include, &out.Include
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InheritRules.
+func (in *InheritRules) DeepCopy() *InheritRules {
+	if in == nil {
+		return nil
+	}
+	out := new(InheritRules)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InitContainerFilter) DeepCopyInto(out *InitContainerFilter) {
+	*out = *in
+	if in.Include != nil {
+		in, out := &in.Include, &out.Include
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Exclude != nil {
+		in, out := &in.Exclude, &out.Exclude
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InitContainerFilter.
+func (in *InitContainerFilter) DeepCopy() *InitContainerFilter {
+	if in == nil {
+		return nil
+	}
+	out := new(InitContainerFilter)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Migrator) DeepCopyInto(out *Migrator) {
 	*out = *in
@@ -130,6 +181,66 @@ func (in *MigratorSpec) DeepCopyInto(out *MigratorSpec) {
 			(*out)[key] = val
 		}
 	}
+	if in.Sidecars != nil {
+		in, out := &in.Sidecars, &out.Sidecars
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.DisableSanitizers != nil {
+		in, out := &in.DisableSanitizers, &out.DisableSanitizers
+		*out = make([]Sanitizer, len(*in))
+		copy(*out, *in)
+	}
+	if in.InheritLabels != nil {
+		in, out := &in.InheritLabels, &out.InheritLabels
+		*out = new(InheritRules)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.InheritAnnotations != nil {
+		in, out := &in.InheritAnnotations, &out.InheritAnnotations
+		*out = new(InheritRules)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.InitContainers != nil {
+		in, out := &in.InitContainers, &out.InitContainers
+		*out = new(InitContainerFilter)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Env != nil {
+		in, out := &in.Env, &out.Env
+		*out = make([]corev1.EnvVar, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RemoveEnv != nil {
+		in, out := &in.RemoveEnv, &out.RemoveEnv
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.EnvFrom != nil {
+		in, out := &in.EnvFrom, &out.EnvFrom
+		*out = make([]corev1.EnvFromSource, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.RemoveEnvFrom != nil {
+		in, out := &in.RemoveEnvFrom, &out.RemoveEnvFrom
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.Resources != nil {
+		in, out := &in.Resources, &out.Resources
+		*out = new(corev1.ResourceRequirements)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.CancellationGracePeriodSeconds != nil {
+		in, out := &in.CancellationGracePeriodSeconds, &out.CancellationGracePeriodSeconds
+		*out = new(int64)
+		**out = **in
+	}
+	in.Waiter.DeepCopyInto(&out.Waiter)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MigratorSpec.
@@ -152,6 +263,19 @@ func (in *MigratorStatus) DeepCopyInto(out *MigratorStatus) {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
 	}
+	if in.LastAttemptTime != nil {
+		in, out := &in.LastAttemptTime, &out.LastAttemptTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastSuccessTime != nil {
+		in, out := &in.LastSuccessTime, &out.LastSuccessTime
+		*out = (*in).DeepCopy()
+	}
+	if in.LastDuration != nil {
+		in, out := &in.LastDuration, &out.LastDuration
+		*out = new(v1.Duration)
+		**out = **in
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MigratorStatus.
@@ -163,3 +287,23 @@ func (in *MigratorStatus) DeepCopy() *MigratorStatus {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WaiterSpec) DeepCopyInto(out *WaiterSpec) {
+	*out = *in
+	if in.Timeout != nil {
+		in, out := &in.Timeout, &out.Timeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WaiterSpec.
+func (in *WaiterSpec) DeepCopy() *WaiterSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(WaiterSpec)
+	in.DeepCopyInto(out)
+	return out
+}
@@ -0,0 +1,139 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	mohttp "github.com/coderanger/migrations-operator/http"
+)
+
+// directChecker watches the Migrator through the Kubernetes API, so waiters keep working while the operator
+// is down. The webhook mounts the token of a ServiceAccount the operator created for this Migrator, which can
+// only read this one Migrator, so everything has to be filtered down to it by name.
+type directChecker struct {
+	client client.WithWatch
+	cfg    *config
+	host   string
+}
+
+func newDirectChecker(cfg *config) (*directChecker, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("direct mode requires KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT")
+	}
+	restConfig := &rest.Config{
+		Host: "https://" + net.JoinHostPort(host, port),
+		// The token file is re-read as the kubelet rotates it.
+		BearerTokenFile: cfg.kubeTokenFile,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: cfg.kubeCAFile},
+		UserAgent:       "migrations-waiter",
+	}
+
+	scheme := runtime.NewScheme()
+	err := migrationsv1.AddToScheme(scheme)
+	if err != nil {
+		return nil, err
+	}
+	// A fixed mapping avoids needing discovery, which would be one more thing that can fail at startup.
+	mapper := meta.NewDefaultRESTMapper([]schema.GroupVersion{migrationsv1.GroupVersion})
+	mapper.Add(migrationsv1.GroupVersion.WithKind("Migrator"), meta.RESTScopeNamespace)
+	c, err := client.NewWithWatch(restConfig, client.Options{Scheme: scheme, Mapper: mapper})
+	if err != nil {
+		return nil, err
+	}
+	return &directChecker{client: c, cfg: cfg, host: restConfig.Host}, nil
+}
+
+func (d *directChecker) check(wait time.Duration, lastState mohttp.ReadyState) (*mohttp.ReadyResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.cfg.requestTimeout+wait)
+	defer cancel()
+
+	selector := fields.OneTermEqualSelector("metadata.name", d.cfg.migratorName)
+	migrators := &migrationsv1.MigratorList{}
+	err := d.client.List(ctx, migrators, &client.ListOptions{Namespace: d.cfg.migratorNamespace, FieldSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	ready := mohttp.NotFoundStatus(d.cfg.migratorNamespace, d.cfg.migratorName)
+	if len(migrators.Items) != 0 {
+		ready = mohttp.ReadyStatus(&migrators.Items[0], d.cfg.targetImage)
+	}
+	timeoutSeconds := int64(wait / time.Second)
+	if ready.State != lastState || timeoutSeconds <= 0 {
+		return ready, nil
+	}
+
+	// Nothing has changed yet, so watch for a change the same way the ready API long-polls.
+	w, err := d.client.Watch(ctx, &migrationsv1.MigratorList{}, &client.ListOptions{
+		Namespace:     d.cfg.migratorNamespace,
+		FieldSelector: selector,
+		Raw:           &metav1.ListOptions{ResourceVersion: migrators.ResourceVersion, TimeoutSeconds: &timeoutSeconds},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ready, nil
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				// The watch timed out without a change.
+				return ready, nil
+			}
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				migrator, ok := event.Object.(*migrationsv1.Migrator)
+				if !ok {
+					return nil, fmt.Errorf("unexpected object in watch: %T", event.Object)
+				}
+				ready = mohttp.ReadyStatus(migrator, d.cfg.targetImage)
+			case watch.Deleted:
+				ready = mohttp.NotFoundStatus(d.cfg.migratorNamespace, d.cfg.migratorName)
+			case watch.Error:
+				return nil, kerrors.FromObject(event.Object)
+			}
+			if ready.State != lastState {
+				return ready, nil
+			}
+		}
+	}
+}
+
+func (d *directChecker) next() {}
+
+func (d *directChecker) endpoint() string {
+	return d.host
+}
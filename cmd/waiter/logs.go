@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mohttp "github.com/coderanger/migrations-operator/http"
+)
+
+// How long to wait before looking for migration logs again when there are none or the stream ended.
+const LOGS_RETRY_INTERVAL = 5 * time.Second
+
+// errLogsForbidden means the operator won't show this waiter the logs, which won't change by retrying.
+var errLogsForbidden = errors.New("forbidden")
+
+// tailLogs follows the logs of the Migrator's running migration Job through the operator's API, printing
+// each line prefixed with the pod name. It runs until the waiter exits.
+func tailLogs(client *http.Client, cfg *config) {
+	// Lines already printed from each pod, so they aren't repeated when the stream is reopened.
+	printed := map[string]int{}
+	endpoint := 0
+	lastErr := ""
+	for {
+		err := followLogs(client, cfg, cfg.apiHosts[endpoint], printed)
+		if err == errLogsForbidden {
+			log.Printf("Not following migration logs, the operator didn't recognize this pod's token as a waiter for %s/%s", cfg.migratorNamespace, cfg.migratorName)
+			return
+		}
+		if err != nil {
+			// Only mention each new problem once, logs are a nicety and shouldn't drown out the waiter.
+			if err.Error() != lastErr {
+				log.Printf("Error following migration logs: %v", err)
+				lastErr = err.Error()
+			}
+			endpoint = (endpoint + 1) % len(cfg.apiHosts)
+		} else {
+			lastErr = ""
+		}
+		time.Sleep(jitter(LOGS_RETRY_INTERVAL))
+	}
+}
+
+// followLogs streams the current migration logs from one API server until the stream ends.
+func followLogs(client *http.Client, cfg *config, apiHost string, printed map[string]int) error {
+	query := url.Values{"namespace": {cfg.migratorNamespace}, "migrator": {cfg.migratorName}}
+	logsUrl := fmt.Sprintf("%s://%s/api/v1/logs?%s", apiScheme(cfg), apiHost, query.Encode())
+	req, err := http.NewRequest(http.MethodGet, logsUrl, nil)
+	if err != nil {
+		return err
+	}
+	err = setToken(req, cfg)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		// No migration is running right now.
+		return nil
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return errLogsForbidden
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected response from %s (HTTP %d): %s", logsUrl, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	pod := resp.Header.Get(mohttp.LOGS_POD_HEADER)
+	skip := printed[pod]
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if skip > 0 {
+			skip--
+			continue
+		}
+		log.Printf("[%s] %s", pod, scanner.Text())
+		printed[pod]++
+	}
+	return scanner.Err()
+}
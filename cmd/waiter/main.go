@@ -18,55 +18,446 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	mohttp "github.com/coderanger/migrations-operator/http"
+	"github.com/coderanger/migrations-operator/webhook"
 )
 
+// Where Kubernetes reads a container's termination message from by default, so the reason a waiter failed
+// shows up in kubectl describe pod.
+const TERMINATION_LOG = "/dev/termination-log"
+
+// Where the webhook mounts the projected ServiceAccount token for the operator's API.
+const DEFAULT_TOKEN_FILE = webhook.WAITER_TOKEN_MOUNT_PATH + "/token"
+
+// Where the webhook mounts the Kubernetes API token and cluster CA for direct mode.
+const (
+	DEFAULT_KUBE_TOKEN_FILE = webhook.WAITER_KUBE_TOKEN_MOUNT_PATH + "/token"
+	DEFAULT_KUBE_CA_FILE    = webhook.WAITER_KUBE_TOKEN_MOUNT_PATH + "/ca.crt"
+)
+
+// The ways a waiter can check for migrations, see WaiterMode in the API.
+const (
+	MODE_API    = "api"
+	MODE_DIRECT = "direct"
+)
+
+type config struct {
+	mode              string
+	targetImage       string
+	migratorNamespace string
+	migratorName      string
+	apiHosts          []string
+	tokenFile         string
+	caBundle          []byte
+	kubeTokenFile     string
+	kubeCAFile        string
+	logs              bool
+	failOnFailure     bool
+	failOnMissing     bool
+	timeout           time.Duration
+	requestTimeout    time.Duration
+	wait              time.Duration
+	minInterval       time.Duration
+	maxInterval       time.Duration
+}
+
+// A checker looks up the state of migrations, waiting for up to wait for it to change from lastState.
+type checker interface {
+	check(wait time.Duration, lastState mohttp.ReadyState) (*mohttp.ReadyResponse, error)
+	// next moves on to the next endpoint after an error, if there is more than one.
+	next()
+	// endpoint describes where the checker is currently looking, for logging.
+	endpoint() string
+}
+
+// permanentError is an error from the API which retrying won't fix.
+type permanentError struct {
+	msg string
+}
+
+func (e *permanentError) Error() string {
+	return e.msg
+}
+
 func main() {
-	if len(os.Args) != 5 {
-		log.Fatal("Incorrect number of arguments")
+	cfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		fail("Invalid configuration: %v", err)
+	}
+	var check checker
+	if cfg.mode == MODE_DIRECT {
+		check, err = newDirectChecker(cfg)
+	} else {
+		var api *apiChecker
+		api, err = newAPIChecker(cfg)
+		if err == nil && cfg.logs {
+			go tailLogs(api.streamClient, cfg)
+		}
+		check = api
+	}
+	if err != nil {
+		fail("Invalid configuration: %v", err)
 	}
-	targetImage := os.Args[1]
-	migratorNamespace := os.Args[2]
-	migratorName := os.Args[3]
-	apiUrl := fmt.Sprintf("http://%s/api/ready", os.Args[4])
 
-	log.Printf("Polling for migrator %s at image %s", migratorName, targetImage)
+	var deadline time.Time
+	if cfg.timeout > 0 {
+		deadline = time.Now().Add(cfg.timeout)
+	}
+
+	log.Printf("Polling for migrator %s at image %s", cfg.migratorName, cfg.targetImage)
+	interval := cfg.minInterval
+	var lastState mohttp.ReadyState
+	var lastErr error
 	for {
-		ready, err := migratorReady(targetImage, migratorNamespace, migratorName, apiUrl)
+		wait := cfg.wait
+		if !deadline.IsZero() && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+		start := time.Now()
+		ready, err := check.check(wait, lastState)
+		// Go straight back to waiting if the API server held the request open, or if something just changed.
+		again := false
 		if err != nil {
-			log.Fatalf("Error while polling: %v", err)
+			var perm *permanentError
+			if errors.As(err, &perm) {
+				fail("Error while polling: %v", err)
+			}
+			// Transient errors, like the operator restarting, are retried against the next endpoint.
+			log.Printf("Error while polling %s, retrying: %v", check.endpoint(), err)
+			lastErr = err
+			check.next()
+		} else {
+			if ready.State == mohttp.ReadyStateReady {
+				break
+			}
+			if ready.State == mohttp.ReadyStateFailed && cfg.failOnFailure {
+				fail("Migrations for %s failed: %s", cfg.targetImage, ready.Message)
+			}
+			if ready.State == mohttp.ReadyStateNotFound && cfg.failOnMissing {
+				fail("Migrator %s/%s does not exist", cfg.migratorNamespace, cfg.migratorName)
+			}
+			logReady(cfg.migratorName, ready)
+			if ready.State != lastState || (wait > 0 && time.Since(start) >= wait/2) {
+				again = true
+				interval = cfg.minInterval
+			}
+			lastState = ready.State
+			lastErr = nil
+		}
+
+		if again {
+			continue
+		}
+		sleep := jitter(interval)
+		if !deadline.IsZero() {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				if lastErr != nil {
+					fail("Timed out after %s waiting for migrations for %s, last error: %v", cfg.timeout, cfg.targetImage, lastErr)
+				}
+				fail("Timed out after %s waiting for migrations for %s, migrator %s is %s", cfg.timeout, cfg.targetImage, cfg.migratorName, lastState)
+			}
+			if sleep > remaining {
+				sleep = remaining
+			}
 		}
-		if ready {
-			break
+		time.Sleep(sleep)
+		interval *= 2
+		if interval > cfg.maxInterval {
+			interval = cfg.maxInterval
 		}
-		time.Sleep(5 * time.Second)
 	}
 	log.Printf("Migrations ready, exiting")
 }
 
-func migratorReady(targetImage, migratorNamespace, migratorName, apiUrl string) (bool, error) {
-	args := &mohttp.ReadyArgs{TargetImage: targetImage, MigratorNamespace: migratorNamespace, MigratorName: migratorName}
+// parseConfig reads the waiter's settings from flags, falling back to environment variables. The original
+// positional form of image, Migrator namespace, Migrator name and API host is still accepted for waiters
+// injected by older versions of the operator.
+func parseConfig(args []string) (*config, error) {
+	cfg := &config{}
+	var apiHosts string
+	var err error
+	flags := flag.NewFlagSet("waiter", flag.ContinueOnError)
+	mode := os.Getenv("WAITER_MODE")
+	if mode == "" {
+		mode = MODE_API
+	}
+	flags.StringVar(&cfg.mode, "mode", mode, "how to check for migrations, api to ask the operator or direct to watch the Migrator through the Kubernetes API [WAITER_MODE]")
+	flags.StringVar(&cfg.targetImage, "image", os.Getenv("WAITER_TARGET_IMAGE"), "image to wait for migrations for [WAITER_TARGET_IMAGE]")
+	flags.StringVar(&cfg.migratorNamespace, "namespace", os.Getenv("WAITER_MIGRATOR_NAMESPACE"), "namespace of the Migrator [WAITER_MIGRATOR_NAMESPACE]")
+	flags.StringVar(&cfg.migratorName, "migrator", os.Getenv("WAITER_MIGRATOR_NAME"), "name of the Migrator [WAITER_MIGRATOR_NAME]")
+	tokenFile := os.Getenv("WAITER_TOKEN_FILE")
+	if tokenFile == "" {
+		tokenFile = DEFAULT_TOKEN_FILE
+	}
+	flags.StringVar(&cfg.tokenFile, "token-file", tokenFile, "file to read the API bearer token from, if it exists [WAITER_TOKEN_FILE]")
+	var caFile string
+	flags.StringVar(&caFile, "ca-file", os.Getenv("WAITER_CA_FILE"), "CA bundle to verify the API server with, which enables HTTPS [WAITER_CA_FILE]")
+	kubeTokenFile := os.Getenv("WAITER_KUBE_TOKEN_FILE")
+	if kubeTokenFile == "" {
+		kubeTokenFile = DEFAULT_KUBE_TOKEN_FILE
+	}
+	flags.StringVar(&cfg.kubeTokenFile, "kube-token-file", kubeTokenFile, "file to read the Kubernetes API bearer token from in direct mode [WAITER_KUBE_TOKEN_FILE]")
+	kubeCAFile := os.Getenv("WAITER_KUBE_CA_FILE")
+	if kubeCAFile == "" {
+		kubeCAFile = DEFAULT_KUBE_CA_FILE
+	}
+	flags.StringVar(&cfg.kubeCAFile, "kube-ca-file", kubeCAFile, "CA bundle to verify the Kubernetes API server with in direct mode [WAITER_KUBE_CA_FILE]")
+	flags.StringVar(&apiHosts, "api", os.Getenv("WAITER_API_HOSTS"), "comma-separated host:port list of operator API servers, tried in turn [WAITER_API_HOSTS]")
+	cfg.logs = true
+	if os.Getenv("WAITER_LOGS") != "" {
+		cfg.logs, err = envBool("WAITER_LOGS")
+		if err != nil {
+			return nil, err
+		}
+	}
+	flags.BoolVar(&cfg.logs, "logs", cfg.logs, "print the logs of the running migration while waiting, in api mode [WAITER_LOGS]")
+	cfg.failOnFailure, err = envBool("WAITER_FAIL_ON_FAILURE")
+	if err != nil {
+		return nil, err
+	}
+	flags.BoolVar(&cfg.failOnFailure, "fail-on-failure", cfg.failOnFailure, "exit with an error if the newest migration for the image failed [WAITER_FAIL_ON_FAILURE]")
+	cfg.failOnMissing, err = envBool("WAITER_FAIL_ON_MISSING")
+	if err != nil {
+		return nil, err
+	}
+	flags.BoolVar(&cfg.failOnMissing, "fail-on-missing", cfg.failOnMissing, "exit with an error if the Migrator doesn't exist [WAITER_FAIL_ON_MISSING]")
+	durations := []struct {
+		target *time.Duration
+		name   string
+		env    string
+		def    time.Duration
+		usage  string
+	}{
+		{&cfg.timeout, "timeout", "WAITER_TIMEOUT", 0, "exit with an error if migrations aren't ready in time, 0 waits forever"},
+		{&cfg.requestTimeout, "request-timeout", "WAITER_REQUEST_TIMEOUT", 10 * time.Second, "timeout for each request to the API"},
+		{&cfg.wait, "wait", "WAITER_WAIT", time.Minute, "how long the API server holds each request waiting for a change, 0 polls instead"},
+		{&cfg.minInterval, "min-interval", "WAITER_MIN_INTERVAL", 2 * time.Second, "initial time between polls"},
+		{&cfg.maxInterval, "max-interval", "WAITER_MAX_INTERVAL", 30 * time.Second, "maximum time between polls"},
+	}
+	for _, d := range durations {
+		def, err := envDuration(d.env, d.def)
+		if err != nil {
+			return nil, err
+		}
+		flags.DurationVar(d.target, d.name, def, fmt.Sprintf("%s [%s]", d.usage, d.env))
+	}
+	err = flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	switch flags.NArg() {
+	case 0:
+	case 4:
+		cfg.targetImage = flags.Arg(0)
+		cfg.migratorNamespace = flags.Arg(1)
+		cfg.migratorName = flags.Arg(2)
+		apiHosts = flags.Arg(3)
+	default:
+		return nil, errors.New("incorrect number of arguments")
+	}
+
+	// The webhook passes the CA bundle in the environment directly.
+	if caFile != "" {
+		cfg.caBundle, err = os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+	} else if caBundle := os.Getenv("WAITER_CA_BUNDLE"); caBundle != "" {
+		cfg.caBundle = []byte(caBundle)
+	}
+
+	for _, host := range strings.Split(apiHosts, ",") {
+		host = strings.TrimSpace(host)
+		if host != "" {
+			cfg.apiHosts = append(cfg.apiHosts, host)
+		}
+	}
+	cfg.mode = strings.ToLower(cfg.mode)
+	if cfg.mode != MODE_API && cfg.mode != MODE_DIRECT {
+		return nil, fmt.Errorf("unknown mode %q", cfg.mode)
+	}
+	if cfg.targetImage == "" || cfg.migratorNamespace == "" || cfg.migratorName == "" {
+		return nil, errors.New("image, namespace and migrator are required")
+	}
+	if cfg.mode == MODE_API && len(cfg.apiHosts) == 0 {
+		return nil, errors.New("api is required unless using direct mode")
+	}
+	if cfg.requestTimeout <= 0 || cfg.minInterval <= 0 || cfg.maxInterval < cfg.minInterval || cfg.wait < 0 {
+		return nil, errors.New("request-timeout and min-interval must be positive, max-interval at least min-interval and wait not negative")
+	}
+	return cfg, nil
+}
+
+func envBool(name string) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return b, nil
+}
+
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return d, nil
+}
+
+// jitter picks a random duration between half and all of d, so waiters started together spread out.
+func jitter(d time.Duration) time.Duration {
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// fail exits with an error, recording it as the container's termination message.
+func fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	err := os.WriteFile(TERMINATION_LOG, []byte(msg), 0644)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Error writing termination message: %v", err)
+	}
+	log.Fatal(msg)
+}
+
+func logReady(migratorName string, ready *mohttp.ReadyResponse) {
+	line := fmt.Sprintf("Migrator %s is %s (%s): %s", migratorName, ready.State, ready.Reason, ready.Message)
+	if ready.CurrentJob != "" {
+		line += fmt.Sprintf(" [job %s, attempt %d]", ready.CurrentJob, ready.Attempt)
+	} else if ready.Attempt != 0 {
+		line += fmt.Sprintf(" [attempt %d]", ready.Attempt)
+	}
+	if ready.LastSuccess != nil {
+		line += fmt.Sprintf(" [last success %s]", ready.LastSuccess.Image)
+	}
+	log.Print(line)
+}
+
+// apiChecker asks the operator's ready API, rotating between API servers on errors.
+type apiChecker struct {
+	client *http.Client
+	// streamClient has no overall timeout, for requests which stay open as long as there's data.
+	streamClient *http.Client
+	cfg          *config
+	current      int
+}
+
+func newAPIChecker(cfg *config) (*apiChecker, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.caBundle != nil {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(cfg.caBundle) {
+			return nil, errors.New("no certificates found in CA bundle")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &apiChecker{
+		// Long-polls hold the request open for up to the wait on top of the usual request time.
+		client:       &http.Client{Transport: transport, Timeout: cfg.requestTimeout + cfg.wait},
+		streamClient: &http.Client{Transport: transport},
+		cfg:          cfg,
+	}, nil
+}
+
+func (a *apiChecker) check(wait time.Duration, lastState mohttp.ReadyState) (*mohttp.ReadyResponse, error) {
+	return migratorReady(a.client, a.cfg, a.cfg.apiHosts[a.current], wait, lastState)
+}
+
+func (a *apiChecker) next() {
+	a.current = (a.current + 1) % len(a.cfg.apiHosts)
+}
+
+func (a *apiChecker) endpoint() string {
+	return a.cfg.apiHosts[a.current]
+}
+
+func migratorReady(client *http.Client, cfg *config, apiHost string, wait time.Duration, lastState mohttp.ReadyState) (*mohttp.ReadyResponse, error) {
+	apiUrl := fmt.Sprintf("%s://%s/api/v1/ready", apiScheme(cfg), apiHost)
+	args := &mohttp.ReadyArgs{
+		TargetImage:       cfg.targetImage,
+		MigratorNamespace: cfg.migratorNamespace,
+		MigratorName:      cfg.migratorName,
+		WaitSeconds:       int(wait / time.Second),
+		LastState:         lastState,
+	}
 	data, err := json.Marshal(args)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	resp, err := http.Post(apiUrl, "application/json", bytes.NewBuffer(data))
+	req, err := http.NewRequest(http.MethodPost, apiUrl, bytes.NewBuffer(data))
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	err = setToken(req, cfg)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	ready := &mohttp.ReadyResponse{}
+	err = json.Unmarshal(body, ready)
+	if err != nil || ready.APIVersion != mohttp.READY_API_VERSION {
+		// Probably a proxy or load balancer error rather than the operator itself.
+		return nil, fmt.Errorf("unexpected response from %s (HTTP %d): %s", apiUrl, resp.StatusCode, body)
+	}
+	if ready.State == mohttp.ReadyStateError {
+		// A rejected token may just need rotating, so that's retried too.
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("error from %s: %s", apiUrl, ready.Message)
+		}
+		return nil, &permanentError{msg: fmt.Sprintf("error from %s: %s", apiUrl, ready.Message)}
 	}
-	ready := string(body) == "true"
 	return ready, nil
 }
+
+func apiScheme(cfg *config) string {
+	if cfg.caBundle != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// setToken adds the API token to a request, if there is one. The token is read each time since the kubelet
+// rotates it.
+func setToken(req *http.Request, cfg *config) error {
+	token, err := os.ReadFile(cfg.tokenFile)
+	if err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
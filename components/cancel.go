@@ -0,0 +1,161 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	cu "github.com/coderanger/controller-utils"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/utils"
+)
+
+// The annotation marking a migration Job which was cancelled because nothing wants its image any more.
+const CANCELLED_ANNOTATION = "migrations.coderanger.net/cancelled"
+
+// jobRunning checks if a job is still working on a migration. A job whose pods have failed is still running
+// while it has retries left.
+func jobRunning(job *batchv1.Job) bool {
+	if job.DeletionTimestamp != nil || job.Status.Succeeded > 0 || jobFailed(job) {
+		return false
+	}
+	return !jobSuspended(job)
+}
+
+// jobFailed checks if a job has given up, after running out of retries or time.
+func jobFailed(job *batchv1.Job) bool {
+	for _, c := range job.Status.Conditions {
+		if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
+
+// jobSuspended checks if a job has been suspended.
+func jobSuspended(job *batchv1.Job) bool {
+	return job.Spec.Suspend != nil && *job.Spec.Suspend
+}
+
+// wantedImages finds the migration images of all matching pods, including old revisions which are still
+// around during a rollout.
+func wantedImages(obj *migrationsv1.Migrator, pods []*corev1.Pod) map[string]bool {
+	images := map[string]bool{}
+	if obj.Spec.Job.Image != "" {
+		images[obj.Spec.Job.Image] = true
+		return images
+	}
+	for _, pod := range pods {
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		// Same rules as the waiter injection.
+		container := utils.FindContainer(&pod.Spec, obj.Spec.Container)
+		if obj.Spec.Container == "" || container == nil {
+			if len(pod.Spec.Containers) == 0 {
+				continue
+			}
+			container = &pod.Spec.Containers[0]
+		}
+		images[container.Image] = true
+	}
+	return images
+}
+
+// cancelMigration stops a running migration job which nothing wants any more, following the Migrator's
+// cancellation policy. Returns true if the job was deleted.
+func (comp *migrationsComponent) cancelMigration(ctx *cu.Context, obj *migrationsv1.Migrator, job *batchv1.Job, image string) (bool, error) {
+	policy := obj.Spec.Job.CancellationPolicy
+	if policy == "" {
+		policy = migrationsv1.CancellationPolicyWait
+	}
+
+	if policy == migrationsv1.CancellationPolicyCancel {
+		// Stop the pods first so they get the requested grace period, the job is then removed without
+		// waiting for them.
+		gracePeriod := obj.Spec.Job.CancellationGracePeriodSeconds
+		if gracePeriod != nil {
+			pods := &corev1.PodList{}
+			err := ctx.Client.List(ctx, pods, client.InNamespace(job.Namespace), client.MatchingLabels{"job-name": job.Name})
+			if err != nil {
+				return false, errors.Wrapf(err, "error listing pods for migration job %s/%s", job.Namespace, job.Name)
+			}
+			for i := range pods.Items {
+				err = ctx.Client.Delete(ctx, &pods.Items[i], client.GracePeriodSeconds(*gracePeriod))
+				if err != nil && !kerrors.IsNotFound(err) {
+					return false, errors.Wrapf(err, "error deleting migration pod %s/%s", pods.Items[i].Namespace, pods.Items[i].Name)
+				}
+			}
+		}
+		err := ctx.Client.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground))
+		if err != nil && !kerrors.IsNotFound(err) {
+			return false, errors.Wrapf(err, "error deleting cancelled migration job %s/%s", job.Namespace, job.Name)
+		}
+		ctx.Events.Eventf(obj, "Normal", "MigrationCancelled", "Cancelled migration job %s/%s using image %s, no pods want it", job.Namespace, job.Name, image)
+		ctx.Conditions.SetfTrue(migrationsv1.ConditionMigrationCancelled, migrationsv1.ReasonJobDeleted, "Cancelled migration job %s/%s using image %s, no pods want it", job.Namespace, job.Name, image)
+		obj.Status.CurrentTarget = ""
+		obj.Status.CurrentJob = ""
+		return true, nil
+	}
+
+	// Otherwise keep the job around, marked so this only happens once and so it can resume.
+	patch := client.MergeFrom(job.DeepCopy())
+	if job.Annotations == nil {
+		job.Annotations = map[string]string{}
+	}
+	job.Annotations[CANCELLED_ANNOTATION] = "true"
+	if policy == migrationsv1.CancellationPolicySuspend {
+		suspend := true
+		job.Spec.Suspend = &suspend
+	}
+	err := ctx.Client.Patch(ctx, job, patch)
+	if err != nil {
+		return false, errors.Wrapf(err, "error cancelling migration job %s/%s", job.Namespace, job.Name)
+	}
+	if policy == migrationsv1.CancellationPolicySuspend {
+		ctx.Events.Eventf(obj, "Normal", "MigrationCancelled", "Suspended migration job %s/%s using image %s, no pods want it", job.Namespace, job.Name, image)
+		ctx.Conditions.SetfTrue(migrationsv1.ConditionMigrationCancelled, migrationsv1.ReasonJobSuspended, "Suspended migration job %s/%s using image %s, no pods want it", job.Namespace, job.Name, image)
+		obj.Status.CurrentTarget = ""
+		obj.Status.CurrentJob = ""
+	} else {
+		ctx.Events.Eventf(obj, "Normal", "MigrationCancelled", "Migration job %s/%s using image %s is no longer wanted, letting it finish", job.Namespace, job.Name, image)
+		ctx.Conditions.SetfTrue(migrationsv1.ConditionMigrationCancelled, migrationsv1.ReasonJobLeftToFinish, "Migration job %s/%s using image %s is no longer wanted, letting it finish", job.Namespace, job.Name, image)
+	}
+	return false, nil
+}
+
+// resumeMigration un-cancels a migration job whose image is wanted again.
+func (comp *migrationsComponent) resumeMigration(ctx *cu.Context, obj *migrationsv1.Migrator, job *batchv1.Job) error {
+	patch := client.MergeFrom(job.DeepCopy())
+	delete(job.Annotations, CANCELLED_ANNOTATION)
+	if job.Spec.Suspend != nil && *job.Spec.Suspend {
+		suspend := false
+		job.Spec.Suspend = &suspend
+	}
+	err := ctx.Client.Patch(ctx, job, patch)
+	if err != nil {
+		return errors.Wrapf(err, "error resuming migration job %s/%s", job.Namespace, job.Name)
+	}
+	ctx.Events.Eventf(obj, "Normal", "MigrationResumed", "Resumed cancelled migration job %s/%s", job.Namespace, job.Name)
+	ctx.Conditions.SetfFalse(migrationsv1.ConditionMigrationCancelled, migrationsv1.ReasonJobResumed, "Resumed cancelled migration job %s/%s", job.Namespace, job.Name)
+	return nil
+}
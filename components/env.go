@@ -0,0 +1,97 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+// applyEnvOverrides merges the migrator's env and envFrom settings into the migration container.
+// Removals happen first so a variable can be both removed and re-added from a different source.
+func applyEnvOverrides(obj *migrationsv1.Migrator, container *corev1.Container) {
+	if len(obj.Spec.Job.RemoveEnv) != 0 {
+		remove := map[string]bool{}
+		for _, name := range obj.Spec.Job.RemoveEnv {
+			remove[name] = true
+		}
+		env := []corev1.EnvVar{}
+		for _, e := range container.Env {
+			if !remove[e.Name] {
+				env = append(env, e)
+			}
+		}
+		container.Env = env
+	}
+
+	for _, override := range obj.Spec.Job.Env {
+		found := false
+		for i := range container.Env {
+			if container.Env[i].Name == override.Name {
+				container.Env[i] = *override.DeepCopy()
+				found = true
+				break
+			}
+		}
+		if !found {
+			container.Env = append(container.Env, *override.DeepCopy())
+		}
+	}
+
+	if len(obj.Spec.Job.RemoveEnvFrom) != 0 {
+		remove := map[string]bool{}
+		for _, name := range obj.Spec.Job.RemoveEnvFrom {
+			remove[name] = true
+		}
+		envFrom := []corev1.EnvFromSource{}
+		for _, e := range container.EnvFrom {
+			_, name := envFromSourceKey(&e)
+			if !remove[name] {
+				envFrom = append(envFrom, e)
+			}
+		}
+		container.EnvFrom = envFrom
+	}
+
+	for _, override := range obj.Spec.Job.EnvFrom {
+		overrideKind, overrideName := envFromSourceKey(&override)
+		found := false
+		for i := range container.EnvFrom {
+			kind, name := envFromSourceKey(&container.EnvFrom[i])
+			if kind == overrideKind && name == overrideName {
+				container.EnvFrom[i] = *override.DeepCopy()
+				found = true
+				break
+			}
+		}
+		if !found {
+			container.EnvFrom = append(container.EnvFrom, *override.DeepCopy())
+		}
+	}
+}
+
+// envFromSourceKey returns the kind and name of the object an envFrom source references.
+func envFromSourceKey(source *corev1.EnvFromSource) (string, string) {
+	if source.ConfigMapRef != nil {
+		return "ConfigMap", source.ConfigMapRef.Name
+	}
+	if source.SecretRef != nil {
+		return "Secret", source.SecretRef.Name
+	}
+	return "", ""
+}
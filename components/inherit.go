@@ -0,0 +1,66 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/utils"
+)
+
+// Labels owned by workload controllers for their selectors. Copying these would let the controller try
+// to adopt the migration pod, so they are never inherited regardless of the rules.
+var neverInheritLabels = []string{
+	"pod-template-hash",
+	"controller-revision-hash",
+	"rollouts-pod-template-hash",
+	"statefulset.kubernetes.io/pod-name",
+	"apps.kubernetes.io/pod-index",
+	"controller-uid",
+	"job-name",
+	"batch.kubernetes.io/controller-uid",
+	"batch.kubernetes.io/job-name",
+	"batch.kubernetes.io/job-completion-index",
+}
+
+// inheritMetadata builds the set of labels or annotations to copy based on the rules. Later sources take
+// precedence over earlier ones.
+func inheritMetadata(rules *migrationsv1.InheritRules, never []string, sources ...map[string]string) map[string]string {
+	inherited := map[string]string{}
+	if rules == nil {
+		return inherited
+	}
+	for _, source := range sources {
+		for k, v := range source {
+			if !utils.MatchesFilter(rules.Include, rules.Exclude, k) || utils.MatchesAny(never, k) {
+				continue
+			}
+			inherited[k] = v
+		}
+	}
+	return inherited
+}
+
+// mergeMetadata combines maps of labels or annotations, later maps take precedence.
+func mergeMetadata(maps ...map[string]string) map[string]string {
+	merged := map[string]string{}
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
@@ -39,20 +39,24 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/freeze"
 	argoprojstubv1alpha1 "github.com/coderanger/migrations-operator/stubs/argoproj/v1alpha1"
 	"github.com/coderanger/migrations-operator/utils"
 	"github.com/coderanger/migrations-operator/webhook"
 )
 
-type migrationsComponent struct{}
+type migrationsComponent struct {
+	freezer freeze.Freezer
+}
 
-func Migrations() *migrationsComponent {
-	return &migrationsComponent{}
+// Migrations creates the migrations component. If freezer is nil, the global freeze is ignored.
+func Migrations(freezer freeze.Freezer) *migrationsComponent {
+	return &migrationsComponent{freezer: freezer}
 }
 
 func (_ *migrationsComponent) GetReadyCondition() string {
-	return "MigrationsReady"
+	return migrationsv1.ConditionMigrationsReady
 }
 
 func (comp *migrationsComponent) Setup(ctx *cu.Context, bldr *ctrl.Builder) error {
@@ -80,22 +84,63 @@ func (comp *migrationsComponent) Setup(ctx *cu.Context, bldr *ctrl.Builder) erro
 			return requests
 		}),
 	)
+	if comp.freezer != nil {
+		// Recheck every Migrator when the global freeze changes.
+		bldr.Watches(
+			comp.freezer.Source(),
+			handler.EnqueueRequestsFromMapFunc(func(_ client.Object) []reconcile.Request {
+				requests := []reconcile.Request{}
+				migrators := &migrationsv1.MigratorList{}
+				err := ctx.Client.List(context.Background(), migrators)
+				if err != nil {
+					ctx.Log.Error(err, "error listing migrators")
+					return requests
+				}
+				for _, migrator := range migrators.Items {
+					requests = append(requests, reconcile.Request{
+						NamespacedName: types.NamespacedName{
+							Name:      migrator.Name,
+							Namespace: migrator.Namespace,
+						},
+					})
+				}
+				return requests
+			}),
+		)
+	}
 	return nil
 }
 
 func (comp *migrationsComponent) Reconcile(ctx *cu.Context) (cu.Result, error) {
-	obj := ctx.Object.(*migrationsv1beta1.Migrator)
+	obj := ctx.Object.(*migrationsv1.Migrator)
 
-	// Create the selectors.
-	rawSelector := obj.Spec.Selector
-	if rawSelector == nil {
-		rawSelector = &metav1.LabelSelector{MatchLabels: map[string]string{}}
+	// Check for a global freeze, which works like suspending every Migrator.
+	frozen := freeze.Status{}
+	if comp.freezer != nil {
+		var err error
+		frozen, err = comp.freezer.Status(ctx)
+		if err != nil {
+			return cu.Result{}, errors.Wrap(err, "error checking global freeze")
+		}
+	}
+	if frozen.Frozen {
+		ctx.Conditions.SetfTrue(migrationsv1.ConditionSuspended, migrationsv1.ReasonGloballyFrozen, "All migrations are frozen (frozenBy %s): %s", frozen.By, frozen.Reason)
+	} else if obj.Spec.Suspend {
+		ctx.Conditions.SetfTrue(migrationsv1.ConditionSuspended, migrationsv1.ReasonSuspended, "Migrator is suspended, no migration jobs will be started")
+	} else {
+		ctx.Conditions.SetfFalse(migrationsv1.ConditionSuspended, migrationsv1.ReasonNotSuspended, "Migrator is not suspended")
 	}
-	selector, err := metav1.LabelSelectorAsSelector(rawSelector)
+
+	// Create the selectors. Empty selectors are rejected by the validating webhook, but Migrators created
+	// before it was installed may still have one, so match nothing the same as ListMatchingMigrators does.
+	selector, err := metav1.LabelSelectorAsSelector(obj.Spec.Selector)
 	if err != nil {
 		return cu.Result{}, errors.Wrap(err, "error parsing selector")
 	}
-	rawSelector = obj.Spec.TemplateSelector
+	if selector.Empty() {
+		selector = labels.Nothing()
+	}
+	rawSelector := obj.Spec.TemplateSelector
 	if rawSelector == nil {
 		rawSelector = &metav1.LabelSelector{MatchLabels: map[string]string{}}
 	}
@@ -115,15 +160,21 @@ func (comp *migrationsComponent) Reconcile(ctx *cu.Context) (cu.Result, error) {
 	for i := range allPods.Items {
 		pod := &allPods.Items[i]
 		labelSet := labels.Set(pod.Labels)
+		if pod.Labels["migrations"] == obj.Name {
+			// Don't use our own migration pods as templates if they inherited matching labels.
+			continue
+		}
 		if selector.Matches(labelSet) {
 			pods = append(pods, pod)
-			if templatePod == nil && templateSelector.Matches(labelSet) {
+			if templateSelector.Matches(labelSet) && (templatePod == nil || utils.NewerPod(pod, templatePod)) {
 				templatePod = pod
 			}
 		}
 	}
+	obj.Status.BlockedPods = countBlockedPods(obj, pods)
 	if len(pods) == 0 {
 		// No matching pods, just bail out for now.
+		obj.Status.ObservedGeneration = obj.Generation
 		return cu.Result{}, nil
 	}
 	if templatePod == nil {
@@ -132,21 +183,17 @@ func (comp *migrationsComponent) Reconcile(ctx *cu.Context) (cu.Result, error) {
 	}
 
 	// Find the template pod spec, possibly from an owner object.
-	templatePodSpec, err := comp.findOwnerSpec(ctx, templatePod)
+	podTemplate, err := comp.findOwnerTemplate(ctx, templatePod)
 	if err != nil {
 		return cu.Result{}, errors.Wrap(err, "error finding template pod spec")
 	}
+	templatePodSpec := &podTemplate.Spec
 
 	// Find the template container.
 	var templateContainer *corev1.Container
 	if obj.Spec.Container != "" {
-		// Looking for a specific container name.
-		for _, c := range templatePodSpec.Containers {
-			if c.Name == obj.Spec.Container {
-				templateContainer = &c
-				break
-			}
-		}
+		// Looking for a specific container name, which may also be an init container.
+		templateContainer = utils.FindContainer(templatePodSpec, obj.Spec.Container)
 	} else if len(templatePodSpec.Containers) > 0 {
 		templateContainer = &templatePodSpec.Containers[0]
 	}
@@ -157,60 +204,112 @@ func (comp *migrationsComponent) Reconcile(ctx *cu.Context) (cu.Result, error) {
 
 	// Build a migration job object.
 	migrationContainer := templateContainer.DeepCopy()
-	migrationContainer.Name = "migrations"
-	if obj.Spec.Image != "" {
-		migrationContainer.Image = obj.Spec.Image
+	migrationContainer.Name = utils.MIGRATION_CONTAINER
+	if obj.Spec.Job.Image != "" {
+		migrationContainer.Image = obj.Spec.Job.Image
+	}
+	if obj.Spec.Job.Command != nil {
+		migrationContainer.Command = obj.Spec.Job.Command
 	}
-	if obj.Spec.Command != nil {
-		migrationContainer.Command = *obj.Spec.Command
+	if obj.Spec.Job.Args != nil {
+		migrationContainer.Args = obj.Spec.Job.Args
 	}
-	if obj.Spec.Args != nil {
-		migrationContainer.Args = *obj.Spec.Args
+	applyEnvOverrides(obj, migrationContainer)
+	if obj.Spec.Job.Resources != nil {
+		migrationContainer.Resources = *obj.Spec.Job.Resources.DeepCopy()
 	}
-	// TODO resources?
 
-	// Remove the probes since they will rarely work.
-	migrationContainer.ReadinessProbe = nil
-	migrationContainer.LivenessProbe = nil
-	migrationContainer.StartupProbe = nil
+	// Make sure any non-native sidecars get told to exit when the migrations are done.
+	if obj.Spec.Job.Sidecars.ShutdownURL != "" {
+		err = wrapSidecarShutdown(migrationContainer, obj.Spec.Job.Sidecars.ShutdownURL)
+		if err != nil {
+			return cu.Result{}, err
+		}
+	}
 
 	migrationPodSpec := templatePodSpec.DeepCopy()
 	migrationPodSpec.Containers = []corev1.Container{*migrationContainer}
 	migrationPodSpec.RestartPolicy = corev1.RestartPolicyNever
 
-	// Purge any migration wait initContainers since that would be a yodawg situation.
+	// Run as the requested ServiceAccount, and surface when that differs from the template.
+	templateServiceAccount := serviceAccountFor(templatePodSpec)
+	if obj.Spec.Job.ServiceAccountName != "" {
+		migrationPodSpec.ServiceAccountName = obj.Spec.Job.ServiceAccountName
+		migrationPodSpec.DeprecatedServiceAccount = ""
+	}
+	obj.Status.ServiceAccountName = serviceAccountFor(migrationPodSpec)
+	if obj.Status.ServiceAccountName != templateServiceAccount {
+		ctx.Conditions.SetfTrue(migrationsv1.ConditionServiceAccountMismatch, migrationsv1.ReasonServiceAccountOverridden, "Migration job runs as ServiceAccount %s instead of template ServiceAccount %s", obj.Status.ServiceAccountName, templateServiceAccount)
+	} else {
+		ctx.Conditions.SetfFalse(migrationsv1.ConditionServiceAccountMismatch, migrationsv1.ReasonServiceAccountMatches, "Migration job runs as template ServiceAccount %s", templateServiceAccount)
+	}
+
+	// Purge any migration wait initContainers since that would be a yodawg situation. If the template
+	// container was itself an init container, drop it too since it's now the main container. Anything
+	// else is up to the configured filter.
 	initContainers := []corev1.Container{}
-	for _, c := range migrationPodSpec.InitContainers {
-		if !strings.HasPrefix(c.Name, "migrate-wait-") {
-			initContainers = append(initContainers, c)
+	for i := range migrationPodSpec.InitContainers {
+		c := &migrationPodSpec.InitContainers[i]
+		if webhook.IsWaiterContainer(c) || c.Name == templateContainer.Name {
+			continue
 		}
+		filter := obj.Spec.Job.InitContainers
+		if filter != nil && !utils.MatchesFilter(filter.Include, filter.Exclude, c.Name) {
+			continue
+		}
+		initContainers = append(initContainers, *c)
 	}
 	migrationPodSpec.InitContainers = initContainers
-
-	// add labels to the job's pod template
-	jobTemplateLabels := map[string]string{"migrations": obj.Name}
-	if obj.Spec.Labels != nil {
-		for k, v := range obj.Spec.Labels {
-			jobTemplateLabels[k] = v
+	// The waiters' token volumes go with them.
+	var volumes []corev1.Volume
+	for i := range migrationPodSpec.Volumes {
+		if !webhook.IsWaiterVolume(&migrationPodSpec.Volumes[i]) {
+			volumes = append(volumes, migrationPodSpec.Volumes[i])
 		}
 	}
+	migrationPodSpec.Volumes = volumes
 
-	// add annotations to the job's pod template
-	jobTemplateAnnotations := map[string]string{
-		webhook.NOWAIT_MIGRATOR_ANNOTATION: "true",
+	// Keep any requested sidecars.
+	nativeSidecars, err := addSidecars(obj, templatePodSpec, migrationPodSpec)
+	if err != nil {
+		return cu.Result{}, errors.Wrap(err, "error adding sidecars")
 	}
-	if obj.Spec.Annotations != nil {
-		for k, v := range obj.Spec.Annotations {
-			jobTemplateAnnotations[k] = v
-		}
+
+	// Strip out anything that doesn't make sense for a batch Job.
+	sanitized, err := sanitizePodSpec(ctx, obj, templatePod, migrationPodSpec)
+	if err != nil {
+		return cu.Result{}, errors.Wrap(err, "error sanitizing migration pod spec")
+	}
+
+	// Copy any requested labels and annotations from the template pod and its owner.
+	inheritedLabels := inheritMetadata(obj.Spec.Job.InheritLabels, neverInheritLabels, podTemplate.Labels, templatePod.Labels)
+	inheritedAnnotations := inheritMetadata(obj.Spec.Job.InheritAnnotations, nil, podTemplate.Annotations, templatePod.Annotations)
+
+	jobLabels := mergeMetadata(inheritedLabels, obj.Labels)
+	jobAnnotations := mergeMetadata(inheritedAnnotations)
+	if len(sanitized) != 0 {
+		jobAnnotations[SANITIZED_ANNOTATION] = strings.Join(sanitized, ",")
+	}
+	specHash, err := hashPodSpec(migrationPodSpec, nativeSidecars)
+	if err != nil {
+		return cu.Result{}, err
 	}
+	jobAnnotations[SPEC_HASH_ANNOTATION] = specHash
+
+	// add labels to the job's pod template
+	jobTemplateLabels := mergeMetadata(inheritedLabels, map[string]string{"migrations": obj.Name}, obj.Spec.Job.PodLabels)
+
+	// add annotations to the job's pod template
+	jobTemplateAnnotations := mergeMetadata(inheritedAnnotations, map[string]string{
+		webhook.NOWAIT_MIGRATOR_ANNOTATION: "true",
+	}, obj.Spec.Job.PodAnnotations)
 
 	migrationJob := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        obj.Name + "-migrations",
 			Namespace:   obj.Namespace,
-			Labels:      obj.Labels,
-			Annotations: map[string]string{},
+			Labels:      jobLabels,
+			Annotations: jobAnnotations,
 		},
 		Spec: batchv1.JobSpec{
 			Template: corev1.PodTemplateSpec{
@@ -226,44 +325,111 @@ func (comp *migrationsComponent) Reconcile(ctx *cu.Context) (cu.Result, error) {
 	if err != nil {
 		return cu.Result{}, errors.Wrap(err, "error setting controller reference")
 	}
+	obj.Status.ObservedGeneration = obj.Generation
+
+	// Look for an existing job, and deal with it first if it's running a migration nothing wants any more.
+	existingJob := &batchv1.Job{}
+	err = ctx.Client.Get(ctx, types.NamespacedName{Name: migrationJob.Name, Namespace: migrationJob.Namespace}, existingJob)
+	if err != nil {
+		if !kerrors.IsNotFound(err) {
+			return cu.Result{}, errors.Wrapf(err, "error getting existing migration job %s/%s", migrationJob.Namespace, migrationJob.Name)
+		}
+		existingJob = nil
+	}
+	var existingImage string
+	if existingJob != nil && len(existingJob.Spec.Template.Spec.Containers) > 0 {
+		existingImage = existingJob.Spec.Template.Spec.Containers[0].Image
+	}
+
+	// While suspended, nothing gets started, replaced or cancelled.
+	if obj.Spec.Suspend || frozen.Frozen {
+		return comp.reconcileSuspended(ctx, obj, existingJob)
+	}
+	if existingJob != nil && existingJob.Annotations[SUSPENDED_ANNOTATION] != "" {
+		// Pick up where we left off.
+		err = comp.unsuspendJob(ctx, obj, existingJob)
+		if err != nil {
+			return cu.Result{}, err
+		}
+	}
+
+	justSuspended := false
+	if existingJob != nil && existingJob.Annotations[CANCELLED_ANNOTATION] != "" && existingImage == migrationContainer.Image {
+		err = comp.resumeMigration(ctx, obj, existingJob)
+		if err != nil {
+			return cu.Result{}, err
+		}
+	} else if existingJob != nil && jobRunning(existingJob) && existingJob.Annotations[CANCELLED_ANNOTATION] == "" && existingImage != migrationContainer.Image && !wantedImages(obj, pods)[existingImage] {
+		deleted, err := comp.cancelMigration(ctx, obj, existingJob, existingImage)
+		if err != nil {
+			return cu.Result{}, err
+		}
+		if deleted {
+			return cu.Result{RequeueAfter: 1 * time.Second, SkipRemaining: true}, nil
+		}
+		justSuspended = jobSuspended(existingJob)
+	}
 
 	// Check if we're already up to date.
-	uncachedObj := &migrationsv1beta1.Migrator{}
+	uncachedObj := &migrationsv1.Migrator{}
 	err = ctx.UncachedClient.Get(ctx, types.NamespacedName{Name: obj.Name, Namespace: obj.Namespace}, uncachedObj)
 	if err != nil {
 		return cu.Result{}, errors.Wrap(err, "error getting latest migrator for status")
 	}
-	if uncachedObj.Status.LastSuccessfulMigration == migrationContainer.Image {
-		ctx.Conditions.SetfTrue(comp.GetReadyCondition(), "MigrationsUpToDate", "Migration %s already run", migrationContainer.Image)
+	lastSuccess := uncachedObj.Status.LastSuccessfulRecord()
+	upToDate := lastSuccess != nil && lastSuccess.Image == migrationContainer.Image
+	if upToDate && obj.Spec.Job.SpecChangePolicy == migrationsv1.SpecChangePolicyRerun && lastSuccess.SpecHash != "" && lastSuccess.SpecHash != specHash {
+		// The Job spec changed since this image was migrated, and that should rerun the migrations.
+		upToDate = false
+	}
+	if upToDate {
+		ctx.Conditions.SetfTrue(comp.GetReadyCondition(), migrationsv1.ReasonMigrationsUpToDate, "Migration %s already run", migrationContainer.Image)
+		obj.Status.CurrentTarget = ""
+		obj.Status.CurrentJob = ""
 		return cu.Result{}, nil
 	}
 
-	existingJob := &batchv1.Job{}
-	err = ctx.Client.Get(ctx, types.NamespacedName{Name: migrationJob.Name, Namespace: migrationJob.Namespace}, existingJob)
-	if err != nil {
-		if kerrors.IsNotFound(err) {
-			// Try to start the migrations.
-			err = ctx.Client.Create(ctx, migrationJob, &client.CreateOptions{FieldManager: ctx.FieldManager})
+	if existingJob == nil {
+		// Try to start the migrations.
+		var createObj client.Object = migrationJob
+		if len(nativeSidecars) != 0 {
+			createObj, err = withNativeSidecars(migrationJob, nativeSidecars)
 			if err != nil {
-				// Possible race condition, try again.
-				ctx.Events.Eventf(obj, "Warning", "CreateError", "Error on create, possible conflict: %v", err)
-				ctx.Conditions.SetfUnknown(comp.GetReadyCondition(), "CreateError", "Error on create, possible conflict: %v", err)
-				return cu.Result{Requeue: true}, nil
+				return cu.Result{}, err
 			}
-			ctx.Events.Eventf(obj, "Normal", "MigrationsStarted", "Started migration job %s/%s using image %s", migrationJob.Namespace, migrationJob.Name, migrationContainer.Image)
-			ctx.Conditions.SetfFalse(comp.GetReadyCondition(), "MigrationsRunning", "Started migration job %s/%s using image %s", migrationJob.Namespace, migrationJob.Name, migrationContainer.Image)
-			return cu.Result{}, nil
-		} else {
-			return cu.Result{}, errors.Wrapf(err, "error getting existing migration job %s/%s", migrationJob.Namespace, migrationJob.Name)
 		}
+		err = ctx.Client.Create(ctx, createObj, &client.CreateOptions{FieldManager: ctx.FieldManager})
+		if err != nil {
+			// Possible race condition, try again.
+			ctx.Events.Eventf(obj, "Warning", "CreateError", "Error on create, possible conflict: %v", err)
+			ctx.Conditions.SetfUnknown(comp.GetReadyCondition(), "CreateError", "Error on create, possible conflict: %v", err)
+			return cu.Result{Requeue: true}, nil
+		}
+		ctx.Events.Eventf(obj, "Normal", "MigrationsStarted", "Started migration job %s/%s using image %s", migrationJob.Namespace, migrationJob.Name, migrationContainer.Image)
+		ctx.Conditions.SetfFalse(comp.GetReadyCondition(), migrationsv1.ReasonMigrationsRunning, "Started migration job %s/%s using image %s", migrationJob.Namespace, migrationJob.Name, migrationContainer.Image)
+		ctx.Conditions.SetfFalse(migrationsv1.ConditionMigrationCancelled, migrationsv1.ReasonMigrationsRunning, "Started migration job %s/%s using image %s", migrationJob.Namespace, migrationJob.Name, migrationContainer.Image)
+		now := metav1.Now()
+		obj.Status.CurrentTarget = migrationContainer.Image
+		obj.Status.CurrentJob = migrationJob.Name
+		obj.Status.LastAttemptTime = &now
+		return cu.Result{}, nil
 	}
 
 	// Check if the existing job is stale, i.e. was for a previous migration image.
-	var existingImage string
-	if len(existingJob.Spec.Template.Spec.Containers) > 0 {
-		existingImage = existingJob.Spec.Template.Spec.Containers[0].Image
-	}
 	if existingImage == "" || existingImage != migrationContainer.Image {
+		if jobRunning(existingJob) {
+			// Either pods still want this migration or it was cancelled but left to finish, so don't kill it
+			// halfway through.
+			ctx.Conditions.SetfFalse(comp.GetReadyCondition(), migrationsv1.ReasonMigrationsRunning, "Waiting for migration job %s/%s using image %s to finish before migrating %s", existingJob.Namespace, existingJob.Name, existingImage, migrationContainer.Image)
+			obj.Status.CurrentTarget = existingImage
+			obj.Status.CurrentJob = existingJob.Name
+			return cu.Result{}, nil
+		}
+		if jobSuspended(existingJob) && (justSuspended || existingJob.Status.Active > 0) {
+			// Give the suspended job's pods time to stop, it's only replaced once nothing is running.
+			ctx.Conditions.SetfFalse(comp.GetReadyCondition(), migrationsv1.ReasonMigrationsRunning, "Waiting for suspended migration job %s/%s using image %s to stop before migrating %s", existingJob.Namespace, existingJob.Name, existingImage, migrationContainer.Image)
+			return cu.Result{RequeueAfter: 1 * time.Second}, nil
+		}
 		// Old, stale migration. Remove it and try again.
 		policy := metav1.DeletePropagationForeground
 		err = ctx.Client.Delete(ctx, existingJob, &client.DeleteOptions{PropagationPolicy: &policy})
@@ -271,33 +437,61 @@ func (comp *migrationsComponent) Reconcile(ctx *cu.Context) (cu.Result, error) {
 			return cu.Result{}, errors.Wrapf(err, "error deleting stale migration job %s/%s", existingJob.Namespace, existingJob.Name)
 		}
 		ctx.Events.Eventf(obj, "Normal", "StaleJob", "Deleted stale migration job %s/%s (%s)", migrationJob.Namespace, migrationJob.Name, existingImage)
-		ctx.Conditions.SetfFalse(comp.GetReadyCondition(), "StaleJob", "Deleted stale migration job %s/%s (%s)", migrationJob.Namespace, migrationJob.Name, existingImage)
+		ctx.Conditions.SetfFalse(comp.GetReadyCondition(), migrationsv1.ReasonStaleJob, "Deleted stale migration job %s/%s (%s)", migrationJob.Namespace, migrationJob.Name, existingImage)
+		obj.Status.CurrentTarget = ""
+		obj.Status.CurrentJob = ""
 		return cu.Result{RequeueAfter: 1 * time.Second, SkipRemaining: true}, nil
 	}
 
 	// Check if the job succeeded.
 	if existingJob.Status.Succeeded > 0 {
-		// Success! Update LastSuccessfulMigration and delete the job.
-		err = ctx.Client.Delete(ctx.Context, existingJob, client.PropagationPolicy(metav1.DeletePropagationBackground))
-		if err != nil {
-			return cu.Result{}, errors.Wrapf(err, "error deleting successful migration job %s/%s", existingJob.Namespace, existingJob.Name)
+		// Success! Record it in the history and delete the job unless it should be kept. A kept job
+		// is cleaned up as stale by the next migration. This comes before the spec check so a job which
+		// finished with an outdated spec still counts, the specChangePolicy then decides if it reruns.
+		if obj.Spec.Job.SuccessfulJobRetention != migrationsv1.JobRetentionKeep {
+			err = ctx.Client.Delete(ctx.Context, existingJob, client.PropagationPolicy(metav1.DeletePropagationBackground))
+			if err != nil {
+				return cu.Result{}, errors.Wrapf(err, "error deleting successful migration job %s/%s", existingJob.Namespace, existingJob.Name)
+			}
 		}
 		ctx.Events.Eventf(obj, "Normal", "MigrationsSucceeded", "Migration job %s/%s using image %s succeeded", existingJob.Namespace, existingJob.Name, existingImage)
-		ctx.Conditions.SetfTrue(comp.GetReadyCondition(), "MigrationsSucceeded", "Migration job %s/%s using image %s succeeded", existingJob.Namespace, existingJob.Name, existingImage)
-		obj.Status.LastSuccessfulMigration = migrationContainer.Image
+		ctx.Conditions.SetfTrue(comp.GetReadyCondition(), migrationsv1.ReasonMigrationsSucceeded, "Migration job %s/%s using image %s succeeded", existingJob.Namespace, existingJob.Name, existingImage)
+		finishMigration(obj, migrationRecord(existingJob, existingImage, migrationsv1.MigrationResultSucceeded))
 		return cu.Result{}, nil
 	}
 
+	// Check if the running or failed job was built from an older spec. Jobs from before spec hashes were
+	// added are left alone.
+	existingHash := existingJob.Annotations[SPEC_HASH_ANNOTATION]
+	if existingHash != "" && existingHash != specHash {
+		policy := metav1.DeletePropagationForeground
+		err = ctx.Client.Delete(ctx, existingJob, &client.DeleteOptions{PropagationPolicy: &policy})
+		if err != nil {
+			return cu.Result{}, errors.Wrapf(err, "error deleting outdated migration job %s/%s", existingJob.Namespace, existingJob.Name)
+		}
+		ctx.Events.Eventf(obj, "Normal", "SpecChanged", "Deleted migration job %s/%s (%s) with an outdated spec", migrationJob.Namespace, migrationJob.Name, existingImage)
+		ctx.Conditions.SetfFalse(comp.GetReadyCondition(), migrationsv1.ReasonSpecChanged, "Deleted migration job %s/%s (%s) with an outdated spec", migrationJob.Namespace, migrationJob.Name, existingImage)
+		obj.Status.CurrentTarget = ""
+		obj.Status.CurrentJob = ""
+		return cu.Result{RequeueAfter: 1 * time.Second, SkipRemaining: true}, nil
+	}
+
 	// ... Or if the job failed.
-	if existingJob.Status.Failed > 0 {
+	if jobFailed(existingJob) {
 		// If it was an outdated job, we would have already deleted it, so this means it's a failed migration for the current version.
 		ctx.Events.Eventf(obj, "Warning", "MigrationsFailed", "Migration job %s/%s using image %s failed", existingJob.Namespace, existingJob.Name, existingImage)
-		ctx.Conditions.SetfFalse(comp.GetReadyCondition(), "MigrationsFailed", "Migration job %s/%s using image %s failed", existingJob.Namespace, existingJob.Name, existingImage)
+		ctx.Conditions.SetfFalse(comp.GetReadyCondition(), migrationsv1.ReasonMigrationsFailed, "Migration job %s/%s using image %s failed", existingJob.Namespace, existingJob.Name, existingImage)
+		finishMigration(obj, migrationRecord(existingJob, existingImage, migrationsv1.MigrationResultFailed))
 		return cu.Result{}, nil
 	}
 
 	// Job is still running, will get reconciled when it finishes.
-	ctx.Conditions.SetfFalse(comp.GetReadyCondition(), "MigrationsRunning", "Migration job %s/%s using image %s still running", existingJob.Namespace, existingJob.Name, existingImage)
+	ctx.Conditions.SetfFalse(comp.GetReadyCondition(), migrationsv1.ReasonMigrationsRunning, "Migration job %s/%s using image %s still running", existingJob.Namespace, existingJob.Name, existingImage)
+	obj.Status.CurrentTarget = existingImage
+	obj.Status.CurrentJob = existingJob.Name
+	if obj.Status.LastAttemptTime == nil || obj.Status.LastAttemptTime.Before(&existingJob.CreationTimestamp) {
+		obj.Status.LastAttemptTime = existingJob.CreationTimestamp.DeepCopy()
+	}
 	return cu.Result{}, nil
 }
 
@@ -337,12 +531,18 @@ func (_ *migrationsComponent) findOwners(ctx *cu.Context, obj client.Object) ([]
 	return owners, nil
 }
 
-func (_ *migrationsComponent) findSpecFor(ctx *cu.Context, obj client.Object) *corev1.PodSpec {
+func (_ *migrationsComponent) findTemplateFor(ctx *cu.Context, obj client.Object) *corev1.PodTemplateSpec {
 	switch v := obj.(type) {
 	case *corev1.Pod:
-		return &v.Spec
+		return &corev1.PodTemplateSpec{ObjectMeta: v.ObjectMeta, Spec: v.Spec}
 	case *appsv1.Deployment:
-		return &v.Spec.Template.Spec
+		return &v.Spec.Template
+	case *appsv1.StatefulSet:
+		return &v.Spec.Template
+	case *appsv1.DaemonSet:
+		return &v.Spec.Template
+	case *appsv1.ReplicaSet:
+		return &v.Spec.Template
 	case *argoprojstubv1alpha1.Rollout:
 		if v.Spec.WorkloadRef != nil {
 			if v.Spec.WorkloadRef.Kind == "Deployment" {
@@ -351,30 +551,92 @@ func (_ *migrationsComponent) findSpecFor(ctx *cu.Context, obj client.Object) *c
 				if err != nil {
 					return nil
 				}
-				return &deployment.Spec.Template.Spec
+				return &deployment.Spec.Template
 			} else {
 				// TODO handle other WorkloadRef types
 				return nil
 			}
 		}
-		return &v.Spec.Template.Spec
+		return &v.Spec.Template
 	// TODO other types. lots of them.
 	default:
 		return nil
 	}
 }
 
-func (comp *migrationsComponent) findOwnerSpec(ctx *cu.Context, obj client.Object) (*corev1.PodSpec, error) {
+func (comp *migrationsComponent) findOwnerTemplate(ctx *cu.Context, obj client.Object) (*corev1.PodTemplateSpec, error) {
 	owners, err := comp.findOwners(ctx, obj)
 	if err != nil {
 		return nil, err
 	}
 	for _, owner := range owners {
-		spec := comp.findSpecFor(ctx, owner)
-		if spec != nil {
-			return spec, nil
+		template := comp.findTemplateFor(ctx, owner)
+		if template != nil {
+			return template, nil
 		}
 	}
 	// This should be impossible since the top-level input is always a corev1.Pod.
 	return nil, errors.Errorf("error finding pod spec for %s %s/%s", obj.GetObjectKind().GroupVersionKind(), obj.GetNamespace(), obj.GetName())
 }
+
+// serviceAccountFor returns the ServiceAccount a pod spec will run as, following the API server's defaulting.
+func serviceAccountFor(spec *corev1.PodSpec) string {
+	if spec.ServiceAccountName != "" {
+		return spec.ServiceAccountName
+	}
+	if spec.DeprecatedServiceAccount != "" {
+		return spec.DeprecatedServiceAccount
+	}
+	return "default"
+}
+
+// migrationRecord builds a history entry for a finished migration job.
+func migrationRecord(job *batchv1.Job, image string, result migrationsv1.MigrationResult) migrationsv1.MigrationRecord {
+	record := migrationsv1.MigrationRecord{
+		Image:          image,
+		Result:         result,
+		JobName:        job.Name,
+		SpecHash:       job.Annotations[SPEC_HASH_ANNOTATION],
+		StartTime:      job.Status.StartTime,
+		CompletionTime: job.Status.CompletionTime,
+	}
+	if result == migrationsv1.MigrationResultFailed && record.CompletionTime == nil {
+		// Failed jobs don't get a completion time, use when the failure was noticed.
+		for _, c := range job.Status.Conditions {
+			if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+				t := c.LastTransitionTime
+				record.CompletionTime = &t
+			}
+		}
+	}
+	return record
+}
+
+// finishMigration records a finished migration job in the status and clears the current run.
+func finishMigration(obj *migrationsv1.Migrator, record migrationsv1.MigrationRecord) {
+	obj.Status.RecordMigration(record)
+	obj.Status.CurrentTarget = ""
+	obj.Status.CurrentJob = ""
+	if record.StartTime != nil && record.CompletionTime != nil {
+		obj.Status.LastDuration = &metav1.Duration{Duration: record.CompletionTime.Sub(record.StartTime.Time)}
+	}
+	if record.Result == migrationsv1.MigrationResultSucceeded {
+		if record.CompletionTime != nil {
+			obj.Status.LastSuccessTime = record.CompletionTime.DeepCopy()
+		} else if obj.Status.LastSuccessTime == nil {
+			now := metav1.Now()
+			obj.Status.LastSuccessTime = &now
+		}
+	}
+}
+
+// countBlockedPods counts the pods whose waiter for this Migrator hasn't finished yet.
+func countBlockedPods(obj *migrationsv1.Migrator, pods []*corev1.Pod) int32 {
+	var blocked int32
+	for _, pod := range pods {
+		if webhook.IsBlocked(pod, obj.Name) {
+			blocked++
+		}
+	}
+	return blocked
+}
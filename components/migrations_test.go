@@ -18,8 +18,10 @@ package components
 
 import (
 	"context"
+	"time"
 
 	cu "github.com/coderanger/controller-utils"
+	"github.com/coderanger/controller-utils/conditions"
 	. "github.com/coderanger/controller-utils/tests/matchers"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -27,30 +29,76 @@ import (
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/freeze"
 	argoprojstubsv1alpha1 "github.com/coderanger/migrations-operator/stubs/argoproj/v1alpha1"
 	"github.com/coderanger/migrations-operator/webhook"
 )
 
+type fakeFreezer struct {
+	status freeze.Status
+}
+
+func (f *fakeFreezer) Status(_ context.Context) (freeze.Status, error) {
+	return f.status, nil
+}
+
+func (f *fakeFreezer) Source() source.Source {
+	return nil
+}
+
+// configMapFreezer reads the freeze ConfigMap through the test client, the same as the real watcher does
+// through its cache.
+type configMapFreezer struct {
+	client client.Client
+}
+
+func (f *configMapFreezer) Status(ctx context.Context) (freeze.Status, error) {
+	cm := &corev1.ConfigMap{}
+	err := f.client.Get(ctx, types.NamespacedName{Name: freeze.FREEZE_CONFIGMAP_NAME, Namespace: "migrations-operator"}, cm)
+	if kerrors.IsNotFound(err) {
+		return freeze.Status{}, nil
+	} else if err != nil {
+		return freeze.Status{}, err
+	}
+	return freeze.StatusFromConfigMap(cm), nil
+}
+
+func (f *configMapFreezer) Source() source.Source {
+	return nil
+}
+
+// failJob marks a job as having given up the same way the Job controller does.
+func failJob(job *batchv1.Job) {
+	job.Status.Failed = 1
+	job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{Type: batchv1.JobFailed, Status: corev1.ConditionTrue, Reason: "BackoffLimitExceeded"})
+}
+
 var _ = Describe("Migrations component", func() {
-	var obj *migrationsv1beta1.Migrator
+	var obj *migrationsv1.Migrator
 	var pod *corev1.Pod
 	var job *batchv1.Job
 	var helper *cu.UnitHelper
 
 	BeforeEach(func() {
-		comp := Migrations()
-		obj = &migrationsv1beta1.Migrator{
-			Spec: migrationsv1beta1.MigratorSpec{},
+		comp := Migrations(nil)
+		obj = &migrationsv1.Migrator{
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"component": "web"}},
+			},
 		}
 		pod = &corev1.Pod{
 			ObjectMeta: metav1.ObjectMeta{
 				Name:      "testpod",
 				Namespace: "default",
-				Labels:    map[string]string{},
+				Labels:    map[string]string{"component": "web"},
 			},
 			Spec: corev1.PodSpec{
 				Containers: []corev1.Container{
@@ -99,6 +147,15 @@ var _ = Describe("Migrations component", func() {
 		Expect(kerrors.IsNotFound(err)).To(BeTrue())
 	})
 
+	It("matches nothing with an empty selector", func() {
+		obj.Spec.Selector = &metav1.LabelSelector{}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		Expect(obj).ToNot(HaveCondition("MigrationsReady"))
+		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations", Namespace: "default"}, job)
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+
 	It("errors with a matching pod but no matching template", func() {
 		obj.Spec.TemplateSelector = &metav1.LabelSelector{
 			MatchLabels: map[string]string{"app": "foo"},
@@ -117,6 +174,37 @@ var _ = Describe("Migrations component", func() {
 		helper.TestClient.GetName("testing-migrations", job)
 		Expect(job.Spec.Template.Spec.Containers[0].Name).To(Equal("migrations"))
 		Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("myapp:latest"))
+		Expect(obj.Status.CurrentTarget).To(Equal("myapp:latest"))
+		Expect(obj.Status.CurrentJob).To(Equal("testing-migrations"))
+		Expect(obj.Status.LastAttemptTime).ToNot(BeNil())
+	})
+
+	It("records the observed generation", func() {
+		obj.Generation = 3
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		Expect(obj.Status.ObservedGeneration).To(Equal(int64(3)))
+	})
+
+	It("counts pods blocked by a waiter", func() {
+		obj.Name = "testing"
+		pod.Spec.InitContainers = []corev1.Container{{Name: "migrate-wait-testing", Image: "waiter"}}
+		helper.TestClient.Create(pod)
+		done := pod.DeepCopy()
+		done.Name = "donepod"
+		done.ResourceVersion = ""
+		done.Status.InitContainerStatuses = []corev1.ContainerStatus{{
+			Name:  "migrate-wait-testing",
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}},
+		}}
+		helper.TestClient.Create(done)
+		other := pod.DeepCopy()
+		other.Name = "otherpod"
+		other.ResourceVersion = ""
+		other.Spec.InitContainers = nil
+		helper.TestClient.Create(other)
+		helper.MustReconcile()
+		Expect(obj.Status.BlockedPods).To(Equal(int32(1)))
 	})
 
 	It("leaves an existing, matching job", func() {
@@ -132,34 +220,397 @@ var _ = Describe("Migrations component", func() {
 	It("deletes a stale job", func() {
 		helper.TestClient.Create(pod)
 		job.Spec.Template.Spec.Containers[0].Image = "other"
+		failJob(job)
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("StaleJob").WithStatus("False"))
+		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations", Namespace: "default"}, job)
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("waits for a running job which pods still want", func() {
+		helper.TestClient.Create(pod)
+		oldPod := pod.DeepCopy()
+		oldPod.Name = "oldpod"
+		oldPod.ResourceVersion = ""
+		oldPod.Spec.Containers[0].Image = "other"
+		helper.TestClient.Create(oldPod)
+		job.Spec.Template.Spec.Containers[0].Image = "other"
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("MigrationsRunning").WithStatus("False"))
+		Expect(obj).ToNot(HaveCondition("MigrationCancelled"))
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Annotations).ToNot(HaveKey(CANCELLED_ANNOTATION))
+	})
+
+	It("lets an unwanted job finish by default", func() {
+		helper.TestClient.Create(pod)
+		job.Spec.Template.Spec.Containers[0].Image = "other"
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(helper.Events).To(Receive(ContainSubstring("MigrationCancelled")))
+		Expect(obj).To(HaveCondition("MigrationCancelled").WithReason("JobLeftToFinish").WithStatus("True"))
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("MigrationsRunning").WithStatus("False"))
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Annotations).To(HaveKeyWithValue(CANCELLED_ANNOTATION, "true"))
+	})
+
+	It("cancels an unwanted job", func() {
+		obj.Spec.Job.CancellationPolicy = migrationsv1.CancellationPolicyCancel
+		gracePeriod := int64(30)
+		obj.Spec.Job.CancellationGracePeriodSeconds = &gracePeriod
+		helper.TestClient.Create(pod)
+		job.Spec.Template.Spec.Containers[0].Image = "other"
+		helper.TestClient.Create(job)
+		jobPod := pod.DeepCopy()
+		jobPod.Name = "testing-migrations-abcde"
+		jobPod.ResourceVersion = ""
+		jobPod.Labels = map[string]string{"job-name": "testing-migrations", "migrations": "testing"}
+		jobPod.Spec.Containers[0].Image = "other"
+		helper.TestClient.Create(jobPod)
+		helper.MustReconcile()
+		Expect(helper.Events).To(Receive(ContainSubstring("MigrationCancelled")))
+		Expect(obj).To(HaveCondition("MigrationCancelled").WithReason("JobDeleted").WithStatus("True"))
+		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations", Namespace: "default"}, job)
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+		err = helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations-abcde", Namespace: "default"}, jobPod)
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("suspends an unwanted job", func() {
+		obj.Spec.Job.CancellationPolicy = migrationsv1.CancellationPolicySuspend
+		// Rolled back to an image which was already migrated.
+		obj.Status.History = []migrationsv1.MigrationRecord{
+			{Image: "myapp:latest", Result: migrationsv1.MigrationResultSucceeded},
+		}
+		helper.TestClient.Create(pod)
+		job.Spec.Template.Spec.Containers[0].Image = "other"
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationCancelled").WithReason("JobSuspended").WithStatus("True"))
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("MigrationsUpToDate").WithStatus("True"))
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Suspend).ToNot(BeNil())
+		Expect(*job.Spec.Suspend).To(BeTrue())
+	})
+
+	It("keeps a suspended job until its pods stop when a new image needs migrating", func() {
+		obj.Spec.Job.CancellationPolicy = migrationsv1.CancellationPolicySuspend
+		helper.TestClient.Create(pod)
+		job.Spec.Template.Spec.Containers[0].Image = "other"
+		job.Status.Active = 1
 		helper.TestClient.Create(job)
 		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationCancelled").WithReason("JobSuspended").WithStatus("True"))
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("MigrationsRunning").WithStatus("False"))
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Suspend).ToNot(BeNil())
+		Expect(*job.Spec.Suspend).To(BeTrue())
+
+		// Still waiting while the pod shuts down.
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+
+		// Replaced once it has stopped.
+		job.Status.Active = 0
+		Expect(helper.Client.Status().Update(context.Background(), job)).To(Succeed())
+		helper.MustReconcile()
 		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("StaleJob").WithStatus("False"))
 		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations", Namespace: "default"}, job)
 		Expect(kerrors.IsNotFound(err)).To(BeTrue())
 	})
 
+	It("resumes a cancelled job when its image is wanted again", func() {
+		helper.TestClient.Create(pod)
+		suspend := true
+		job.Spec.Suspend = &suspend
+		job.Annotations = map[string]string{CANCELLED_ANNOTATION: "true"}
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(helper.Events).To(Receive(ContainSubstring("MigrationResumed")))
+		Expect(obj).To(HaveCondition("MigrationCancelled").WithReason("JobResumed").WithStatus("False"))
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Suspend).ToNot(BeNil())
+		Expect(*job.Spec.Suspend).To(BeFalse())
+		Expect(job.Annotations).ToNot(HaveKey(CANCELLED_ANNOTATION))
+	})
+
 	It("recognizes a successful job", func() {
 		helper.TestClient.Create(pod)
 		job.Status.Succeeded = 1
 		helper.TestClient.Create(job)
 		helper.MustReconcile()
 		Expect(obj).To(HaveCondition("MigrationsReady").WithStatus("True"))
+		Expect(obj.Status.History).To(HaveLen(1))
+		Expect(obj.Status.History[0].Image).To(Equal("myapp:latest"))
+		Expect(obj.Status.History[0].Result).To(Equal(migrationsv1.MigrationResultSucceeded))
+		Expect(obj.Status.History[0].JobName).To(Equal("testing-migrations"))
+		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations", Namespace: "default"}, job)
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("records timings for a successful job", func() {
+		helper.TestClient.Create(pod)
+		start := metav1.NewTime(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		completion := metav1.NewTime(start.Add(90 * time.Second))
+		job.Status.Succeeded = 1
+		job.Status.StartTime = &start
+		job.Status.CompletionTime = &completion
+		helper.TestClient.Create(job)
+		obj.Status.CurrentTarget = "myapp:latest"
+		obj.Status.CurrentJob = "testing-migrations"
+		helper.MustReconcile()
+		Expect(obj.Status.CurrentTarget).To(Equal(""))
+		Expect(obj.Status.CurrentJob).To(Equal(""))
+		Expect(obj.Status.LastSuccessTime.Equal(&completion)).To(BeTrue())
+		Expect(obj.Status.LastDuration).To(Equal(&metav1.Duration{Duration: 90 * time.Second}))
+	})
+
+	It("keeps a successful job if requested", func() {
+		obj.Spec.Job.SuccessfulJobRetention = migrationsv1.JobRetentionKeep
+		helper.TestClient.Create(pod)
+		job.Status.Succeeded = 1
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithStatus("True"))
+		Expect(obj.Status.LastSuccessfulMigration()).To(Equal("myapp:latest"))
+		helper.TestClient.GetName("testing-migrations", job)
+	})
+
+	It("records a successful job with an outdated spec", func() {
+		helper.TestClient.Create(pod)
+		job.Annotations = map[string]string{SPEC_HASH_ANNOTATION: "outdated"}
+		job.Status.Succeeded = 1
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("MigrationsSucceeded").WithStatus("True"))
+		Expect(obj.Status.History).To(HaveLen(1))
+		Expect(obj.Status.History[0].Result).To(Equal(migrationsv1.MigrationResultSucceeded))
+		Expect(obj.Status.History[0].SpecHash).To(Equal("outdated"))
+	})
+
+	It("sets a spec hash on the job", func() {
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Annotations).To(HaveKeyWithValue(SPEC_HASH_ANNOTATION, HaveLen(16)))
+	})
+
+	It("keeps a running job when only per-pod fields differ", func() {
+		pod.Spec.NodeName = "node1"
+		pod.Spec.Volumes = []corev1.Volume{{Name: "kube-api-access-abcde", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{}}}}
+		pod.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{{Name: "kube-api-access-abcde", MountPath: "/var/run/secrets/kubernetes.io/serviceaccount"}}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		hash := job.Annotations[SPEC_HASH_ANNOTATION]
+
+		// The same template scheduled somewhere else with a new token volume.
+		pod.Spec.NodeName = "node2"
+		pod.Spec.Volumes[0].Name = "kube-api-access-fghij"
+		pod.Spec.Containers[0].VolumeMounts[0].Name = "kube-api-access-fghij"
+		Expect(helper.Client.Update(context.Background(), pod)).To(Succeed())
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("MigrationsRunning"))
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Annotations).To(HaveKeyWithValue(SPEC_HASH_ANNOTATION, hash))
+	})
+
+	It("uses the newest matching pod as the template", func() {
+		newer := pod.DeepCopy()
+		newer.Name = "a-newer"
+		newer.CreationTimestamp = metav1.NewTime(time.Now())
+		newer.Spec.Containers[0].Image = "myapp:newer"
+		helper.TestClient.Create(newer)
+		older := pod.DeepCopy()
+		older.Name = "b-older"
+		older.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Hour))
+		older.Spec.Containers[0].Image = "myapp:older"
+		helper.TestClient.Create(older)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("myapp:newer"))
+	})
+
+	It("uses a StatefulSet's current pod template during a rollout", func() {
+		truep := true
+		statefulSet := &appsv1.StatefulSet{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
+			Spec: appsv1.StatefulSetSpec{
+				Template: corev1.PodTemplateSpec{Spec: *pod.Spec.DeepCopy()},
+			},
+		}
+		statefulSet.Spec.Template.Spec.Containers[0].Image = "myapp:v2"
+		helper.TestClient.Create(statefulSet)
+		// Only the old revision's pod is around so far.
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{
+				APIVersion: "apps/v1",
+				Kind:       "StatefulSet",
+				Name:       "testing",
+				Controller: &truep,
+			},
+		}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("myapp:v2"))
+	})
+
+	It("replaces a running job when the spec changes", func() {
+		helper.TestClient.Create(pod)
+		job.Annotations = map[string]string{SPEC_HASH_ANNOTATION: "outdated"}
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("SpecChanged").WithStatus("False"))
+		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations", Namespace: "default"}, job)
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("replaces a failed job when the spec changes", func() {
+		helper.TestClient.Create(pod)
+		job.Annotations = map[string]string{SPEC_HASH_ANNOTATION: "outdated"}
+		failJob(job)
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("SpecChanged").WithStatus("False"))
+		Expect(obj.Status.History).To(BeEmpty())
+	})
+
+	It("doesn't rerun a migrated image when the spec changes by default", func() {
+		helper.TestClient.Create(pod)
+		obj.Status.History = []migrationsv1.MigrationRecord{
+			{Image: "myapp:latest", Result: migrationsv1.MigrationResultSucceeded, SpecHash: "outdated"},
+		}
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("MigrationsUpToDate").WithStatus("True"))
+	})
+
+	It("reruns a migrated image when the spec changes if requested", func() {
+		obj.Spec.Job.SpecChangePolicy = migrationsv1.SpecChangePolicyRerun
+		helper.TestClient.Create(pod)
+		obj.Status.History = []migrationsv1.MigrationRecord{
+			{Image: "myapp:latest", Result: migrationsv1.MigrationResultSucceeded, SpecHash: "outdated"},
+		}
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("MigrationsRunning").WithStatus("False"))
+		helper.TestClient.GetName("testing-migrations", job)
+	})
+
+	It("doesn't start a job while suspended", func() {
+		obj.Spec.Suspend = true
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("Suspended").WithReason("Suspended").WithStatus("True"))
 		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations", Namespace: "default"}, job)
 		Expect(kerrors.IsNotFound(err)).To(BeTrue())
 	})
 
+	It("doesn't replace a failed job while suspended", func() {
+		obj.Spec.Suspend = true
+		helper.TestClient.Create(pod)
+		job.Annotations = map[string]string{SPEC_HASH_ANNOTATION: "outdated"}
+		failJob(job)
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+	})
+
+	It("leaves a running job alone while suspended", func() {
+		obj.Spec.Suspend = true
+		helper.TestClient.Create(pod)
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Suspend).To(BeNil())
+	})
+
+	It("suspends a running job along with the Migrator if requested", func() {
+		obj.Spec.Suspend = true
+		obj.Spec.SuspendRunningJob = true
+		helper.TestClient.Create(pod)
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(helper.Events).To(Receive(ContainSubstring("JobSuspended")))
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Suspend).ToNot(BeNil())
+		Expect(*job.Spec.Suspend).To(BeTrue())
+		Expect(job.Annotations).To(HaveKeyWithValue(SUSPENDED_ANNOTATION, "true"))
+	})
+
+	It("resumes a suspended job when the Migrator is resumed", func() {
+		helper.TestClient.Create(pod)
+		suspend := true
+		job.Spec.Suspend = &suspend
+		job.Annotations = map[string]string{SUSPENDED_ANNOTATION: "true"}
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("Suspended").WithReason("NotSuspended").WithStatus("False"))
+		Expect(obj).To(HaveCondition("MigrationsReady").WithReason("MigrationsRunning").WithStatus("False"))
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(*job.Spec.Suspend).To(BeFalse())
+		Expect(job.Annotations).ToNot(HaveKey(SUSPENDED_ANNOTATION))
+	})
+
+	It("doesn't start a job while globally frozen", func() {
+		helper = suiteHelper.Setup(Migrations(&fakeFreezer{status: freeze.Status{Frozen: true, By: "alice", Reason: "database maintenance"}}), obj)
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("Suspended").WithReason("GloballyFrozen").WithStatus("True"))
+		Expect(conditions.FindStatusCondition(obj.Status.Conditions, "Suspended").Message).To(Equal("All migrations are frozen (frozenBy alice): database maintenance"))
+		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations", Namespace: "default"}, job)
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("doesn't start a job while the freeze ConfigMap is set", func() {
+		freezer := &configMapFreezer{}
+		helper = suiteHelper.Setup(Migrations(freezer), obj)
+		freezer.client = helper.Client
+		helper.TestClient.Create(pod)
+		Expect(helper.Client.Create(context.Background(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: freeze.FREEZE_CONFIGMAP_NAME, Namespace: "migrations-operator"},
+			Data:       map[string]string{"frozen": "true", "frozenBy": "alice"},
+		})).To(Succeed())
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("Suspended").WithReason("GloballyFrozen").WithStatus("True"))
+		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations", Namespace: "default"}, job)
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("starts a migration when the global freeze is lifted", func() {
+		helper = suiteHelper.Setup(Migrations(&fakeFreezer{}), obj)
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("Suspended").WithReason("NotSuspended").WithStatus("False"))
+		helper.TestClient.GetName("testing-migrations", job)
+	})
+
 	It("recognizes a failed job", func() {
 		helper.TestClient.Create(pod)
-		job.Status.Failed = 1
+		failJob(job)
 		helper.TestClient.Create(job)
 		helper.MustReconcile()
 		Expect(obj).To(HaveCondition("MigrationsReady").WithStatus("False").WithReason("MigrationsFailed"))
+		Expect(obj.Status.History).To(HaveLen(1))
+		Expect(obj.Status.History[0].Result).To(Equal(migrationsv1.MigrationResultFailed))
+		Expect(obj.Status.LastSuccessfulMigration()).To(Equal(""))
 		job2 := &batchv1.Job{}
 		helper.TestClient.GetName("testing-migrations", job2)
 		Expect(job.Spec).To(Equal(job2.Spec))
 	})
 
+	It("waits for a job which is retrying after a pod failed", func() {
+		helper.TestClient.Create(pod)
+		job.Status.Failed = 1
+		job.Status.Active = 1
+		helper.TestClient.Create(job)
+		helper.MustReconcile()
+		Expect(obj).To(HaveCondition("MigrationsReady").WithStatus("False").WithReason("MigrationsRunning"))
+		Expect(obj.Status.History).To(BeEmpty())
+		Expect(obj.Status.CurrentJob).To(Equal("testing-migrations"))
+	})
+
 	It("it uses a template pod if specified", func() {
 		obj.Spec.TemplateSelector = &metav1.LabelSelector{
 			MatchLabels: map[string]string{"app": "two"},
@@ -179,8 +630,95 @@ var _ = Describe("Migrations component", func() {
 		Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("two:latest"))
 	})
 
+	It("uses an init container as the template container", func() {
+		obj.Spec.Container = "db-migrations"
+		pod.Spec.InitContainers = []corev1.Container{
+			{
+				Name:  "db-migrations",
+				Image: "myapp-migrations:v1",
+			},
+			{
+				Name:  "other-init",
+				Image: "other:latest",
+			},
+		}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		Expect(helper.Events).To(Receive(Equal("Normal MigrationsStarted Started migration job default/testing-migrations using image myapp-migrations:v1")))
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers).To(HaveLen(1))
+		Expect(job.Spec.Template.Spec.Containers[0].Name).To(Equal("migrations"))
+		Expect(job.Spec.Template.Spec.Containers[0].Image).To(Equal("myapp-migrations:v1"))
+		Expect(job.Spec.Template.Spec.InitContainers).To(HaveLen(1))
+		Expect(job.Spec.Template.Spec.InitContainers[0].Name).To(Equal("other-init"))
+	})
+
+	It("keeps all non-waiter init containers by default", func() {
+		pod.Spec.InitContainers = []corev1.Container{
+			{Name: "fetch-secrets", Image: "fetcher"},
+			{Name: "migrate-wait-testing", Image: "waiter", Command: []string{"/waiter", "myapp:latest", "default", "testing", "api"}},
+			{Name: "renamed-waiter", Image: "waiter", Command: []string{"/waiter", "myapp:latest", "default", "other", "api"}},
+			{Name: "warm-cache", Image: "myapp:latest"},
+		}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		names := []string{}
+		for _, c := range job.Spec.Template.Spec.InitContainers {
+			names = append(names, c.Name)
+		}
+		Expect(names).To(Equal([]string{"fetch-secrets", "warm-cache"}))
+	})
+
+	It("removes the waiter token volumes", func() {
+		obj.Spec.Job.DisableSanitizers = []migrationsv1.Sanitizer{migrationsv1.SanitizerUnusedVolumes}
+		pod.Spec.InitContainers = []corev1.Container{
+			{Name: "migrate-wait-testing", Image: "waiter", Command: []string{"/waiter"}, VolumeMounts: []corev1.VolumeMount{{Name: webhook.WAITER_TOKEN_VOLUME, MountPath: webhook.WAITER_TOKEN_MOUNT_PATH}}},
+		}
+		pod.Spec.Volumes = []corev1.Volume{
+			{Name: "config", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			{Name: webhook.WAITER_TOKEN_VOLUME, VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{}}},
+			{Name: "migrate-wait-other", VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: "other-migrations-waiter"}}},
+		}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Volumes).To(HaveLen(1))
+		Expect(job.Spec.Template.Spec.Volumes[0].Name).To(Equal("config"))
+	})
+
+	It("filters init containers", func() {
+		obj.Spec.Job.InitContainers = &migrationsv1.InitContainerFilter{
+			Include: []string{"fetch-*", "warm-cache", "upload-assets"},
+			Exclude: []string{"warm-*"},
+		}
+		pod.Spec.InitContainers = []corev1.Container{
+			{Name: "fetch-secrets", Image: "fetcher"},
+			{Name: "fetch-config", Image: "fetcher"},
+			{Name: "warm-cache", Image: "myapp:latest"},
+			{Name: "upload-assets", Image: "myapp:latest"},
+			{Name: "other", Image: "myapp:latest"},
+			{Name: "migrate-wait-testing", Image: "waiter", Command: []string{"/waiter", "myapp:latest", "default", "testing", "api"}},
+		}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		names := []string{}
+		for _, c := range job.Spec.Template.Spec.InitContainers {
+			names = append(names, c.Name)
+		}
+		Expect(names).To(Equal([]string{"fetch-secrets", "fetch-config", "upload-assets"}))
+	})
+
+	It("errors if the named container doesn't exist", func() {
+		obj.Spec.Container = "missing"
+		helper.TestClient.Create(pod)
+		_, err := helper.Reconcile()
+		Expect(err).To(MatchError("no template container found"))
+	})
+
 	It("applies image override", func() {
-		obj.Spec.Image = "other:1"
+		obj.Spec.Job.Image = "other:1"
 		helper.TestClient.Create(pod)
 		helper.MustReconcile()
 		helper.TestClient.GetName("testing-migrations", job)
@@ -189,7 +727,7 @@ var _ = Describe("Migrations component", func() {
 
 	It("applies command override", func() {
 		command := []string{"run", "migrations"}
-		obj.Spec.Command = &command
+		obj.Spec.Job.Command = command
 		helper.TestClient.Create(pod)
 		helper.MustReconcile()
 		helper.TestClient.GetName("testing-migrations", job)
@@ -198,13 +736,202 @@ var _ = Describe("Migrations component", func() {
 
 	It("applies args override", func() {
 		args := []string{"run", "migrations"}
-		obj.Spec.Args = &args
+		obj.Spec.Job.Args = args
 		helper.TestClient.Create(pod)
 		helper.MustReconcile()
 		helper.TestClient.GetName("testing-migrations", job)
 		Expect(job.Spec.Template.Spec.Containers[0].Args).To(Equal([]string{"run", "migrations"}))
 	})
 
+	It("keeps a sidecar as a native sidecar", func() {
+		obj.Spec.Job.Sidecars.Containers = []string{"proxy"}
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name:  "proxy",
+			Image: "cloud-sql-proxy:latest",
+		})
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers).To(HaveLen(1))
+		Expect(job.Spec.Template.Spec.InitContainers).To(HaveLen(1))
+		Expect(job.Spec.Template.Spec.InitContainers[0].Name).To(Equal("proxy"))
+
+		// The typed API doesn't have restartPolicy on containers and the fake client round-trips through it,
+		// so check the conversion directly.
+		u, err := withNativeSidecars(job, []string{"proxy"})
+		Expect(err).ToNot(HaveOccurred())
+		initContainers, _, _ := unstructured.NestedSlice(u.Object, "spec", "template", "spec", "initContainers")
+		Expect(initContainers[0]).To(HaveKeyWithValue("restartPolicy", "Always"))
+	})
+
+	It("keeps a sidecar as a normal container in legacy mode", func() {
+		obj.Spec.Job.Sidecars.Containers = []string{"proxy"}
+		obj.Spec.Job.Sidecars.Mode = migrationsv1.SidecarModeLegacy
+		pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{
+			Name:  "proxy",
+			Image: "cloud-sql-proxy:latest",
+		})
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers).To(HaveLen(2))
+		Expect(job.Spec.Template.Spec.Containers[0].Name).To(Equal("migrations"))
+		Expect(job.Spec.Template.Spec.Containers[1].Name).To(Equal("proxy"))
+		Expect(job.Spec.Template.Spec.InitContainers).To(BeEmpty())
+	})
+
+	It("errors on a missing sidecar", func() {
+		obj.Spec.Job.Sidecars.Containers = []string{"proxy"}
+		helper.TestClient.Create(pod)
+		_, err := helper.Reconcile()
+		Expect(err).To(MatchError("error adding sidecars: sidecar proxy not found in template"))
+	})
+
+	It("wraps the command to shut down sidecars", func() {
+		obj.Spec.Job.Command = []string{"migrate"}
+		obj.Spec.Job.Args = []string{"--all"}
+		obj.Spec.Job.Sidecars.ShutdownURL = "http://localhost:15020/quitquitquit"
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		container := job.Spec.Template.Spec.Containers[0]
+		Expect(container.Command[:2]).To(Equal([]string{"/bin/sh", "-c"}))
+		Expect(container.Command[3:]).To(Equal([]string{"migrations", "migrate", "--all"}))
+		Expect(container.Args).To(BeEmpty())
+		Expect(container.Env).To(ContainElement(corev1.EnvVar{Name: "MIGRATIONS_SIDECAR_SHUTDOWN_URL", Value: "http://localhost:15020/quitquitquit"}))
+	})
+
+	It("errors on sidecar shutdown without a command", func() {
+		obj.Spec.Job.Sidecars.ShutdownURL = "http://localhost:15020/quitquitquit"
+		helper.TestClient.Create(pod)
+		_, err := helper.Reconcile()
+		Expect(err).To(MatchError("sidecar shutdown requires an explicit command"))
+	})
+
+	It("records sanitized fields on the job", func() {
+		pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{ContainerPort: 8000}}
+		pod.Spec.Containers[0].ReadinessProbe = &corev1.Probe{ProbeHandler: corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"true"}}}}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers[0].Ports).To(BeEmpty())
+		Expect(job.Spec.Template.Spec.Containers[0].ReadinessProbe).To(BeNil())
+		Expect(job.Annotations).To(HaveKeyWithValue(SANITIZED_ANNOTATION, "containers[migrations].readinessProbe,containers[migrations].ports"))
+	})
+
+	It("applies env overrides", func() {
+		pod.Spec.Containers[0].Env = []corev1.EnvVar{
+			{Name: "DATABASE_URL", Value: "postgres://app@db/app"},
+			{Name: "DEBUG", Value: "true"},
+			{Name: "PORT", Value: "8000"},
+		}
+		obj.Spec.Job.Env = []corev1.EnvVar{
+			{
+				Name: "DATABASE_URL",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "migration-creds"},
+						Key:                  "url",
+					},
+				},
+			},
+			{Name: "MIGRATION_LOCK_TIMEOUT", Value: "60"},
+		}
+		obj.Spec.Job.RemoveEnv = []string{"PORT"}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers[0].Env).To(Equal([]corev1.EnvVar{
+			{
+				Name: "DATABASE_URL",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: "migration-creds"},
+						Key:                  "url",
+					},
+				},
+			},
+			{Name: "DEBUG", Value: "true"},
+			{Name: "MIGRATION_LOCK_TIMEOUT", Value: "60"},
+		}))
+	})
+
+	It("applies envFrom overrides", func() {
+		pod.Spec.Containers[0].EnvFrom = []corev1.EnvFromSource{
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-creds"}}},
+			{ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}}},
+		}
+		obj.Spec.Job.EnvFrom = []corev1.EnvFromSource{
+			{Prefix: "APP_", ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}}},
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "migration-creds"}}},
+		}
+		obj.Spec.Job.RemoveEnvFrom = []string{"app-creds"}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers[0].EnvFrom).To(Equal([]corev1.EnvFromSource{
+			{Prefix: "APP_", ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"}}},
+			{SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: "migration-creds"}}},
+		}))
+	})
+
+	It("uses the template container's resources by default", func() {
+		pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+		}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers[0].Resources).To(Equal(pod.Spec.Containers[0].Resources))
+	})
+
+	It("overrides the container resources", func() {
+		pod.Spec.Containers[0].Resources = corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+		}
+		obj.Spec.Job.Resources = &corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+		}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.Containers[0].Resources).To(Equal(corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("1Gi")},
+		}))
+	})
+
+	It("fills in static defaults", func() {
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		Expect(obj.Spec.TemplateSelector).To(Equal(obj.Spec.Selector))
+		Expect(obj.Spec.Job.Sidecars.Mode).To(Equal(migrationsv1.SidecarModeNative))
+		Expect(obj.Spec.Job.SuccessfulJobRetention).To(Equal(migrationsv1.JobRetentionDelete))
+		Expect(obj.Spec.Job.SpecChangePolicy).To(Equal(migrationsv1.SpecChangePolicyIgnore))
+	})
+
+	It("uses the template ServiceAccount by default", func() {
+		pod.Spec.ServiceAccountName = "myapp"
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.ServiceAccountName).To(Equal("myapp"))
+		Expect(obj.Status.ServiceAccountName).To(Equal("myapp"))
+		Expect(conditions.IsStatusConditionFalse(obj.Status.Conditions, "ServiceAccountMismatch")).To(BeTrue())
+	})
+
+	It("overrides the ServiceAccount", func() {
+		obj.Spec.Job.ServiceAccountName = "migrations"
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Spec.ServiceAccountName).To(Equal("migrations"))
+		Expect(obj.Status.ServiceAccountName).To(Equal("migrations"))
+		cond := conditions.FindStatusCondition(obj.Status.Conditions, "ServiceAccountMismatch")
+		Expect(cond).ToNot(BeNil())
+		Expect(cond.Status).To(Equal(metav1.ConditionTrue))
+		Expect(cond.Message).To(Equal("Migration job runs as ServiceAccount migrations instead of template ServiceAccount default"))
+	})
+
 	It("follows owner references for a deployment", func() {
 		truep := true
 		deployment := &appsv1.Deployment{
@@ -253,7 +980,7 @@ var _ = Describe("Migrations component", func() {
 	})
 
 	It("applies specified labels to the migration pod", func() {
-		obj.Spec.Labels = map[string]string{"key1": "value1"}
+		obj.Spec.Job.PodLabels = map[string]string{"key1": "value1"}
 		helper.TestClient.Create(pod)
 		helper.MustReconcile()
 		helper.TestClient.GetName("testing-migrations", job)
@@ -269,13 +996,97 @@ var _ = Describe("Migrations component", func() {
 	})
 
 	It("applies specified annotations to the migration pod", func() {
-		obj.Spec.Annotations = map[string]string{"key2": "value2"}
+		obj.Spec.Job.PodAnnotations = map[string]string{"key2": "value2"}
 		helper.TestClient.Create(pod)
 		helper.MustReconcile()
 		helper.TestClient.GetName("testing-migrations", job)
 		Expect(job.Spec.Template.ObjectMeta.Annotations).To(HaveKeyWithValue("key2", "value2"))
 	})
 
+	It("doesn't inherit template metadata by default", func() {
+		pod.Labels["app"] = "myapp"
+		pod.Annotations = map[string]string{"vault.hashicorp.com/agent-inject": "true"}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Labels).ToNot(HaveKey("app"))
+		Expect(job.Spec.Template.Annotations).ToNot(HaveKey("vault.hashicorp.com/agent-inject"))
+	})
+
+	It("inherits template labels and annotations", func() {
+		obj.Spec.Job.InheritLabels = &migrationsv1.InheritRules{}
+		obj.Spec.Job.InheritAnnotations = &migrationsv1.InheritRules{
+			Include: []string{"vault.hashicorp.com/*", "eks.amazonaws.com/role-arn"},
+			Exclude: []string{"vault.hashicorp.com/agent-pre-populate-only"},
+		}
+		obj.Spec.Job.PodLabels = map[string]string{"team": "override"}
+		pod.Labels["app"] = "myapp"
+		pod.Labels["team"] = "db"
+		pod.Labels["pod-template-hash"] = "1234"
+		pod.Annotations = map[string]string{
+			"vault.hashicorp.com/agent-inject":            "true",
+			"vault.hashicorp.com/agent-pre-populate-only": "true",
+			"eks.amazonaws.com/role-arn":                  "arn:aws:iam::1234:role/app",
+			"sidecar.istio.io/status":                     "{}",
+		}
+		helper.TestClient.Create(pod)
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Labels).To(HaveKeyWithValue("app", "myapp"))
+		Expect(job.Labels).ToNot(HaveKey("pod-template-hash"))
+		Expect(job.Spec.Template.Labels).To(Equal(map[string]string{"app": "myapp", "component": "web", "team": "override", "migrations": "testing"}))
+		Expect(job.Annotations).To(HaveKeyWithValue("vault.hashicorp.com/agent-inject", "true"))
+		Expect(job.Spec.Template.Annotations).To(Equal(map[string]string{
+			"vault.hashicorp.com/agent-inject": "true",
+			"eks.amazonaws.com/role-arn":       "arn:aws:iam::1234:role/app",
+			webhook.NOWAIT_MIGRATOR_ANNOTATION: "true",
+		}))
+	})
+
+	It("inherits annotations from the owner's pod template", func() {
+		obj.Spec.Job.InheritAnnotations = &migrationsv1.InheritRules{Include: []string{"vault.hashicorp.com/*"}}
+		truep := true
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{"vault.hashicorp.com/role": "myapp"},
+					},
+					Spec: pod.Spec,
+				},
+			},
+		}
+		helper.TestClient.Create(deployment)
+		rs := &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "testing-1234",
+				OwnerReferences: []metav1.OwnerReference{
+					{
+						APIVersion: "apps/v1",
+						Kind:       "Deployment",
+						Name:       "testing",
+						Controller: &truep,
+					},
+				},
+			},
+		}
+		helper.TestClient.Create(rs)
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{
+				APIVersion: "apps/v1",
+				Kind:       "ReplicaSet",
+				Name:       "testing-1234",
+				Controller: &truep,
+			},
+		}
+		helper.TestClient.Create(pod)
+
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations", job)
+		Expect(job.Spec.Template.Annotations).To(HaveKeyWithValue("vault.hashicorp.com/role", "myapp"))
+	})
+
 	It("follows owner references for an argoproj.io rollout", func() {
 		truep := true
 		rollout := &argoprojstubsv1alpha1.Rollout{
@@ -0,0 +1,277 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"fmt"
+
+	cu "github.com/coderanger/controller-utils"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+// Annotation on the migration Job listing the fields removed by sanitizers.
+const SANITIZED_ANNOTATION = "migrations.coderanger.net/sanitized"
+
+// A sanitizer function removes fields from the migration pod spec, returning a description of each.
+type sanitizerFunc func(ctx *cu.Context, templatePod *corev1.Pod, spec *corev1.PodSpec) ([]string, error)
+
+// Sanitizers in the order they run. UnusedVolumes must come after anything which removes mounts.
+var sanitizers = []struct {
+	rule migrationsv1.Sanitizer
+	fn   sanitizerFunc
+}{
+	{migrationsv1.SanitizerProbes, sanitizeProbes},
+	{migrationsv1.SanitizerPorts, sanitizePorts},
+	{migrationsv1.SanitizerHostPorts, sanitizeHostPorts},
+	{migrationsv1.SanitizerLifecycle, sanitizeLifecycle},
+	{migrationsv1.SanitizerTopologySpread, sanitizeTopologySpread},
+	{migrationsv1.SanitizerSelfAntiAffinity, sanitizeSelfAntiAffinity},
+	{migrationsv1.SanitizerReadWriteOnceVolumes, sanitizeReadWriteOnceVolumes},
+	{migrationsv1.SanitizerUnusedVolumes, sanitizeUnusedVolumes},
+}
+
+// sanitizePodSpec runs all enabled sanitizers over the migration pod spec. The migration container must
+// be the first container.
+func sanitizePodSpec(ctx *cu.Context, obj *migrationsv1.Migrator, templatePod *corev1.Pod, spec *corev1.PodSpec) ([]string, error) {
+	disabled := map[migrationsv1.Sanitizer]bool{}
+	for _, rule := range obj.Spec.Job.DisableSanitizers {
+		disabled[rule] = true
+	}
+	removed := []string{}
+	for _, s := range sanitizers {
+		if disabled[s.rule] {
+			continue
+		}
+		fields, err := s.fn(ctx, templatePod, spec)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error running sanitizer %s", s.rule)
+		}
+		removed = append(removed, fields...)
+	}
+	return removed, nil
+}
+
+func sanitizeProbes(_ *cu.Context, _ *corev1.Pod, spec *corev1.PodSpec) ([]string, error) {
+	// Probes will rarely work for a migration command.
+	c := &spec.Containers[0]
+	removed := []string{}
+	if c.ReadinessProbe != nil {
+		c.ReadinessProbe = nil
+		removed = append(removed, fmt.Sprintf("containers[%s].readinessProbe", c.Name))
+	}
+	if c.LivenessProbe != nil {
+		c.LivenessProbe = nil
+		removed = append(removed, fmt.Sprintf("containers[%s].livenessProbe", c.Name))
+	}
+	if c.StartupProbe != nil {
+		c.StartupProbe = nil
+		removed = append(removed, fmt.Sprintf("containers[%s].startupProbe", c.Name))
+	}
+	return removed, nil
+}
+
+func sanitizePorts(_ *cu.Context, _ *corev1.Pod, spec *corev1.PodSpec) ([]string, error) {
+	c := &spec.Containers[0]
+	if len(c.Ports) == 0 {
+		return nil, nil
+	}
+	c.Ports = nil
+	return []string{fmt.Sprintf("containers[%s].ports", c.Name)}, nil
+}
+
+func sanitizeHostPorts(_ *cu.Context, _ *corev1.Pod, spec *corev1.PodSpec) ([]string, error) {
+	// A hostPort will conflict with the application pod if they land on the same node.
+	removed := []string{}
+	strip := func(field string, containers []corev1.Container) {
+		for i := range containers {
+			c := &containers[i]
+			for j := range c.Ports {
+				if c.Ports[j].HostPort != 0 {
+					c.Ports[j].HostPort = 0
+					removed = append(removed, fmt.Sprintf("%s[%s].ports[%d].hostPort", field, c.Name, j))
+				}
+			}
+		}
+	}
+	strip("initContainers", spec.InitContainers)
+	strip("containers", spec.Containers)
+	return removed, nil
+}
+
+func sanitizeLifecycle(_ *cu.Context, _ *corev1.Pod, spec *corev1.PodSpec) ([]string, error) {
+	// Lifecycle hooks are often things like deregistering from a load balancer, which can hang or fail.
+	c := &spec.Containers[0]
+	if c.Lifecycle == nil {
+		return nil, nil
+	}
+	c.Lifecycle = nil
+	return []string{fmt.Sprintf("containers[%s].lifecycle", c.Name)}, nil
+}
+
+func sanitizeTopologySpread(_ *cu.Context, _ *corev1.Pod, spec *corev1.PodSpec) ([]string, error) {
+	if len(spec.TopologySpreadConstraints) == 0 {
+		return nil, nil
+	}
+	spec.TopologySpreadConstraints = nil
+	return []string{"topologySpreadConstraints"}, nil
+}
+
+func sanitizeSelfAntiAffinity(_ *cu.Context, templatePod *corev1.Pod, spec *corev1.PodSpec) ([]string, error) {
+	if spec.Affinity == nil || spec.Affinity.PodAntiAffinity == nil {
+		return nil, nil
+	}
+	podLabels := labels.Set(templatePod.Labels)
+	matchesSelf := func(term *corev1.PodAffinityTerm) bool {
+		if term.LabelSelector == nil {
+			return false
+		}
+		selector, err := metav1.LabelSelectorAsSelector(term.LabelSelector)
+		if err != nil {
+			return false
+		}
+		return selector.Matches(podLabels)
+	}
+
+	removed := []string{}
+	antiAffinity := spec.Affinity.PodAntiAffinity
+	required := []corev1.PodAffinityTerm{}
+	for i := range antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution {
+		term := antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution[i]
+		if matchesSelf(&term) {
+			removed = append(removed, fmt.Sprintf("affinity.podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution[%d]", i))
+		} else {
+			required = append(required, term)
+		}
+	}
+	preferred := []corev1.WeightedPodAffinityTerm{}
+	for i := range antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		term := antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[i]
+		if matchesSelf(&term.PodAffinityTerm) {
+			removed = append(removed, fmt.Sprintf("affinity.podAntiAffinity.preferredDuringSchedulingIgnoredDuringExecution[%d]", i))
+		} else {
+			preferred = append(preferred, term)
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	if len(required) == 0 && len(preferred) == 0 {
+		spec.Affinity.PodAntiAffinity = nil
+	} else {
+		antiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = required
+		antiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = preferred
+	}
+	return removed, nil
+}
+
+func sanitizeReadWriteOnceVolumes(ctx *cu.Context, templatePod *corev1.Pod, spec *corev1.PodSpec) ([]string, error) {
+	rwoVolumes := map[string]bool{}
+	for _, v := range spec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+		pvc := &corev1.PersistentVolumeClaim{}
+		err := ctx.Client.Get(ctx, types.NamespacedName{Name: v.PersistentVolumeClaim.ClaimName, Namespace: templatePod.Namespace}, pvc)
+		if err != nil {
+			if kerrors.IsNotFound(err) {
+				// Leave it alone, the Job will wait for it like any other pod would.
+				continue
+			}
+			return nil, errors.Wrapf(err, "error getting PersistentVolumeClaim %s/%s", templatePod.Namespace, v.PersistentVolumeClaim.ClaimName)
+		}
+		for _, mode := range pvc.Spec.AccessModes {
+			if mode == corev1.ReadWriteOnce || mode == corev1.ReadWriteOncePod {
+				rwoVolumes[v.Name] = true
+			}
+		}
+	}
+	if len(rwoVolumes) == 0 {
+		return nil, nil
+	}
+
+	removed := []string{}
+	volumes := []corev1.Volume{}
+	for _, v := range spec.Volumes {
+		if rwoVolumes[v.Name] {
+			removed = append(removed, fmt.Sprintf("volumes[%s]", v.Name))
+		} else {
+			volumes = append(volumes, v)
+		}
+	}
+	spec.Volumes = volumes
+	unmount := func(containers []corev1.Container) {
+		for i := range containers {
+			c := &containers[i]
+			mounts := []corev1.VolumeMount{}
+			for _, m := range c.VolumeMounts {
+				if !rwoVolumes[m.Name] {
+					mounts = append(mounts, m)
+				}
+			}
+			if len(mounts) != len(c.VolumeMounts) {
+				c.VolumeMounts = mounts
+			}
+			devices := []corev1.VolumeDevice{}
+			for _, d := range c.VolumeDevices {
+				if !rwoVolumes[d.Name] {
+					devices = append(devices, d)
+				}
+			}
+			if len(devices) != len(c.VolumeDevices) {
+				c.VolumeDevices = devices
+			}
+		}
+	}
+	unmount(spec.InitContainers)
+	unmount(spec.Containers)
+	return removed, nil
+}
+
+func sanitizeUnusedVolumes(_ *cu.Context, _ *corev1.Pod, spec *corev1.PodSpec) ([]string, error) {
+	used := map[string]bool{}
+	for _, containers := range [][]corev1.Container{spec.InitContainers, spec.Containers} {
+		for _, c := range containers {
+			for _, m := range c.VolumeMounts {
+				used[m.Name] = true
+			}
+			for _, d := range c.VolumeDevices {
+				used[d.Name] = true
+			}
+		}
+	}
+	removed := []string{}
+	volumes := []corev1.Volume{}
+	for _, v := range spec.Volumes {
+		if used[v.Name] {
+			volumes = append(volumes, v)
+		} else {
+			removed = append(removed, fmt.Sprintf("volumes[%s]", v.Name))
+		}
+	}
+	if len(removed) == 0 {
+		return nil, nil
+	}
+	spec.Volumes = volumes
+	return removed, nil
+}
@@ -0,0 +1,239 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/ginkgo/extensions/table"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+type sanitizeCase struct {
+	disable  []migrationsv1.Sanitizer
+	objects  []client.Object
+	spec     corev1.PodSpec
+	expected corev1.PodSpec
+	removed  []string
+}
+
+func sanitizeContainer(mutate func(*corev1.Container)) corev1.Container {
+	c := corev1.Container{Name: "migrations", Image: "myapp:latest"}
+	if mutate != nil {
+		mutate(&c)
+	}
+	return c
+}
+
+func sanitizeVolume(name, claim string) corev1.Volume {
+	v := corev1.Volume{Name: name}
+	if claim != "" {
+		v.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim}
+	} else {
+		v.EmptyDir = &corev1.EmptyDirVolumeSource{}
+	}
+	return v
+}
+
+var _ = Describe("Sanitizers", func() {
+	selfTerm := corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "myapp"}},
+		TopologyKey:   "kubernetes.io/hostname",
+	}
+	otherTerm := corev1.PodAffinityTerm{
+		LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "other"}},
+		TopologyKey:   "kubernetes.io/hostname",
+	}
+	probe := &corev1.Probe{ProbeHandler: corev1.ProbeHandler{Exec: &corev1.ExecAction{Command: []string{"true"}}}}
+
+	DescribeTable("sanitizing the migration pod spec",
+		func(c sanitizeCase) {
+			obj := &migrationsv1.Migrator{
+				Spec: migrationsv1.MigratorSpec{Job: migrationsv1.MigrationJobSpec{DisableSanitizers: c.disable}},
+			}
+			helper := suiteHelper.Setup(Migrations(nil), obj)
+			for _, o := range c.objects {
+				helper.TestClient.Create(o)
+			}
+			templatePod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "testpod",
+					Namespace: "default",
+					Labels:    map[string]string{"app": "myapp"},
+				},
+			}
+			spec := c.spec.DeepCopy()
+			removed, err := sanitizePodSpec(helper.Ctx, obj, templatePod, spec)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(removed).To(Equal(c.removed))
+			Expect(*spec).To(Equal(c.expected))
+		},
+		Entry("nothing to remove", sanitizeCase{
+			spec:     corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(nil)}},
+			expected: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(nil)}},
+			removed:  []string{},
+		}),
+		Entry("probes", sanitizeCase{
+			spec: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+				c.ReadinessProbe = probe
+				c.LivenessProbe = probe
+				c.StartupProbe = probe
+			})}},
+			expected: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(nil)}},
+			removed:  []string{"containers[migrations].readinessProbe", "containers[migrations].livenessProbe", "containers[migrations].startupProbe"},
+		}),
+		Entry("probes disabled", sanitizeCase{
+			disable: []migrationsv1.Sanitizer{migrationsv1.SanitizerProbes},
+			spec: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+				c.ReadinessProbe = probe
+			})}},
+			expected: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+				c.ReadinessProbe = probe
+			})}},
+			removed: []string{},
+		}),
+		Entry("ports and host ports", sanitizeCase{
+			spec: corev1.PodSpec{Containers: []corev1.Container{
+				sanitizeContainer(func(c *corev1.Container) {
+					c.Ports = []corev1.ContainerPort{{ContainerPort: 8000}}
+				}),
+				{Name: "proxy", Ports: []corev1.ContainerPort{{ContainerPort: 9000, HostPort: 9000}}},
+			}},
+			expected: corev1.PodSpec{Containers: []corev1.Container{
+				sanitizeContainer(nil),
+				{Name: "proxy", Ports: []corev1.ContainerPort{{ContainerPort: 9000}}},
+			}},
+			removed: []string{"containers[migrations].ports", "containers[proxy].ports[0].hostPort"},
+		}),
+		Entry("host ports only", sanitizeCase{
+			disable: []migrationsv1.Sanitizer{migrationsv1.SanitizerPorts},
+			spec: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+				c.Ports = []corev1.ContainerPort{{ContainerPort: 8000}, {ContainerPort: 8001, HostPort: 8001}}
+			})}},
+			expected: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+				c.Ports = []corev1.ContainerPort{{ContainerPort: 8000}, {ContainerPort: 8001}}
+			})}},
+			removed: []string{"containers[migrations].ports[1].hostPort"},
+		}),
+		Entry("lifecycle hooks", sanitizeCase{
+			spec: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+				c.Lifecycle = &corev1.Lifecycle{PreStop: &corev1.LifecycleHandler{Exec: &corev1.ExecAction{Command: []string{"sleep", "30"}}}}
+			})}},
+			expected: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(nil)}},
+			removed:  []string{"containers[migrations].lifecycle"},
+		}),
+		Entry("topology spread constraints", sanitizeCase{
+			spec: corev1.PodSpec{
+				Containers:                []corev1.Container{sanitizeContainer(nil)},
+				TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{MaxSkew: 1, TopologyKey: "zone"}},
+			},
+			expected: corev1.PodSpec{Containers: []corev1.Container{sanitizeContainer(nil)}},
+			removed:  []string{"topologySpreadConstraints"},
+		}),
+		Entry("self anti-affinity", sanitizeCase{
+			spec: corev1.PodSpec{
+				Containers: []corev1.Container{sanitizeContainer(nil)},
+				Affinity: &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution:  []corev1.PodAffinityTerm{selfTerm, otherTerm},
+					PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{{Weight: 1, PodAffinityTerm: selfTerm}},
+				}},
+			},
+			expected: corev1.PodSpec{
+				Containers: []corev1.Container{sanitizeContainer(nil)},
+				Affinity: &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution:  []corev1.PodAffinityTerm{otherTerm},
+					PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{},
+				}},
+			},
+			removed: []string{
+				"affinity.podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution[0]",
+				"affinity.podAntiAffinity.preferredDuringSchedulingIgnoredDuringExecution[0]",
+			},
+		}),
+		Entry("only self anti-affinity", sanitizeCase{
+			spec: corev1.PodSpec{
+				Containers: []corev1.Container{sanitizeContainer(nil)},
+				Affinity: &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: []corev1.PodAffinityTerm{selfTerm},
+				}},
+			},
+			expected: corev1.PodSpec{
+				Containers: []corev1.Container{sanitizeContainer(nil)},
+				Affinity:   &corev1.Affinity{},
+			},
+			removed: []string{"affinity.podAntiAffinity.requiredDuringSchedulingIgnoredDuringExecution[0]"},
+		}),
+		Entry("read-write-once volumes", sanitizeCase{
+			objects: []client.Object{
+				&corev1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Name: "rwo"},
+					Spec:       corev1.PersistentVolumeClaimSpec{AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}},
+				},
+				&corev1.PersistentVolumeClaim{
+					ObjectMeta: metav1.ObjectMeta{Name: "rwx"},
+					Spec:       corev1.PersistentVolumeClaimSpec{AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany}},
+				},
+			},
+			spec: corev1.PodSpec{
+				Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+					c.VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/data"}, {Name: "shared", MountPath: "/shared"}}
+				})},
+				Volumes: []corev1.Volume{sanitizeVolume("data", "rwo"), sanitizeVolume("shared", "rwx")},
+			},
+			expected: corev1.PodSpec{
+				Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+					c.VolumeMounts = []corev1.VolumeMount{{Name: "shared", MountPath: "/shared"}}
+				})},
+				Volumes: []corev1.Volume{sanitizeVolume("shared", "rwx")},
+			},
+			removed: []string{"volumes[data]"},
+		}),
+		Entry("unused volumes", sanitizeCase{
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init", VolumeMounts: []corev1.VolumeMount{{Name: "init", MountPath: "/init"}}}},
+				Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+					c.VolumeMounts = []corev1.VolumeMount{{Name: "config", MountPath: "/config"}}
+				})},
+				Volumes: []corev1.Volume{sanitizeVolume("init", ""), sanitizeVolume("config", ""), sanitizeVolume("istio-envoy", "")},
+			},
+			expected: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init", VolumeMounts: []corev1.VolumeMount{{Name: "init", MountPath: "/init"}}}},
+				Containers: []corev1.Container{sanitizeContainer(func(c *corev1.Container) {
+					c.VolumeMounts = []corev1.VolumeMount{{Name: "config", MountPath: "/config"}}
+				})},
+				Volumes: []corev1.Volume{sanitizeVolume("init", ""), sanitizeVolume("config", "")},
+			},
+			removed: []string{"volumes[istio-envoy]"},
+		}),
+		Entry("unused volumes disabled", sanitizeCase{
+			disable: []migrationsv1.Sanitizer{migrationsv1.SanitizerUnusedVolumes},
+			spec: corev1.PodSpec{
+				Containers: []corev1.Container{sanitizeContainer(nil)},
+				Volumes:    []corev1.Volume{sanitizeVolume("istio-envoy", "")},
+			},
+			expected: corev1.PodSpec{
+				Containers: []corev1.Container{sanitizeContainer(nil)},
+				Volumes:    []corev1.Volume{sanitizeVolume("istio-envoy", "")},
+			},
+			removed: []string{},
+		}),
+	)
+})
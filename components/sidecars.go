@@ -0,0 +1,108 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/utils"
+)
+
+const sidecarShutdownEnv = "MIGRATIONS_SIDECAR_SHUTDOWN_URL"
+
+// Runs the original command and then pokes the shutdown URL, preserving the exit code.
+const sidecarShutdownScript = `"$@"; rc=$?; ` +
+	`(curl -fsS -X POST "$` + sidecarShutdownEnv + `" || wget -q -O /dev/null --post-data "" "$` + sidecarShutdownEnv + `") >/dev/null 2>&1; ` +
+	`exit $rc`
+
+// wrapSidecarShutdown rewrites the migration container command to send a shutdown request when it exits.
+func wrapSidecarShutdown(container *corev1.Container, url string) error {
+	if len(container.Command) == 0 {
+		return errors.New("sidecar shutdown requires an explicit command")
+	}
+	command := []string{"/bin/sh", "-c", sidecarShutdownScript, "migrations"}
+	command = append(command, container.Command...)
+	command = append(command, container.Args...)
+	container.Command = command
+	container.Args = nil
+	container.Env = append(container.Env, corev1.EnvVar{Name: sidecarShutdownEnv, Value: url})
+	return nil
+}
+
+// addSidecars copies the requested sidecars from the template pod spec into the migration pod spec. It
+// returns the names of any containers which need to be run as native sidecars.
+func addSidecars(obj *migrationsv1.Migrator, templatePodSpec, migrationPodSpec *corev1.PodSpec) ([]string, error) {
+	nativeSidecars := []string{}
+	for _, name := range obj.Spec.Job.Sidecars.Containers {
+		if name == migrationPodSpec.Containers[0].Name {
+			// Can't reuse the migration container name.
+			return nil, errors.Errorf("sidecar name %s conflicts with the migration container", name)
+		}
+		if utils.FindContainer(migrationPodSpec, name) != nil {
+			// Already an init container, probably a native sidecar in the template already.
+			if obj.Spec.Job.Sidecars.Mode != migrationsv1.SidecarModeLegacy {
+				nativeSidecars = append(nativeSidecars, name)
+			}
+			continue
+		}
+		sidecar := utils.FindContainer(templatePodSpec, name)
+		if sidecar == nil {
+			return nil, errors.Errorf("sidecar %s not found in template", name)
+		}
+		sidecar = sidecar.DeepCopy()
+		if obj.Spec.Job.Sidecars.Mode == migrationsv1.SidecarModeLegacy {
+			migrationPodSpec.Containers = append(migrationPodSpec.Containers, *sidecar)
+		} else {
+			migrationPodSpec.InitContainers = append(migrationPodSpec.InitContainers, *sidecar)
+			nativeSidecars = append(nativeSidecars, name)
+		}
+	}
+	return nativeSidecars, nil
+}
+
+// withNativeSidecars converts a Job to unstructured form and marks the named init containers with
+// restartPolicy: Always. This is needed because our vendored API types predate native sidecars.
+func withNativeSidecars(job *batchv1.Job, sidecars []string) (*unstructured.Unstructured, error) {
+	raw, err := runtime.DefaultUnstructuredConverter.ToUnstructured(job)
+	if err != nil {
+		return nil, errors.Wrap(err, "error converting job to unstructured")
+	}
+	u := &unstructured.Unstructured{Object: raw}
+	u.SetGroupVersionKind(batchv1.SchemeGroupVersion.WithKind("Job"))
+	initContainers, _, err := unstructured.NestedSlice(raw, "spec", "template", "spec", "initContainers")
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading init containers")
+	}
+	for _, c := range initContainers {
+		container := c.(map[string]interface{})
+		for _, name := range sidecars {
+			if container["name"] == name {
+				container["restartPolicy"] = "Always"
+			}
+		}
+	}
+	err = unstructured.SetNestedSlice(raw, initContainers, "spec", "template", "spec", "initContainers")
+	if err != nil {
+		return nil, errors.Wrap(err, "error writing init containers")
+	}
+	return u, nil
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// The annotation on a migration Job holding the hash of its rendered pod spec.
+const SPEC_HASH_ANNOTATION = "migrations.coderanger.net/spec-hash"
+
+// The prefix of the ServiceAccount token volume the API server adds to each pod.
+const SERVICE_ACCOUNT_VOLUME_PREFIX = "kube-api-access-"
+
+// hashPodSpec hashes a rendered migration pod spec, along with which sidecars will be converted to native
+// sidecars since that happens after the spec is built.
+func hashPodSpec(spec *corev1.PodSpec, nativeSidecars []string) (string, error) {
+	data, err := json.Marshal(struct {
+		Spec           *corev1.PodSpec `json:"spec"`
+		NativeSidecars []string        `json:"nativeSidecars,omitempty"`
+	}{hashablePodSpec(spec), nativeSidecars})
+	if err != nil {
+		return "", errors.Wrap(err, "error encoding migration pod spec")
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])[:16], nil
+}
+
+// hashablePodSpec drops the fields which are filled in separately for each pod when the template is a pod
+// rather than its owner's template, so the hash doesn't change between pods of the same template.
+func hashablePodSpec(spec *corev1.PodSpec) *corev1.PodSpec {
+	spec = spec.DeepCopy()
+	spec.NodeName = ""
+	spec.Hostname = ""
+	spec.EphemeralContainers = nil
+	volumes := []corev1.Volume{}
+	for _, v := range spec.Volumes {
+		if !strings.HasPrefix(v.Name, SERVICE_ACCOUNT_VOLUME_PREFIX) {
+			volumes = append(volumes, v)
+		}
+	}
+	spec.Volumes = volumes
+	stripMounts := func(containers []corev1.Container) {
+		for i := range containers {
+			c := &containers[i]
+			mounts := []corev1.VolumeMount{}
+			for _, m := range c.VolumeMounts {
+				if !strings.HasPrefix(m.Name, SERVICE_ACCOUNT_VOLUME_PREFIX) {
+					mounts = append(mounts, m)
+				}
+			}
+			c.VolumeMounts = mounts
+		}
+	}
+	stripMounts(spec.InitContainers)
+	stripMounts(spec.Containers)
+	return spec
+}
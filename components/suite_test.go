@@ -26,7 +26,7 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 	argoprojstubsv1alpha1 "github.com/coderanger/migrations-operator/stubs/argoproj/v1alpha1"
 )
 
@@ -44,7 +44,7 @@ var _ = BeforeSuite(func() {
 	logf.SetLogger(zap.New(zap.UseDevMode(true), zap.WriteTo(GinkgoWriter)))
 
 	suiteHelper = cu.Unit().
-		API(migrationsv1beta1.AddToScheme).
+		API(migrationsv1.AddToScheme).
 		API(argoprojstubsv1alpha1.AddToScheme).
 		MustBuild()
 })
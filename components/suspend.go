@@ -0,0 +1,65 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	cu "github.com/coderanger/controller-utils"
+	"github.com/pkg/errors"
+	batchv1 "k8s.io/api/batch/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+// The annotation marking a migration Job which was suspended along with its Migrator.
+const SUSPENDED_ANNOTATION = "migrations.coderanger.net/suspended"
+
+// reconcileSuspended leaves everything as it is while a Migrator is suspended, other than optionally
+// suspending a running job.
+func (comp *migrationsComponent) reconcileSuspended(ctx *cu.Context, obj *migrationsv1.Migrator, job *batchv1.Job) (cu.Result, error) {
+	if job == nil || !obj.Spec.SuspendRunningJob || !jobRunning(job) {
+		return cu.Result{}, nil
+	}
+
+	patch := client.MergeFrom(job.DeepCopy())
+	if job.Annotations == nil {
+		job.Annotations = map[string]string{}
+	}
+	job.Annotations[SUSPENDED_ANNOTATION] = "true"
+	suspend := true
+	job.Spec.Suspend = &suspend
+	err := ctx.Client.Patch(ctx, job, patch)
+	if err != nil {
+		return cu.Result{}, errors.Wrapf(err, "error suspending migration job %s/%s", job.Namespace, job.Name)
+	}
+	ctx.Events.Eventf(obj, "Normal", "JobSuspended", "Suspended migration job %s/%s along with the Migrator", job.Namespace, job.Name)
+	return cu.Result{}, nil
+}
+
+// unsuspendJob resumes a migration job which was suspended along with its Migrator.
+func (comp *migrationsComponent) unsuspendJob(ctx *cu.Context, obj *migrationsv1.Migrator, job *batchv1.Job) error {
+	patch := client.MergeFrom(job.DeepCopy())
+	delete(job.Annotations, SUSPENDED_ANNOTATION)
+	suspend := false
+	job.Spec.Suspend = &suspend
+	err := ctx.Client.Patch(ctx, job, patch)
+	if err != nil {
+		return errors.Wrapf(err, "error resuming migration job %s/%s", job.Namespace, job.Name)
+	}
+	ctx.Events.Eventf(obj, "Normal", "JobResumed", "Resumed migration job %s/%s along with the Migrator", job.Namespace, job.Name)
+	return nil
+}
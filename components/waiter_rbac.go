@@ -0,0 +1,178 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"context"
+
+	cu "github.com/coderanger/controller-utils"
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/utils"
+	"github.com/coderanger/migrations-operator/webhook"
+)
+
+type waiterRBACComponent struct{}
+
+// WaiterRBAC creates the waiter RBAC component, which gives direct mode waiters a ServiceAccount that can only
+// read their own Migrator.
+func WaiterRBAC() *waiterRBACComponent {
+	return &waiterRBACComponent{}
+}
+
+func (comp *waiterRBACComponent) Setup(ctx *cu.Context, bldr *ctrl.Builder) error {
+	bldr.Owns(&corev1.ServiceAccount{})
+	bldr.Owns(&rbacv1.Role{})
+	bldr.Owns(&rbacv1.RoleBinding{})
+	bldr.Watches(
+		&source.Kind{Type: &corev1.Namespace{}},
+		handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+			// The namespace's default waiter mode applies to every Migrator in it.
+			requests := []reconcile.Request{}
+			migrators := &migrationsv1.MigratorList{}
+			err := ctx.Client.List(context.Background(), migrators, &client.ListOptions{Namespace: obj.GetName()})
+			if err != nil {
+				ctx.Log.Error(err, "error listing migrators", "namespace", obj.GetName())
+				return requests
+			}
+			for _, migrator := range migrators.Items {
+				requests = append(requests, reconcile.Request{
+					NamespacedName: types.NamespacedName{
+						Name:      migrator.Name,
+						Namespace: migrator.Namespace,
+					},
+				})
+			}
+			return requests
+		}),
+	)
+	return nil
+}
+
+func (comp *waiterRBACComponent) Reconcile(ctx *cu.Context) (cu.Result, error) {
+	obj := ctx.Object.(*migrationsv1.Migrator)
+
+	namespace := &corev1.Namespace{}
+	err := ctx.Client.Get(ctx, types.NamespacedName{Name: obj.Namespace}, namespace)
+	if err != nil {
+		return cu.Result{}, errors.Wrapf(err, "error getting namespace %s", obj.Namespace)
+	}
+	name := types.NamespacedName{Name: webhook.WaiterServiceAccountName(obj.Name), Namespace: obj.Namespace}
+	serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}}
+	role := &rbacv1.Role{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}}
+	binding := &rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: name.Name, Namespace: name.Namespace}}
+
+	if utils.WaiterMode(obj, namespace) != migrationsv1.WaiterModeDirect {
+		// Clean up after any earlier use of direct mode. Secrets aren't cached, so the operator doesn't have to
+		// watch every Secret in the cluster.
+		for _, rbacObj := range []client.Object{binding, role, secret, serviceAccount} {
+			c := ctx.Client
+			if rbacObj == secret {
+				c = ctx.UncachedClient
+			}
+			err = c.Get(ctx, name, rbacObj)
+			if kerrors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return cu.Result{}, errors.Wrapf(err, "error getting waiter RBAC %s", name)
+			}
+			if !metav1.IsControlledBy(rbacObj, obj) {
+				continue
+			}
+			err = c.Delete(ctx, rbacObj)
+			if err != nil && !kerrors.IsNotFound(err) {
+				return cu.Result{}, errors.Wrapf(err, "error deleting waiter RBAC %s", name)
+			}
+		}
+		return cu.Result{}, nil
+	}
+
+	_, err = controllerutil.CreateOrUpdate(ctx, ctx.Client, serviceAccount, func() error {
+		// Only the token Secret below is used, nothing should mount tokens for this ServiceAccount.
+		automount := false
+		serviceAccount.AutomountServiceAccountToken = &automount
+		return controllerutil.SetControllerReference(obj, serviceAccount, ctx.Scheme)
+	})
+	if err != nil {
+		return cu.Result{}, errors.Wrapf(err, "error updating waiter service account %s", name)
+	}
+	// The token controller fills in the Secret's token and ca.crt, which the webhook mounts into waiters. Once
+	// created it is left alone so the token isn't replaced.
+	err = ctx.UncachedClient.Get(ctx, name, secret)
+	if kerrors.IsNotFound(err) {
+		secret.Type = corev1.SecretTypeServiceAccountToken
+		secret.Annotations = map[string]string{corev1.ServiceAccountNameKey: serviceAccount.Name}
+		err = controllerutil.SetControllerReference(obj, secret, ctx.Scheme)
+		if err != nil {
+			return cu.Result{}, errors.Wrapf(err, "error setting owner of waiter token secret %s", name)
+		}
+		err = ctx.UncachedClient.Create(ctx, secret)
+	}
+	if err != nil {
+		return cu.Result{}, errors.Wrapf(err, "error creating waiter token secret %s", name)
+	}
+	if !metav1.IsControlledBy(secret, obj) {
+		return cu.Result{}, errors.Errorf("waiter token secret %s already exists and isn't owned by this Migrator", name)
+	}
+
+	_, err = controllerutil.CreateOrUpdate(ctx, ctx.Client, role, func() error {
+		role.Rules = []rbacv1.PolicyRule{
+			{
+				APIGroups:     []string{migrationsv1.GroupVersion.Group},
+				Resources:     []string{"migrators"},
+				ResourceNames: []string{obj.Name},
+				Verbs:         []string{"get", "list", "watch"},
+			},
+		}
+		return controllerutil.SetControllerReference(obj, role, ctx.Scheme)
+	})
+	if err != nil {
+		return cu.Result{}, errors.Wrapf(err, "error updating waiter role %s", name)
+	}
+	_, err = controllerutil.CreateOrUpdate(ctx, ctx.Client, binding, func() error {
+		binding.RoleRef = rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     role.Name,
+		}
+		binding.Subjects = []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      serviceAccount.Name,
+				Namespace: serviceAccount.Namespace,
+			},
+		}
+		return controllerutil.SetControllerReference(obj, binding, ctx.Scheme)
+	})
+	if err != nil {
+		return cu.Result{}, errors.Wrapf(err, "error updating waiter role binding %s", name)
+	}
+	return cu.Result{}, nil
+}
@@ -0,0 +1,138 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package components
+
+import (
+	"context"
+
+	cu "github.com/coderanger/controller-utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/utils"
+)
+
+var _ = Describe("WaiterRBAC component", func() {
+	var obj *migrationsv1.Migrator
+	var namespace *corev1.Namespace
+	var helper *cu.UnitHelper
+
+	BeforeEach(func() {
+		obj = &migrationsv1.Migrator{
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "myapp"},
+				},
+			},
+		}
+		namespace = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+		helper = suiteHelper.Setup(WaiterRBAC(), obj)
+	})
+
+	It("does nothing in API mode", func() {
+		Expect(helper.Client.Create(context.Background(), namespace)).To(Succeed())
+		helper.MustReconcile()
+		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations-waiter", Namespace: "default"}, &rbacv1.Role{})
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+
+	It("grants access to just this Migrator in direct mode", func() {
+		obj.Spec.Waiter.Mode = migrationsv1.WaiterModeDirect
+		Expect(helper.Client.Create(context.Background(), namespace)).To(Succeed())
+		helper.MustReconcile()
+
+		serviceAccount := &corev1.ServiceAccount{}
+		helper.TestClient.GetName("testing-migrations-waiter", serviceAccount)
+		Expect(serviceAccount.AutomountServiceAccountToken).ToNot(BeNil())
+		Expect(*serviceAccount.AutomountServiceAccountToken).To(BeFalse())
+		Expect(metav1.IsControlledBy(serviceAccount, obj)).To(BeTrue())
+		secret := &corev1.Secret{}
+		helper.TestClient.GetName("testing-migrations-waiter", secret)
+		Expect(secret.Type).To(Equal(corev1.SecretTypeServiceAccountToken))
+		Expect(secret.Annotations).To(HaveKeyWithValue("kubernetes.io/service-account.name", "testing-migrations-waiter"))
+		Expect(metav1.IsControlledBy(secret, obj)).To(BeTrue())
+
+		role := &rbacv1.Role{}
+		helper.TestClient.GetName("testing-migrations-waiter", role)
+		Expect(role.Rules).To(Equal([]rbacv1.PolicyRule{{
+			APIGroups:     []string{"migrations.coderanger.net"},
+			Resources:     []string{"migrators"},
+			ResourceNames: []string{"testing"},
+			Verbs:         []string{"get", "list", "watch"},
+		}}))
+		Expect(metav1.IsControlledBy(role, obj)).To(BeTrue())
+		binding := &rbacv1.RoleBinding{}
+		helper.TestClient.GetName("testing-migrations-waiter", binding)
+		Expect(binding.RoleRef.Name).To(Equal("testing-migrations-waiter"))
+		Expect(binding.Subjects).To(Equal([]rbacv1.Subject{
+			{Kind: "ServiceAccount", Name: "testing-migrations-waiter", Namespace: "default"},
+		}))
+	})
+
+	It("uses the namespace default mode", func() {
+		namespace.Annotations = map[string]string{utils.WAITER_MODE_ANNOTATION: "direct"}
+		Expect(helper.Client.Create(context.Background(), namespace)).To(Succeed())
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations-waiter", &rbacv1.Role{})
+	})
+
+	It("leaves an existing token secret alone", func() {
+		obj.Spec.Waiter.Mode = migrationsv1.WaiterModeDirect
+		Expect(helper.Client.Create(context.Background(), namespace)).To(Succeed())
+		helper.MustReconcile()
+		secret := &corev1.Secret{}
+		helper.TestClient.GetName("testing-migrations-waiter", secret)
+		secret.Data = map[string][]byte{"token": []byte("abc")}
+		helper.TestClient.Update(secret)
+
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations-waiter", secret)
+		Expect(secret.Data).To(HaveKeyWithValue("token", []byte("abc")))
+	})
+
+	It("fails if the token secret belongs to something else", func() {
+		obj.Spec.Waiter.Mode = migrationsv1.WaiterModeDirect
+		Expect(helper.Client.Create(context.Background(), namespace)).To(Succeed())
+		helper.TestClient.Create(&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "testing-migrations-waiter"}})
+		_, err := helper.Reconcile()
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("cleans up when leaving direct mode", func() {
+		obj.Spec.Waiter.Mode = migrationsv1.WaiterModeDirect
+		Expect(helper.Client.Create(context.Background(), namespace)).To(Succeed())
+		helper.MustReconcile()
+		helper.TestClient.GetName("testing-migrations-waiter", &rbacv1.RoleBinding{})
+
+		obj.Spec.Waiter.Mode = migrationsv1.WaiterModeAPI
+		helper.MustReconcile()
+		err := helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations-waiter", Namespace: "default"}, &rbacv1.Role{})
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+		err = helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations-waiter", Namespace: "default"}, &rbacv1.RoleBinding{})
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+		err = helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations-waiter", Namespace: "default"}, &corev1.Secret{})
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+		err = helper.Client.Get(context.Background(), types.NamespacedName{Name: "testing-migrations-waiter", Namespace: "default"}, &corev1.ServiceAccount{})
+		Expect(kerrors.IsNotFound(err)).To(BeTrue())
+	})
+})
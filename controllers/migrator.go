@@ -17,27 +17,50 @@ limitations under the License.
 package controllers
 
 import (
+	"os"
+
 	cu "github.com/coderanger/controller-utils"
 	"github.com/coderanger/migrations-operator/components"
+	"github.com/coderanger/migrations-operator/freeze"
+	"github.com/pkg/errors"
 	ctrl "sigs.k8s.io/controller-runtime"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 )
 
 // +kubebuilder:rbac:groups=migrations.coderanger.net,resources=migrators,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=migrations.coderanger.net,resources=migrators/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
-// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;delete
+// +kubebuilder:rbac:groups="",resources=persistentvolumeclaims,verbs=get;list;watch
 // +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
-// +kubebuilder:rbac:groups=apps,resources=replicasets;deployments;statfulsets;daemonsets,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",namespace=system,resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;create;delete
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=roles;rolebindings,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=apps,resources=replicasets;deployments;statefulsets;daemonsets,verbs=get;list;watch
 // +kubebuilder:rbac:groups=batch,resources=cronjobs,verbs=get;list;watch
 // +kubebuilder:rbac:groups=argoproj.io,resources=rollouts,verbs=get;list;watch
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
 
 func Migrator(mgr ctrl.Manager) error {
+	// The global freeze ConfigMap lives in the operator's namespace. Refuse to start without it rather than
+	// silently ignoring a freeze.
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		return errors.New("POD_NAMESPACE must be set to the operator's namespace to watch the global freeze")
+	}
+	freezer, err := freeze.NewWatcher(mgr, namespace)
+	if err != nil {
+		return err
+	}
+
 	return cu.NewReconciler(mgr).
-		For(&migrationsv1beta1.Migrator{}).
-		Component("user", components.Migrations()).
-		ReadyStatusComponent("MigrationsReady").
+		For(&migrationsv1.Migrator{}).
+		Component("waiterRBAC", components.WaiterRBAC()).
+		Component("user", components.Migrations(freezer)).
+		ReadyStatusComponent(migrationsv1.ConditionMigrationsReady).
 		// Webhook().
 		Complete()
 }
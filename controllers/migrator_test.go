@@ -28,7 +28,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 	"github.com/coderanger/migrations-operator/webhook"
 )
 
@@ -38,7 +38,8 @@ var _ = Describe("Migrator controller", func() {
 	BeforeEach(func() {
 		os.Setenv("API_HOSTNAME", "migrations-operator.migration-operator.svc")
 		os.Setenv("WAITER_IMAGE", "migrations-operator:latest")
-		helper = suiteHelper.MustStart(Migrator, webhook.InitInjector)
+		os.Setenv("POD_NAMESPACE", "default")
+		helper = suiteHelper.MustStart(Migrator, webhook.InitInjector, webhook.MigratorDefaulter, webhook.MigratorValidator)
 	})
 
 	AfterEach(func() {
@@ -49,9 +50,9 @@ var _ = Describe("Migrator controller", func() {
 	It("runs a basic reconcile", func() {
 		c := helper.TestClient
 
-		migrator := &migrationsv1beta1.Migrator{
+		migrator := &migrationsv1.Migrator{
 			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
-			Spec: migrationsv1beta1.MigratorSpec{
+			Spec: migrationsv1.MigratorSpec{
 				Selector: &metav1.LabelSelector{
 					MatchLabels: map[string]string{
 						"app": "test",
@@ -88,7 +89,7 @@ var _ = Describe("Migrator controller", func() {
 
 		// Make sure the migrator is ready.
 		c.EventuallyGetName("testing", migrator, c.EventuallyReady())
-		Expect(migrator.Status.LastSuccessfulMigration).To(Equal("myapp:v1"))
+		Expect(migrator.Status.LastSuccessfulMigration()).To(Equal("myapp:v1"))
 
 		// Make sure the job doesn't come back.
 		Consistently(func() error {
@@ -110,6 +111,6 @@ var _ = Describe("Migrator controller", func() {
 
 		// Make sure the migrator is ready, again.
 		c.EventuallyGetName("testing", migrator, c.EventuallyReady())
-		Expect(migrator.Status.LastSuccessfulMigration).To(Equal("myapp:v2"))
+		Expect(migrator.Status.LastSuccessfulMigration()).To(Equal("myapp:v2"))
 	})
 })
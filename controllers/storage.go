@@ -0,0 +1,122 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/pkg/errors"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+const MIGRATORS_CRD_NAME = "migrators.migrations.coderanger.net"
+
+// How long to wait before first retrying a failed storage version migration.
+const STORAGE_RETRY_INTERVAL = time.Second
+
+// The longest to wait between retries of a failed storage version migration.
+const MAX_STORAGE_RETRY_INTERVAL = 5 * time.Minute
+
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions/status,verbs=update
+
+// storageVersionMigrator rewrites every Migrator in the current storage version.
+type storageVersionMigrator struct {
+	client client.Client
+	reader client.Reader
+}
+
+// StorageVersionMigrator rewrites all Migrators once at startup so older API versions can be removed from
+// the CRD's stored versions.
+func StorageVersionMigrator(mgr ctrl.Manager) error {
+	return mgr.Add(&storageVersionMigrator{client: mgr.GetClient(), reader: mgr.GetAPIReader()})
+}
+
+func (m *storageVersionMigrator) Start(ctx context.Context) error {
+	log := ctrl.Log.WithName("controllers").WithName("StorageVersionMigrator")
+
+	// The operator's own conversion and validation webhooks may not be serving yet at startup, so keep
+	// trying rather than stopping the manager.
+	backoff := wait.Backoff{Duration: STORAGE_RETRY_INTERVAL, Factor: 2, Jitter: 0.1, Steps: math.MaxInt32, Cap: MAX_STORAGE_RETRY_INTERVAL}
+	for {
+		err := m.migrate(ctx)
+		if err == nil {
+			return nil
+		}
+		delay := backoff.Step()
+		log.Error(err, "error migrating stored versions, retrying", "delay", delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (m *storageVersionMigrator) migrate(ctx context.Context) error {
+	log := ctrl.Log.WithName("controllers").WithName("StorageVersionMigrator")
+
+	crd := &apiextensionsv1.CustomResourceDefinition{}
+	err := m.reader.Get(ctx, types.NamespacedName{Name: MIGRATORS_CRD_NAME}, crd)
+	if err != nil {
+		return errors.Wrapf(err, "error getting CRD %s", MIGRATORS_CRD_NAME)
+	}
+	storageVersion := migrationsv1.GroupVersion.Version
+	if len(crd.Status.StoredVersions) == 1 && crd.Status.StoredVersions[0] == storageVersion {
+		// Nothing to do.
+		return nil
+	}
+
+	// An update with no changes still re-encodes the object in the storage version.
+	migrators := &migrationsv1.MigratorList{}
+	err = m.reader.List(ctx, migrators)
+	if err != nil {
+		return errors.Wrap(err, "error listing migrators")
+	}
+	failed := 0
+	for i := range migrators.Items {
+		migrator := &migrators.Items[i]
+		err = m.client.Update(ctx, migrator)
+		if err != nil && !kerrors.IsNotFound(err) && !kerrors.IsConflict(err) {
+			// A conflict means something else already wrote a newer version, which is just as good. Keep
+			// going so one bad object doesn't hold up the rest.
+			log.Error(err, "error rewriting migrator", "migrator", fmt.Sprintf("%s/%s", migrator.Namespace, migrator.Name))
+			failed++
+		}
+	}
+	if failed != 0 {
+		return errors.Errorf("error rewriting %d of %d migrators", failed, len(migrators.Items))
+	}
+
+	log.Info("Migrated stored versions", "from", crd.Status.StoredVersions, "to", storageVersion, "count", len(migrators.Items))
+	crd.Status.StoredVersions = []string{storageVersion}
+	err = m.client.Status().Update(ctx, crd)
+	if err != nil {
+		return errors.Wrapf(err, "error updating stored versions for CRD %s", MIGRATORS_CRD_NAME)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+var _ = Describe("StorageVersionMigrator", func() {
+	var objs []runtime.Object
+
+	BeforeEach(func() {
+		objs = []runtime.Object{
+			&migrationsv1.Migrator{ObjectMeta: metav1.ObjectMeta{Name: "testing", Namespace: "default"}},
+		}
+	})
+
+	build := func() (*storageVersionMigrator, func() *apiextensionsv1.CustomResourceDefinition) {
+		scheme := runtime.NewScheme()
+		Expect(migrationsv1.AddToScheme(scheme)).To(Succeed())
+		Expect(apiextensionsv1.AddToScheme(scheme)).To(Succeed())
+		c := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build()
+		getCRD := func() *apiextensionsv1.CustomResourceDefinition {
+			crd := &apiextensionsv1.CustomResourceDefinition{}
+			Expect(c.Get(context.Background(), types.NamespacedName{Name: MIGRATORS_CRD_NAME}, crd)).To(Succeed())
+			return crd
+		}
+		return &storageVersionMigrator{client: c, reader: c}, getCRD
+	}
+
+	It("rewrites Migrators and drops old stored versions", func() {
+		objs = append(objs, &apiextensionsv1.CustomResourceDefinition{
+			ObjectMeta: metav1.ObjectMeta{Name: MIGRATORS_CRD_NAME},
+			Status:     apiextensionsv1.CustomResourceDefinitionStatus{StoredVersions: []string{"v1beta1", "v1"}},
+		})
+		m, getCRD := build()
+		Expect(m.Start(context.Background())).To(Succeed())
+		Expect(getCRD().Status.StoredVersions).To(Equal([]string{"v1"}))
+	})
+
+	It("keeps retrying instead of stopping the manager", func() {
+		// No CRD, so every attempt fails.
+		m, _ := build()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		Expect(m.Start(ctx)).To(Succeed())
+		Expect(ctx.Err()).To(HaveOccurred())
+	})
+})
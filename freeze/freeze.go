@@ -0,0 +1,163 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package freeze
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+)
+
+// The well-known ConfigMap, in the operator's namespace, which freezes all migrations in the cluster.
+const FREEZE_CONFIGMAP_NAME = "migrations-freeze"
+
+// Keys in the freeze ConfigMap. frozenBy and reason are whatever the writer put there, nothing checks them.
+const (
+	FROZEN_KEY    = "frozen"
+	FROZEN_BY_KEY = "frozenBy"
+	REASON_KEY    = "reason"
+)
+
+var (
+	frozenGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "migrations_operator_frozen",
+		Help: "Whether all migrations are frozen by the global kill switch.",
+	})
+	frozenInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "migrations_operator_frozen_info",
+		Help: "Who set the global migration freeze and why, while it is set.",
+	}, []string{"frozen_by", "reason"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(frozenGauge, frozenInfo)
+}
+
+// Status is the state of the global freeze.
+type Status struct {
+	Frozen bool
+	// By is who the ConfigMap says set the freeze, unverified.
+	By     string
+	Reason string
+}
+
+// Freezer reports the global freeze.
+type Freezer interface {
+	// Status returns the current state of the freeze.
+	Status(ctx context.Context) (Status, error)
+	// Source emits an event whenever the freeze may have changed.
+	Source() source.Source
+}
+
+type watcher struct {
+	cache     cache.Cache
+	namespace string
+}
+
+// NewWatcher creates a Freezer which watches the freeze ConfigMap in the given namespace. It uses its own
+// cache so only that one ConfigMap is watched.
+func NewWatcher(mgr ctrl.Manager, namespace string) (Freezer, error) {
+	c, err := cache.New(mgr.GetConfig(), cache.Options{
+		Scheme:    mgr.GetScheme(),
+		Mapper:    mgr.GetRESTMapper(),
+		Namespace: namespace,
+		SelectorsByObject: cache.SelectorsByObject{
+			&corev1.ConfigMap{}: {Field: fields.OneTermEqualSelector("metadata.name", FREEZE_CONFIGMAP_NAME)},
+		},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating freeze cache")
+	}
+	err = mgr.Add(c)
+	if err != nil {
+		return nil, errors.Wrap(err, "error adding freeze cache")
+	}
+
+	// Keep the metrics and logs up to date as the freeze changes.
+	informer, err := c.GetInformer(context.Background(), &corev1.ConfigMap{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting freeze informer")
+	}
+	log := ctrl.Log.WithName("freeze")
+	update := func(obj interface{}) {
+		cm, _ := obj.(*corev1.ConfigMap)
+		status := StatusFromConfigMap(cm)
+		frozenInfo.Reset()
+		if status.Frozen {
+			frozenGauge.Set(1)
+			frozenInfo.WithLabelValues(status.By, status.Reason).Set(1)
+			log.Info("All migrations frozen", "frozenBy", status.By, "reason", status.Reason)
+		} else {
+			frozenGauge.Set(0)
+			log.Info("Migrations not frozen")
+		}
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj interface{}) { update(obj) },
+		DeleteFunc: func(_ interface{}) { update(nil) },
+	})
+
+	return &watcher{cache: c, namespace: namespace}, nil
+}
+
+func (w *watcher) Status(ctx context.Context) (Status, error) {
+	cm := &corev1.ConfigMap{}
+	err := w.cache.Get(ctx, types.NamespacedName{Name: FREEZE_CONFIGMAP_NAME, Namespace: w.namespace}, cm)
+	if err != nil {
+		if kerrors.IsNotFound(err) {
+			return Status{}, nil
+		}
+		return Status{}, errors.Wrapf(err, "error getting freeze ConfigMap %s/%s", w.namespace, FREEZE_CONFIGMAP_NAME)
+	}
+	return StatusFromConfigMap(cm), nil
+}
+
+func (w *watcher) Source() source.Source {
+	return source.NewKindWithCache(&corev1.ConfigMap{}, w.cache)
+}
+
+// StatusFromConfigMap parses a freeze ConfigMap. A missing ConfigMap, or one without frozen set to true, is
+// not frozen.
+func StatusFromConfigMap(cm *corev1.ConfigMap) Status {
+	if cm == nil {
+		return Status{}
+	}
+	frozen, err := strconv.ParseBool(cm.Data[FROZEN_KEY])
+	if err != nil || !frozen {
+		return Status{}
+	}
+	status := Status{Frozen: true, By: cm.Data[FROZEN_BY_KEY], Reason: cm.Data[REASON_KEY]}
+	if status.By == "" {
+		status.By = "unknown"
+	}
+	if status.Reason == "" {
+		status.Reason = "no reason given"
+	}
+	return status
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package freeze
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+)
+
+var _ = Describe("StatusFromConfigMap", func() {
+	It("is not frozen without a ConfigMap", func() {
+		Expect(StatusFromConfigMap(nil)).To(Equal(Status{}))
+	})
+
+	It("is not frozen without the frozen key", func() {
+		cm := &corev1.ConfigMap{Data: map[string]string{"reason": "testing"}}
+		Expect(StatusFromConfigMap(cm)).To(Equal(Status{}))
+	})
+
+	It("is not frozen with an invalid value", func() {
+		cm := &corev1.ConfigMap{Data: map[string]string{"frozen": "maybe"}}
+		Expect(StatusFromConfigMap(cm)).To(Equal(Status{}))
+	})
+
+	It("is not frozen when set to false", func() {
+		cm := &corev1.ConfigMap{Data: map[string]string{"frozen": "false", "frozenBy": "alice"}}
+		Expect(StatusFromConfigMap(cm)).To(Equal(Status{}))
+	})
+
+	It("records who froze migrations and why", func() {
+		cm := &corev1.ConfigMap{Data: map[string]string{"frozen": "true", "frozenBy": "alice", "reason": "database maintenance"}}
+		Expect(StatusFromConfigMap(cm)).To(Equal(Status{Frozen: true, By: "alice", Reason: "database maintenance"}))
+	})
+
+	It("fills in defaults for who and why", func() {
+		cm := &corev1.ConfigMap{Data: map[string]string{"frozen": "1"}}
+		Expect(StatusFromConfigMap(cm)).To(Equal(Status{Frozen: true, By: "unknown", Reason: "no reason given"}))
+	})
+})
@@ -0,0 +1,314 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/coderanger/migrations-operator/webhook"
+)
+
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+// +kubebuilder:rbac:groups="",resources=pods/log,verbs=get
+
+// How long a successful token review is reused for, so polling waiters don't each cause a TokenReview.
+const TOKEN_CACHE_TTL = time.Minute
+
+const serviceAccountPrefix = "system:serviceaccount:"
+
+// Extra user info the TokenReview of a projected ServiceAccount token has about the pod it is bound to.
+const (
+	POD_NAME_EXTRA = "authentication.kubernetes.io/pod-name"
+	POD_UID_EXTRA  = "authentication.kubernetes.io/pod-uid"
+)
+
+// AuthMode controls whether API requests must carry a token.
+type AuthMode string
+
+const (
+	// AuthModeRequired rejects requests without a valid token.
+	AuthModeRequired AuthMode = "required"
+	// AuthModeOptional checks tokens when they are sent but allows requests without one, for upgrading
+	// from versions which didn't send tokens.
+	AuthModeOptional AuthMode = "optional"
+	// AuthModeDisabled ignores tokens.
+	AuthModeDisabled AuthMode = "disabled"
+)
+
+// authError is an authentication or authorization failure, with the HTTP status code to return.
+type authError struct {
+	code int
+	msg  string
+}
+
+func (e *authError) Error() string {
+	return e.msg
+}
+
+type cachedUser struct {
+	user    authenticationv1.UserInfo
+	expires time.Time
+}
+
+// authenticator checks bearer tokens with TokenReviews and authorizes access to Migrators by namespace.
+type authenticator struct {
+	client client.Client
+	mode   AuthMode
+
+	mu    sync.Mutex
+	users map[[sha256.Size]byte]cachedUser
+}
+
+func newAuthenticator(c client.Client, mode AuthMode) (*authenticator, error) {
+	switch mode {
+	case "":
+		mode = AuthModeRequired
+	case AuthModeRequired, AuthModeOptional, AuthModeDisabled:
+	default:
+		return nil, errors.Errorf("unknown API auth mode %q", mode)
+	}
+	return &authenticator{client: c, mode: mode, users: map[[sha256.Size]byte]cachedUser{}}, nil
+}
+
+// authorizeReady checks that the request may ask whether Migrators in the given namespace are ready. Only tokens
+// for the operator's audience, as mounted into waiters, are accepted. A ServiceAccount token can ask about
+// Migrators in its own namespace, so waiters need no extra RBAC, anyone else needs RBAC permission to get them.
+func (a *authenticator) authorizeReady(r *http.Request, namespace string) error {
+	return a.authorizeRequest(r, migratorAttributes(namespace, "get"), true)
+}
+
+// authorizeLogs checks that the request may read a Migrator's migration logs. Waiters can follow the logs of the
+// Migrator they are waiting on, anyone else needs RBAC permission to get pod logs in the namespace. Logs can
+// hold anything the migration prints, so unlike the ready API, ServiceAccounts aren't trusted just for being in
+// the namespace, and the optional mode meant for upgrading old waiters still needs a token.
+func (a *authenticator) authorizeLogs(r *http.Request, namespace, migrator string) error {
+	if a != nil && a.mode == AuthModeOptional && bearerToken(r) == "" {
+		return &authError{code: http.StatusUnauthorized, msg: "missing bearer token"}
+	}
+	if a.isWaiterFor(r, namespace, migrator) {
+		return nil
+	}
+	return a.authorizeResource(r, &authorizationv1.ResourceAttributes{
+		Namespace:   namespace,
+		Verb:        "get",
+		Resource:    "pods",
+		Subresource: "log",
+	})
+}
+
+// isWaiterFor checks if the request's token was mounted into a pod which has a waiter for the given Migrator.
+// The TokenReview of a projected token says which pod it is bound to.
+func (a *authenticator) isWaiterFor(r *http.Request, namespace, migrator string) bool {
+	token := bearerToken(r)
+	if a == nil || token == "" {
+		return false
+	}
+	user, err := a.review(r.Context(), token, webhook.WAITER_TOKEN_AUDIENCE)
+	if err != nil {
+		return false
+	}
+	saNamespace, _, ok := splitServiceAccount(user.Username)
+	podName, podUID := user.Extra[POD_NAME_EXTRA], user.Extra[POD_UID_EXTRA]
+	if !ok || saNamespace != namespace || len(podName) != 1 || len(podUID) != 1 {
+		return false
+	}
+	pod := &corev1.Pod{}
+	err = a.client.Get(r.Context(), types.NamespacedName{Name: podName[0], Namespace: namespace}, pod)
+	if err != nil || string(pod.UID) != podUID[0] {
+		return false
+	}
+	injected, _ := webhook.WaiterStatus(pod, migrator)
+	return injected
+}
+
+// authorizeResource checks that the request has RBAC permission for the given resource attributes. Tokens for
+// either the operator's audience or the Kubernetes API's, such as from kubectl create token, are accepted.
+func (a *authenticator) authorizeResource(r *http.Request, attrs *authorizationv1.ResourceAttributes) error {
+	return a.authorizeRequest(r, attrs, false)
+}
+
+// authorizeRequest checks a request's token and RBAC permission. Waiter endpoints only accept the operator's
+// audience and trust ServiceAccounts in the namespace.
+func (a *authenticator) authorizeRequest(r *http.Request, attrs *authorizationv1.ResourceAttributes, waiterEndpoint bool) error {
+	if a == nil || a.mode == AuthModeDisabled {
+		return nil
+	}
+	token := bearerToken(r)
+	if token == "" {
+		if a.mode == AuthModeOptional {
+			return nil
+		}
+		return &authError{code: http.StatusUnauthorized, msg: "missing bearer token"}
+	}
+	user, err := a.authenticate(r.Context(), token, !waiterEndpoint)
+	if err != nil {
+		return err
+	}
+
+	if waiterEndpoint {
+		saNamespace, _, ok := splitServiceAccount(user.Username)
+		if ok && saNamespace == attrs.Namespace {
+			return nil
+		}
+	}
+	allowed, reason, err := a.canAccess(r.Context(), user, attrs)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		resource := attrs.Resource
+		if attrs.Subresource != "" {
+			resource += "/" + attrs.Subresource
+		}
+		msg := fmt.Sprintf("%s cannot %s %s in namespace %s", user.Username, attrs.Verb, resource, attrs.Namespace)
+		if reason != "" {
+			msg += ": " + reason
+		}
+		return &authError{code: http.StatusForbidden, msg: msg}
+	}
+	return nil
+}
+
+// authorizeStrictly checks that the request authenticated as a user with RBAC permission for the given resource
+// attributes. Unlike authorizeResource it ignores the auth mode, for things which must never be shown to
+// requests without a token.
+func (a *authenticator) authorizeStrictly(r *http.Request, attrs *authorizationv1.ResourceAttributes) bool {
+	token := bearerToken(r)
+	if a == nil || token == "" {
+		return false
+	}
+	user, err := a.authenticate(r.Context(), token, true)
+	if err != nil {
+		return false
+	}
+	allowed, _, err := a.canAccess(r.Context(), user, attrs)
+	return err == nil && allowed
+}
+
+// authenticate checks a token meant for the operator's API, or with kubeAudience also one meant for the
+// Kubernetes API.
+func (a *authenticator) authenticate(ctx context.Context, token string, kubeAudience bool) (*authenticationv1.UserInfo, error) {
+	user, err := a.review(ctx, token, webhook.WAITER_TOKEN_AUDIENCE)
+	if _, ok := err.(*authError); ok && kubeAudience {
+		// No audience reviews it for the Kubernetes API server's own audiences.
+		return a.review(ctx, token, "")
+	}
+	return user, err
+}
+
+// review runs a TokenReview for a token and audience, reusing recent results.
+func (a *authenticator) review(ctx context.Context, token, audience string) (*authenticationv1.UserInfo, error) {
+	key := tokenCacheKey(token, audience)
+	now := time.Now()
+	a.mu.Lock()
+	cached, ok := a.users[key]
+	a.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return &cached.user, nil
+	}
+
+	review := &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{
+			Token: token,
+		},
+	}
+	if audience != "" {
+		review.Spec.Audiences = []string{audience}
+	}
+	err := a.client.Create(ctx, review)
+	if err != nil {
+		return nil, errors.Wrap(err, "error creating TokenReview")
+	}
+	if !review.Status.Authenticated {
+		msg := "invalid bearer token"
+		if review.Status.Error != "" {
+			msg += ": " + review.Status.Error
+		}
+		return nil, &authError{code: http.StatusUnauthorized, msg: msg}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for k, v := range a.users {
+		if now.After(v.expires) {
+			delete(a.users, k)
+		}
+	}
+	a.users[key] = cachedUser{user: review.Status.User, expires: now.Add(TOKEN_CACHE_TTL)}
+	return &review.Status.User, nil
+}
+
+// tokenCacheKey is the key for a token reviewed for an audience, hashed so tokens aren't kept in memory.
+func tokenCacheKey(token, audience string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(audience + "\x00" + token))
+}
+
+// canAccess runs a SubjectAccessReview for a user.
+func (a *authenticator) canAccess(ctx context.Context, user *authenticationv1.UserInfo, attrs *authorizationv1.ResourceAttributes) (bool, string, error) {
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user.Username,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+			ResourceAttributes: attrs,
+		},
+	}
+	err := a.client.Create(ctx, sar)
+	if err != nil {
+		return false, "", errors.Wrap(err, "error creating SubjectAccessReview")
+	}
+	return sar.Status.Allowed, sar.Status.Reason, nil
+}
+
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// splitServiceAccount splits a ServiceAccount username into its namespace and name.
+func splitServiceAccount(username string) (string, string, bool) {
+	if !strings.HasPrefix(username, serviceAccountPrefix) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(username, serviceAccountPrefix), ":")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"time"
+
+	cu "github.com/coderanger/controller-utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/webhook"
+)
+
+var _ = Describe("API authentication", func() {
+	var helper *cu.FunctionalHelper
+
+	BeforeEach(func() {
+		os.Setenv("API_AUTH", string(AuthModeRequired))
+		helper = suiteHelper.MustStart(APIServer)
+		helper.TestClient.Create(&migrationsv1.Migrator{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "testing"}},
+			},
+		})
+	})
+
+	AfterEach(func() {
+		helper.MustStop()
+		helper = nil
+		os.Setenv("API_AUTH", string(AuthModeDisabled))
+	})
+
+	post := func(path, token string) int {
+		args := &ReadyArgs{TargetImage: "myapp:latest", MigratorNamespace: helper.Namespace, MigratorName: "testing"}
+		data, err := json.Marshal(args)
+		Expect(err).ToNot(HaveOccurred())
+		req, err := http.NewRequest(http.MethodPost, url+path, bytes.NewBuffer(data))
+		Expect(err).ToNot(HaveOccurred())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	It("rejects requests without a token", func() {
+		Expect(post("api/v1/ready", "")).To(Equal(401))
+		Expect(post("api/ready", "")).To(Equal(401))
+	})
+
+	It("rejects requests with an invalid token", func() {
+		Expect(post("api/v1/ready", "not-a-token")).To(Equal(401))
+		Expect(post("api/ready", "not-a-token")).To(Equal(401))
+	})
+
+	It("rejects REST API requests without a token", func() {
+		resp, err := http.Get(url + "api/v1/namespaces/" + helper.Namespace + "/migrators")
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(401))
+	})
+
+	It("rejects log requests without a token", func() {
+		resp, err := http.Get(url + "api/v1/logs?namespace=" + helper.Namespace + "&migrator=testing")
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(401))
+	})
+
+	It("rejects dashboard requests without a token but serves the page", func() {
+		resp, err := http.Get(url + "dashboard/api/overview")
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(401))
+
+		resp, err = http.Get(url + "dashboard/")
+		Expect(err).ToNot(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(200))
+	})
+})
+
+// reviewClient answers every TokenReview as not authenticated, and every SubjectAccessReview the same way.
+type reviewClient struct {
+	client.Client
+	allowed bool
+}
+
+func (c *reviewClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	if _, ok := obj.(*authenticationv1.TokenReview); ok {
+		return nil
+	}
+	if sar, ok := obj.(*authorizationv1.SubjectAccessReview); ok {
+		sar.Status.Allowed = c.allowed
+		if !c.allowed {
+			sar.Status.Reason = "denied"
+		}
+		return nil
+	}
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+// newTestAuthenticator creates an authenticator which knows the token "sa-token" belongs to a ServiceAccount
+// in the default namespace for the operator's audience, bound to the pod web-1, and "kube-token" belongs to a
+// user for the Kubernetes API's, without needing real TokenReviews.
+func newTestAuthenticator(mode AuthMode, allowed bool, objs ...client.Object) *authenticator {
+	auth, err := newAuthenticator(&reviewClient{Client: fake.NewClientBuilder().WithObjects(objs...).Build(), allowed: allowed}, mode)
+	Expect(err).ToNot(HaveOccurred())
+	auth.users[tokenCacheKey("sa-token", webhook.WAITER_TOKEN_AUDIENCE)] = cachedUser{
+		user: authenticationv1.UserInfo{
+			Username: "system:serviceaccount:default:myapp",
+			Extra: map[string]authenticationv1.ExtraValue{
+				POD_NAME_EXTRA: {"web-1"},
+				POD_UID_EXTRA:  {"uid-1"},
+			},
+		},
+		expires: time.Now().Add(time.Minute),
+	}
+	auth.users[tokenCacheKey("kube-token", "")] = cachedUser{
+		user:    authenticationv1.UserInfo{Username: "alice"},
+		expires: time.Now().Add(time.Minute),
+	}
+	return auth
+}
+
+var _ = Describe("authenticator", func() {
+	var auth *authenticator
+	var req *http.Request
+
+	BeforeEach(func() {
+		auth = newTestAuthenticator(AuthModeRequired, false)
+		req, _ = http.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer sa-token")
+	})
+
+	It("lets a ServiceAccount use the ready API in its own namespace", func() {
+		Expect(auth.authorizeReady(req, "default")).To(Succeed())
+	})
+
+	It("requires a token unless the mode is optional", func() {
+		req.Header.Del("Authorization")
+		err := auth.authorizeReady(req, "default")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*authError).code).To(Equal(http.StatusUnauthorized))
+
+		auth = newTestAuthenticator(AuthModeOptional, false)
+		Expect(auth.authorizeReady(req, "default")).To(Succeed())
+		err = auth.authorizeLogs(req, "default", "testing")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*authError).code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("only accepts the operator's audience on the ready API", func() {
+		auth = newTestAuthenticator(AuthModeRequired, true)
+		req.Header.Set("Authorization", "Bearer kube-token")
+		err := auth.authorizeReady(req, "default")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*authError).code).To(Equal(http.StatusUnauthorized))
+	})
+
+	It("accepts the Kubernetes API's audience elsewhere", func() {
+		auth = newTestAuthenticator(AuthModeRequired, true)
+		req.Header.Set("Authorization", "Bearer kube-token")
+		Expect(auth.authorizeResource(req, migratorAttributes("", "list"))).To(Succeed())
+		Expect(auth.authorizeLogs(req, "default", "testing")).To(Succeed())
+		Expect(auth.authorizeStrictly(req, podAttributes("default", "get"))).To(BeTrue())
+	})
+
+	It("checks RBAC for a ServiceAccount in another namespace", func() {
+		err := auth.authorizeReady(req, "other")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*authError).code).To(Equal(http.StatusForbidden))
+	})
+
+	It("checks RBAC for a ServiceAccount reading logs in its own namespace", func() {
+		err := auth.authorizeLogs(req, "default", "testing")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*authError).code).To(Equal(http.StatusForbidden))
+	})
+
+	It("lets a waiter read its own Migrator's logs", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default", UID: "uid-1"},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: webhook.WAITER_PREFIX + "testing", Image: "waiter"}},
+				Containers:     []corev1.Container{{Name: "main", Image: "myapp"}},
+			},
+		}
+		auth = newTestAuthenticator(AuthModeRequired, false, pod)
+		Expect(auth.authorizeLogs(req, "default", "testing")).To(Succeed())
+
+		err := auth.authorizeLogs(req, "default", "other")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*authError).code).To(Equal(http.StatusForbidden))
+	})
+
+	It("doesn't treat a replaced pod with the same name as a waiter", func() {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default", UID: "uid-2"},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: webhook.WAITER_PREFIX + "testing", Image: "waiter"}},
+				Containers:     []corev1.Container{{Name: "main", Image: "myapp"}},
+			},
+		}
+		auth = newTestAuthenticator(AuthModeRequired, false, pod)
+		err := auth.authorizeLogs(req, "default", "testing")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*authError).code).To(Equal(http.StatusForbidden))
+	})
+
+	It("requires a token to authorize strictly whatever the mode", func() {
+		auth = newTestAuthenticator(AuthModeDisabled, true)
+		Expect(auth.authorizeStrictly(req, podAttributes("default", "get"))).To(BeTrue())
+		req.Header.Del("Authorization")
+		Expect(auth.authorizeStrictly(req, podAttributes("default", "get"))).To(BeFalse())
+	})
+})
+
+var _ = Describe("splitServiceAccount", func() {
+	It("splits a ServiceAccount username", func() {
+		namespace, name, ok := splitServiceAccount("system:serviceaccount:default:myapp")
+		Expect(ok).To(BeTrue())
+		Expect(namespace).To(Equal("default"))
+		Expect(name).To(Equal("myapp"))
+	})
+
+	It("rejects other usernames", func() {
+		_, _, ok := splitServiceAccount("alice")
+		Expect(ok).To(BeFalse())
+		_, _, ok = splitServiceAccount("system:serviceaccount:default")
+		Expect(ok).To(BeFalse())
+	})
+})
+
+var _ = Describe("bearerToken", func() {
+	It("reads the token from the Authorization header", func() {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer abc123")
+		Expect(bearerToken(req)).To(Equal("abc123"))
+	})
+
+	It("ignores other schemes", func() {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Basic abc123")
+		Expect(bearerToken(req)).To(Equal(""))
+	})
+})
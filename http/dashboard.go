@@ -0,0 +1,253 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/utils"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// The most log lines shown for a failed migration.
+const FAILURE_LOG_LINES = 20
+
+// The most bytes of logs shown for a failed migration, in case of very long lines.
+const FAILURE_LOG_BYTES = 16 * 1024
+
+// The most failure logs kept in memory. Logs of finished pods never change, so they are cached until this
+// fills up.
+const FAILURE_LOG_CACHE_SIZE = 100
+
+// The longest a dashboard request can wait for a change.
+const MAX_DASHBOARD_WAIT = time.Minute
+
+// DashboardOverview is everything shown on the dashboard.
+type DashboardOverview struct {
+	APIVersion string `json:"apiVersion"`
+	// Generation goes up each time any Migrator changes, pass it back as since to wait for the next change.
+	Generation uint64              `json:"generation"`
+	Migrators  []DashboardMigrator `json:"migrators"`
+}
+
+// DashboardMigrator is one Migrator on the dashboard.
+type DashboardMigrator struct {
+	MigratorSummary
+	History []migrationsv1.MigrationRecord `json:"history"`
+	Blocked []BlockedPod                   `json:"blocked"`
+	// Failure is the end of the logs from the newest migration, if it failed.
+	Failure *FailureLogs `json:"failure,omitempty"`
+}
+
+// FailureLogs is the end of the logs from a failed migration Job.
+type FailureLogs struct {
+	JobName string `json:"jobName"`
+	Image   string `json:"image"`
+	Pod     string `json:"pod,omitempty"`
+	Logs    string `json:"logs,omitempty"`
+	// Message says why there are no logs, if there aren't any.
+	Message string `json:"message,omitempty"`
+}
+
+// dashboardHandler serves the dashboard's data. The page itself is static and polls this.
+type dashboardHandler struct {
+	client    client.Client
+	clientset kubernetes.Interface
+	watcher   *migratorWatcher
+	auth      *authenticator
+
+	mu       sync.Mutex
+	logCache map[types.UID]string
+}
+
+// DashboardFiles returns the static files for the dashboard page.
+func DashboardFiles() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		// Only possible if the embed directive is broken.
+		panic(err)
+	}
+	return http.StripPrefix("/dashboard/", http.FileServer(http.FS(files)))
+}
+
+func (h *dashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.handle(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// handle builds the overview. With a since generation and a wait in seconds, it waits until something has
+// changed since then, the same way the ready API long-polls.
+func (h *dashboardHandler) handle(r *http.Request) (*DashboardOverview, error) {
+	err := h.auth.authorizeResource(r, migratorAttributes("", "list"))
+	if err != nil {
+		return nil, err
+	}
+	// Logs can hold anything a migration prints, so they are only included for requests with a token allowed to
+	// read them, even when the dashboard itself is open to everyone.
+	withLogs := h.auth.authorizeStrictly(r, &authorizationv1.ResourceAttributes{Verb: "get", Resource: "pods", Subresource: "log"})
+
+	query := r.URL.Query()
+	if query.Get("since") != "" && h.watcher != nil {
+		since, err := strconv.ParseUint(query.Get("since"), 10, 64)
+		if err != nil {
+			return nil, badRequestError{errors.Wrap(err, "error parsing since")}
+		}
+		wait, err := strconv.Atoi(query.Get("wait"))
+		if err != nil {
+			return nil, badRequestError{errors.Wrap(err, "error parsing wait")}
+		}
+		waitDuration := time.Duration(wait) * time.Second
+		if waitDuration > MAX_DASHBOARD_WAIT {
+			waitDuration = MAX_DASHBOARD_WAIT
+		}
+		timer := time.NewTimer(waitDuration)
+		defer timer.Stop()
+		for {
+			changed, generation := h.watcher.anyChanged()
+			if generation != since {
+				break
+			}
+			select {
+			case <-changed:
+			case <-timer.C:
+				return h.overview(r.Context(), withLogs)
+			case <-r.Context().Done():
+				return nil, r.Context().Err()
+			}
+		}
+	}
+	return h.overview(r.Context(), withLogs)
+}
+
+// overview gathers the state of every Migrator.
+func (h *dashboardHandler) overview(ctx context.Context, withLogs bool) (*DashboardOverview, error) {
+	resp := &DashboardOverview{APIVersion: READY_API_VERSION, Migrators: []DashboardMigrator{}}
+	if h.watcher != nil {
+		// Read the generation first, so a change while building the overview is seen next time.
+		_, resp.Generation = h.watcher.anyChanged()
+	}
+	summaries, err := ListMigrators(ctx, h.client, "")
+	if err != nil {
+		return nil, err
+	}
+	pods := map[string][]corev1.Pod{}
+	for _, summary := range summaries {
+		migrator, err := getMigrator(ctx, h.client, summary.Namespace, summary.Name)
+		if _, ok := err.(notFoundError); ok {
+			// Deleted since it was listed.
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		namespacePods, ok := pods[migrator.Namespace]
+		if !ok {
+			podList := &corev1.PodList{}
+			err = h.client.List(ctx, podList, client.InNamespace(migrator.Namespace))
+			if err != nil {
+				return nil, errors.Wrapf(err, "error listing pods in namespace %s", migrator.Namespace)
+			}
+			namespacePods = podList.Items
+			pods[migrator.Namespace] = namespacePods
+		}
+		item := DashboardMigrator{
+			MigratorSummary: summary,
+			History:         migrator.Status.History,
+			Blocked:         blockedPods(migrator, namespacePods),
+		}
+		if item.History == nil {
+			item.History = []migrationsv1.MigrationRecord{}
+		}
+		if len(migrator.Status.History) != 0 && migrator.Status.History[0].Result == migrationsv1.MigrationResultFailed {
+			item.Failure = h.failureLogs(ctx, &migrator.Status.History[0], namespacePods, withLogs)
+		}
+		resp.Migrators = append(resp.Migrators, item)
+	}
+	return resp, nil
+}
+
+// failureLogs gets the end of the logs for a failed migration, if its pod is still around.
+func (h *dashboardHandler) failureLogs(ctx context.Context, record *migrationsv1.MigrationRecord, pods []corev1.Pod, withLogs bool) *FailureLogs {
+	failure := &FailureLogs{JobName: record.JobName, Image: record.Image}
+	// Job names are reused, so look for the newest pod of the Job which failed.
+	var pod *corev1.Pod
+	for i := range pods {
+		p := &pods[i]
+		if p.Labels["job-name"] != record.JobName || p.Status.Phase != corev1.PodFailed {
+			continue
+		}
+		if pod == nil || pod.CreationTimestamp.Before(&p.CreationTimestamp) {
+			pod = p
+		}
+	}
+	if pod == nil {
+		failure.Message = "The failed migration pod no longer exists"
+		return failure
+	}
+	failure.Pod = pod.Name
+	if !withLogs || h.clientset == nil {
+		failure.Message = "Sign in with a token allowed to get pods/log to see the logs"
+		return failure
+	}
+
+	h.mu.Lock()
+	logs, ok := h.logCache[pod.UID]
+	h.mu.Unlock()
+	if !ok {
+		tailLines := int64(FAILURE_LOG_LINES)
+		limitBytes := int64(FAILURE_LOG_BYTES)
+		raw, err := h.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+			Container:  utils.MIGRATION_CONTAINER,
+			TailLines:  &tailLines,
+			LimitBytes: &limitBytes,
+		}).DoRaw(ctx)
+		if err != nil {
+			// Not cached, so it's tried again next time.
+			failure.Message = errors.Wrapf(err, "error getting logs for %s/%s", pod.Namespace, pod.Name).Error()
+			return failure
+		}
+		logs = string(raw)
+		h.mu.Lock()
+		if h.logCache == nil || len(h.logCache) >= FAILURE_LOG_CACHE_SIZE {
+			h.logCache = map[types.UID]string{}
+		}
+		h.logCache[pod.UID] = logs
+		h.mu.Unlock()
+	}
+	failure.Logs = logs
+	return failure
+}
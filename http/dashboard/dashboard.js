@@ -0,0 +1,207 @@
+// Migrations dashboard. Long-polls the overview and redraws whenever a Migrator changes. Everything from
+// the cluster is inserted as text, never as HTML.
+(function () {
+  "use strict";
+
+  const TOKEN_KEY = "migrationsDashboardToken";
+  const WAIT_SECONDS = 30;
+  const RETRY_MS = 5000;
+
+  let overview = null;
+  let polling = false;
+  // Which Migrators are expanded, kept across redraws.
+  const open = new Set();
+
+  function el(tag, attrs, ...children) {
+    const node = document.createElement(tag);
+    for (const [key, value] of Object.entries(attrs || {})) {
+      if (key === "className") {
+        node.className = value;
+      } else {
+        node.setAttribute(key, value);
+      }
+    }
+    for (const child of children) {
+      if (child === null || child === undefined) {
+        continue;
+      }
+      node.append(child instanceof Node ? child : String(child));
+    }
+    return node;
+  }
+
+  function ago(timestamp) {
+    if (!timestamp) {
+      return "";
+    }
+    const seconds = Math.max(0, Math.round((Date.now() - new Date(timestamp).getTime()) / 1000));
+    if (seconds < 60) {
+      return seconds + "s ago";
+    }
+    if (seconds < 3600) {
+      return Math.round(seconds / 60) + "m ago";
+    }
+    if (seconds < 86400) {
+      return Math.round(seconds / 3600) + "h ago";
+    }
+    return Math.round(seconds / 86400) + "d ago";
+  }
+
+  function duration(start, end) {
+    if (!start || !end) {
+      return "";
+    }
+    const seconds = Math.round((new Date(end).getTime() - new Date(start).getTime()) / 1000);
+    return seconds < 60 ? seconds + "s" : Math.floor(seconds / 60) + "m" + (seconds % 60) + "s";
+  }
+
+  function setStatus(text, error) {
+    const status = document.getElementById("status");
+    status.textContent = text;
+    status.classList.toggle("error", !!error);
+  }
+
+  function renderMigrator(m) {
+    const key = m.namespace + "/" + m.name;
+    const details = el("details", { className: "migrator" },
+      el("summary", {},
+        el("span", { className: "state " + m.state }, m.state),
+        el("span", { className: "name" }, key),
+        el("span", { className: "message" }, m.message || "")));
+    details.open = open.has(key);
+    details.addEventListener("toggle", () => {
+      if (details.open) {
+        open.add(key);
+      } else {
+        open.delete(key);
+      }
+    });
+
+    const body = el("div", { className: "body" });
+    body.append(el("dl", {},
+      el("dt", {}, "Target"), el("dd", {}, m.target || "-"),
+      el("dt", {}, "Running job"), el("dd", {}, m.currentJob || "-"),
+      el("dt", {}, "Last attempt"), el("dd", {}, ago(m.lastAttemptTime) || "-"),
+      el("dt", {}, "Last success"),
+      el("dd", {}, m.lastSuccess ? m.lastSuccess.image + " " + ago(m.lastSuccess.completionTime) : "-"),
+      el("dt", {}, "Blocked pods"), el("dd", {}, m.blocked.length)));
+
+    if (m.blocked.length) {
+      body.append(el("h3", {}, "Blocked pods"));
+      const rows = m.blocked.map((p) => el("tr", {},
+        el("td", {}, p.name),
+        el("td", {}, p.targetImage),
+        el("td", {}, p.state),
+        el("td", {}, ago(p.creationTimestamp)),
+        el("td", {}, p.waiterRestarts ? p.waiterRestarts + " restarts: " + (p.waiterMessage || "") : "")));
+      body.append(el("table", {},
+        el("thead", {}, el("tr", {}, el("th", {}, "Pod"), el("th", {}, "Image"), el("th", {}, "State"),
+          el("th", {}, "Created"), el("th", {}, "Waiter"))),
+        el("tbody", {}, ...rows)));
+    }
+
+    if (m.failure) {
+      body.append(el("h3", {}, "Last failure: " + m.failure.jobName + " (" + m.failure.image + ")"));
+      if (m.failure.logs) {
+        body.append(el("pre", {}, m.failure.logs));
+      } else {
+        body.append(el("p", { className: "empty" }, m.failure.message || "No logs"));
+        if (m.failure.pod && !sessionStorage.getItem(TOKEN_KEY)) {
+          // Logs always need a token, even when the dashboard doesn't.
+          const signIn = el("button", { type: "button" }, "Sign in to see logs");
+          signIn.addEventListener("click", () => showLogin("Sign in with a token allowed to read pod logs"));
+          body.append(signIn);
+        }
+      }
+    }
+
+    body.append(el("h3", {}, "History"));
+    if (m.history.length) {
+      const rows = m.history.map((r) => el("tr", {},
+        el("td", {}, r.image),
+        el("td", { className: r.result }, r.result),
+        el("td", {}, r.jobName || ""),
+        el("td", {}, ago(r.startTime)),
+        el("td", {}, duration(r.startTime, r.completionTime))));
+      body.append(el("table", {},
+        el("thead", {}, el("tr", {}, el("th", {}, "Image"), el("th", {}, "Result"), el("th", {}, "Job"),
+          el("th", {}, "Started"), el("th", {}, "Took"))),
+        el("tbody", {}, ...rows)));
+    } else {
+      body.append(el("p", { className: "empty" }, "No migrations have finished yet"));
+    }
+
+    details.append(body);
+    return details;
+  }
+
+  function render() {
+    const main = document.getElementById("migrators");
+    if (!overview) {
+      return;
+    }
+    const filter = document.getElementById("filter").value.trim().toLowerCase();
+    const items = overview.migrators.filter((m) =>
+      !filter || (m.namespace + "/" + m.name).toLowerCase().includes(filter));
+    main.replaceChildren(...items.map(renderMigrator));
+    if (!items.length) {
+      main.append(el("p", { className: "empty" }, overview.migrators.length ? "No Migrators match" : "No Migrators"));
+    }
+  }
+
+  function showLogin(message) {
+    const form = document.getElementById("login");
+    document.getElementById("login-message").textContent = message;
+    form.hidden = false;
+    setStatus("");
+  }
+
+  async function poll() {
+    polling = true;
+    let since = null;
+    for (;;) {
+      const url = since === null ? "api/overview" : "api/overview?since=" + since + "&wait=" + WAIT_SECONDS;
+      const headers = {};
+      const token = sessionStorage.getItem(TOKEN_KEY);
+      if (token) {
+        headers["Authorization"] = "Bearer " + token;
+      }
+      try {
+        const resp = await fetch(url, { headers, cache: "no-store" });
+        const body = await resp.json();
+        if (resp.status === 401 || resp.status === 403) {
+          showLogin(body.message || "Sign in to see Migrators");
+          polling = false;
+          return;
+        }
+        if (!resp.ok) {
+          throw new Error(body.message || "HTTP " + resp.status);
+        }
+        overview = body;
+        since = body.generation;
+        render();
+        setStatus("Updated " + new Date().toLocaleTimeString());
+      } catch (err) {
+        setStatus("Error, retrying: " + err.message, true);
+        since = null;
+        await new Promise((resolve) => setTimeout(resolve, RETRY_MS));
+      }
+    }
+  }
+
+  document.getElementById("filter").addEventListener("input", render);
+  document.getElementById("login").addEventListener("submit", (event) => {
+    event.preventDefault();
+    sessionStorage.setItem(TOKEN_KEY, document.getElementById("token").value.trim());
+    document.getElementById("login").hidden = true;
+    if (polling) {
+      // Signing in for logs, the running poll picks the token up on its next request.
+      render();
+    } else {
+      poll();
+    }
+  });
+  // Keep relative times fresh between updates.
+  setInterval(render, 30000);
+  poll();
+})();
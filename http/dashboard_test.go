@@ -0,0 +1,182 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/webhook"
+)
+
+var _ = Describe("Dashboard", func() {
+	var objs []runtime.Object
+	var watcher *migratorWatcher
+	var auth *authenticator
+	var token string
+
+	BeforeEach(func() {
+		auth = nil
+		token = ""
+		objs = []runtime.Object{
+			&migrationsv1.Migrator{
+				ObjectMeta: metav1.ObjectMeta{Name: "testing", Namespace: "default"},
+				Spec: migrationsv1.MigratorSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "testing"}},
+				},
+				Status: migrationsv1.MigratorStatus{
+					CurrentTarget: "myapp:v2",
+					History: []migrationsv1.MigrationRecord{
+						{Image: "myapp:v2", Result: migrationsv1.MigrationResultFailed, JobName: "testing-migrations"},
+						{Image: "myapp:v1", Result: migrationsv1.MigrationResultSucceeded, JobName: "testing-migrations"},
+					},
+				},
+			},
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "testing-1", Namespace: "default", Labels: map[string]string{"app": "testing"}},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{{Name: webhook.WAITER_PREFIX + "testing", Image: "waiter"}},
+					Containers:     []corev1.Container{{Name: "main", Image: "myapp:v2"}},
+				},
+				Status: corev1.PodStatus{
+					Phase:                 corev1.PodPending,
+					InitContainerStatuses: []corev1.ContainerStatus{{Name: webhook.WAITER_PREFIX + "testing"}},
+				},
+			},
+		}
+		watcher = &migratorWatcher{watches: map[string]*migratorWatch{}}
+	})
+
+	get := func(query string) *httptest.ResponseRecorder {
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(migrationsv1.AddToScheme(scheme)).To(Succeed())
+		handler := &dashboardHandler{
+			client:    fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build(),
+			clientset: kubefake.NewSimpleClientset(),
+			watcher:   watcher,
+			auth:      auth,
+		}
+		req := httptest.NewRequest(http.MethodGet, "/dashboard/api/overview"+query, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	overview := func(recorder *httptest.ResponseRecorder) *DashboardOverview {
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		resp := &DashboardOverview{}
+		Expect(json.Unmarshal(recorder.Body.Bytes(), resp)).To(Succeed())
+		return resp
+	}
+
+	It("shows Migrators with their blocked pods and history", func() {
+		resp := overview(get(""))
+		Expect(resp.Migrators).To(HaveLen(1))
+		m := resp.Migrators[0]
+		Expect(m.Name).To(Equal("testing"))
+		Expect(m.History).To(HaveLen(2))
+		Expect(m.Blocked).To(HaveLen(1))
+		Expect(m.Blocked[0].Name).To(Equal("testing-1"))
+	})
+
+	It("says when the failed migration pod is gone", func() {
+		resp := overview(get(""))
+		Expect(resp.Migrators[0].Failure).ToNot(BeNil())
+		Expect(resp.Migrators[0].Failure.Image).To(Equal("myapp:v2"))
+		Expect(resp.Migrators[0].Failure.Logs).To(BeEmpty())
+		Expect(resp.Migrators[0].Failure.Message).To(Equal("The failed migration pod no longer exists"))
+	})
+
+	It("shows the logs of the newest failed migration pod", func() {
+		auth = newTestAuthenticator(AuthModeRequired, true)
+		token = "sa-token"
+		objs = append(objs,
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "testing-migrations-old", Namespace: "default", Labels: map[string]string{"job-name": "testing-migrations"}, CreationTimestamp: metav1.NewTime(time.Now().Add(-time.Hour))},
+				Status:     corev1.PodStatus{Phase: corev1.PodFailed},
+			},
+			&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "testing-migrations-new", Namespace: "default", Labels: map[string]string{"job-name": "testing-migrations"}, CreationTimestamp: metav1.NewTime(time.Now())},
+				Status:     corev1.PodStatus{Phase: corev1.PodFailed},
+			},
+		)
+		resp := overview(get(""))
+		Expect(resp.Migrators[0].Failure.Pod).To(Equal("testing-migrations-new"))
+		Expect(resp.Migrators[0].Failure.Logs).To(Equal("fake logs"))
+	})
+
+	It("leaves out logs without a token", func() {
+		objs = append(objs, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing-migrations-new", Namespace: "default", Labels: map[string]string{"job-name": "testing-migrations"}},
+			Status:     corev1.PodStatus{Phase: corev1.PodFailed},
+		})
+		resp := overview(get(""))
+		Expect(resp.Migrators[0].Failure.Pod).To(Equal("testing-migrations-new"))
+		Expect(resp.Migrators[0].Failure.Logs).To(BeEmpty())
+		Expect(resp.Migrators[0].Failure.Message).To(Equal("Sign in with a token allowed to get pods/log to see the logs"))
+	})
+
+	It("waits for a Migrator to change", func() {
+		_, since := watcher.anyChanged()
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(100 * time.Millisecond)
+			watcher.notify(&migrationsv1.Migrator{ObjectMeta: metav1.ObjectMeta{Name: "testing", Namespace: "default"}})
+		}()
+		start := time.Now()
+		resp := overview(get("?since=" + strconv.FormatUint(since, 10) + "&wait=10"))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		Expect(resp.Generation).To(Equal(since + 1))
+	})
+
+	It("returns after the wait with nothing changed", func() {
+		_, since := watcher.anyChanged()
+		resp := overview(get("?since=" + strconv.FormatUint(since, 10) + "&wait=1"))
+		Expect(resp.Generation).To(Equal(since))
+	})
+
+	It("rejects a bad since", func() {
+		Expect(get("?since=nope&wait=1").Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("serves the page", func() {
+		recorder := httptest.NewRecorder()
+		DashboardFiles().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/dashboard/", nil))
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		body, err := io.ReadAll(recorder.Body)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring("dashboard.js"))
+	})
+})
@@ -18,40 +18,94 @@ package http
 
 import (
 	"context"
+	"crypto/tls"
 	"net/http"
 	"os"
+	"path/filepath"
 
+	"github.com/pkg/errors"
+	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 var log = ctrl.Log.WithName("api")
 
 type apiServer struct {
-	client client.Client
+	client        client.Client
+	clientset     kubernetes.Interface
+	watcher       *migratorWatcher
+	auth          *authenticator
+	dashboardAuth *authenticator
 }
 
 func APIServer(mgr ctrl.Manager) error {
-	server := &apiServer{client: mgr.GetClient()}
+	watcher, err := newMigratorWatcher(mgr)
+	if err != nil {
+		return err
+	}
+	auth, err := newAuthenticator(mgr.GetClient(), AuthMode(os.Getenv("API_AUTH")))
+	if err != nil {
+		return err
+	}
+	// The dashboard may be opened up to people without Kubernetes credentials separately from the API.
+	dashboardAuth := auth
+	if mode := os.Getenv("DASHBOARD_AUTH"); mode != "" {
+		dashboardAuth, err = newAuthenticator(mgr.GetClient(), AuthMode(mode))
+		if err != nil {
+			return err
+		}
+	}
+	// Pod logs aren't available through the controller-runtime client.
+	clientset, err := kubernetes.NewForConfig(mgr.GetConfig())
+	if err != nil {
+		return errors.Wrap(err, "error creating Kubernetes clientset")
+	}
+	server := &apiServer{client: mgr.GetClient(), clientset: clientset, watcher: watcher, auth: auth, dashboardAuth: dashboardAuth}
 	return mgr.Add(server)
 }
 
 func (s *apiServer) Start(ctx context.Context) error {
 	mux := http.NewServeMux()
-	mux.Handle("/api/ready", &readyHandler{client: s.client})
+	mux.Handle("/api/ready", &readyHandler{client: s.client, auth: s.auth})
+	mux.Handle("/api/v1/ready", &readyV1Handler{client: s.client, watcher: s.watcher, auth: s.auth})
+	mux.Handle("/api/v1/logs", &logsHandler{client: s.client, clientset: s.clientset, auth: s.auth})
+	mux.Handle("/api/v1/openapi.json", &openAPIHandler{})
+	mux.Handle("/api/v1/", &restHandler{client: s.client, auth: s.auth})
+	mux.Handle("/dashboard/", DashboardFiles())
+	mux.Handle("/dashboard/api/overview", &dashboardHandler{client: s.client, clientset: s.clientset, watcher: s.watcher, auth: s.dashboardAuth})
 
 	addr := os.Getenv("API_LISTEN")
 	if addr == "" {
 		addr = ":5000"
 	}
 
-	log.Info("serving API server", "addr", addr)
-
 	srv := &http.Server{
 		Addr:    addr,
 		Handler: mux,
 	}
 
+	// Serve HTTPS if there's a certificate, reloading it when the Secret it is mounted from changes.
+	certDir := os.Getenv("API_CERT_DIR")
+	if certDir != "" {
+		watcher, err := certwatcher.New(filepath.Join(certDir, "tls.crt"), filepath.Join(certDir, "tls.key"))
+		if err != nil {
+			return errors.Wrap(err, "error loading API server certificate")
+		}
+		go func() {
+			if err := watcher.Start(ctx); err != nil {
+				log.Error(err, "error watching API server certificate")
+			}
+		}()
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: watcher.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	log.Info("serving API server", "addr", addr, "auth", s.auth.mode, "tls", srv.TLSConfig != nil)
+
 	done := make(chan struct{})
 	go func() {
 		<-ctx.Done()
@@ -65,7 +119,13 @@ func (s *apiServer) Start(ctx context.Context) error {
 		close(done)
 	}()
 
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		return err
 	}
 
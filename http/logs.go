@@ -0,0 +1,140 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/utils"
+)
+
+// The response header naming the pod whose logs are being streamed.
+const LOGS_POD_HEADER = "X-Migrations-Pod"
+
+// logsHandler streams the logs of the current migration Job for a Migrator, so waiters can show people
+// what their pod is waiting on.
+type logsHandler struct {
+	client    client.Client
+	clientset kubernetes.Interface
+	auth      *authenticator
+}
+
+func (h *logsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	namespace := r.URL.Query().Get("namespace")
+	name := r.URL.Query().Get("migrator")
+	if namespace == "" || name == "" {
+		http.Error(w, "namespace and migrator are required", http.StatusBadRequest)
+		return
+	}
+	err := h.auth.authorizeLogs(r, namespace, name)
+	if err != nil {
+		if authErr, ok := err.(*authError); ok {
+			http.Error(w, authErr.msg, authErr.code)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	pod, err := currentMigrationPod(r.Context(), h.client, namespace, name)
+	if err != nil {
+		if kerrors.IsNotFound(errors.Cause(err)) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if pod == nil {
+		// Nothing is running yet, so there are no logs to follow.
+		w.Header().Set("Retry-After", "5")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	stream, err := h.clientset.CoreV1().Pods(pod.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{
+		Container: utils.MIGRATION_CONTAINER,
+		Follow:    true,
+	}).Stream(r.Context())
+	if err != nil {
+		http.Error(w, errors.Wrapf(err, "error streaming logs for %s/%s", pod.Namespace, pod.Name).Error(), http.StatusBadGateway)
+		return
+	}
+	defer stream.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set(LOGS_POD_HEADER, pod.Name)
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 4096)
+	for {
+		n, err := stream.Read(buf)
+		if n > 0 {
+			_, writeErr := w.Write(buf[:n])
+			if writeErr != nil {
+				// The client went away.
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// currentMigrationPod finds the newest pod of a Migrator's running migration Job. It returns nil if there
+// is no running Job or its pod hasn't started yet.
+func currentMigrationPod(ctx context.Context, c client.Client, namespace, name string) (*corev1.Pod, error) {
+	migrator := &migrationsv1.Migrator{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, migrator)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting Migrator %s/%s", namespace, name)
+	}
+	if migrator.Status.CurrentJob == "" {
+		return nil, nil
+	}
+
+	pods := &corev1.PodList{}
+	err = c.List(ctx, pods, client.InNamespace(namespace), client.MatchingLabels{"job-name": migrator.Status.CurrentJob})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing pods for job %s/%s", namespace, migrator.Status.CurrentJob)
+	}
+	var newest *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if newest == nil || newest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			newest = pod
+		}
+	}
+	if newest == nil || newest.Status.Phase == corev1.PodPending {
+		return nil, nil
+	}
+	return newest, nil
+}
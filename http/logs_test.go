@@ -0,0 +1,109 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	kubefake "k8s.io/client-go/kubernetes/fake"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+var _ = Describe("Logs API", func() {
+	var migrator *migrationsv1.Migrator
+	var pods []*corev1.Pod
+
+	BeforeEach(func() {
+		migrator = &migrationsv1.Migrator{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing", Namespace: "default"},
+		}
+		pods = nil
+	})
+
+	migrationPod := func(name string, created time.Time, phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              name,
+				Namespace:         "default",
+				Labels:            map[string]string{"job-name": "testing-migrations"},
+				CreationTimestamp: metav1.NewTime(created),
+			},
+			Status: corev1.PodStatus{Phase: phase},
+		}
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		scheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+		Expect(migrationsv1.AddToScheme(scheme)).To(Succeed())
+		objs := []runtime.Object{migrator}
+		for _, pod := range pods {
+			objs = append(objs, pod)
+		}
+		handler := &logsHandler{
+			client:    fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build(),
+			clientset: kubefake.NewSimpleClientset(),
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/logs?"+query, nil))
+		return recorder
+	}
+
+	It("requires a namespace and migrator", func() {
+		Expect(get("namespace=default").Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("returns 404 for a missing migrator", func() {
+		Expect(get("namespace=default&migrator=other").Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("has no content with no running job", func() {
+		resp := get("namespace=default&migrator=testing")
+		Expect(resp.Code).To(Equal(http.StatusNoContent))
+		Expect(resp.Header().Get("Retry-After")).To(Equal("5"))
+	})
+
+	It("has no content until the pod starts", func() {
+		migrator.Status.CurrentJob = "testing-migrations"
+		pods = []*corev1.Pod{migrationPod("testing-migrations-abcde", time.Now(), corev1.PodPending)}
+		Expect(get("namespace=default&migrator=testing").Code).To(Equal(http.StatusNoContent))
+	})
+
+	It("streams the logs of the newest pod", func() {
+		migrator.Status.CurrentJob = "testing-migrations"
+		now := time.Now()
+		pods = []*corev1.Pod{
+			migrationPod("testing-migrations-old", now.Add(-time.Minute), corev1.PodFailed),
+			migrationPod("testing-migrations-new", now, corev1.PodRunning),
+		}
+		resp := get("namespace=default&migrator=testing")
+		Expect(resp.Code).To(Equal(http.StatusOK))
+		Expect(resp.Header().Get(LOGS_POD_HEADER)).To(Equal("testing-migrations-new"))
+		// The fake clientset always returns the same logs.
+		Expect(resp.Body.String()).To(Equal("fake logs"))
+	})
+})
@@ -17,55 +17,312 @@ limitations under the License.
 package http
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
+	"github.com/coderanger/controller-utils/conditions"
+	"github.com/pkg/errors"
 	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 )
 
-type readyHandler struct {
-	client client.Client
+// The ready API's response when migrations aren't ready because the Migrator is suspended. Anything other
+// than "true" means not ready, so older waiters treat this the same as "false".
+const READY_SUSPENDED = "suspended"
+
+// The version of the structured ready API, served at /api/v1/ready.
+const READY_API_VERSION = "v1"
+
+// ReadyState is the state of migrations for one image, as reported by the structured ready API.
+type ReadyState string
+
+const (
+	// ReadyStateReady means migrations for the image have succeeded.
+	ReadyStateReady ReadyState = "Ready"
+	// ReadyStatePending means no migration Job for the image has started yet.
+	ReadyStatePending ReadyState = "Pending"
+	// ReadyStateRunning means a migration Job for the image is running.
+	ReadyStateRunning ReadyState = "Running"
+	// ReadyStateFailed means the newest migration Job for the image failed.
+	ReadyStateFailed ReadyState = "Failed"
+	// ReadyStateSuspended means the Migrator is suspended or all migrations are frozen.
+	ReadyStateSuspended ReadyState = "Suspended"
+	// ReadyStateNotFound means the Migrator doesn't exist.
+	ReadyStateNotFound ReadyState = "NotFound"
+	// ReadyStateError means the request couldn't be answered.
+	ReadyStateError ReadyState = "Error"
+)
+
+// badRequestError is an error caused by the request itself, which retrying won't fix.
+type badRequestError struct {
+	error
 }
 
+// The longest a ready request can wait for a change.
+const MAX_READY_WAIT = 5 * time.Minute
+
 type ReadyArgs struct {
 	TargetImage       string `json:"targetImage"`
 	MigratorNamespace string `json:"migratorNamespace"`
 	MigratorName      string `json:"migratorName"`
+	// WaitSeconds makes the structured ready API long-poll, holding the request until the state differs
+	// from LastState or this many seconds pass. Capped at MAX_READY_WAIT.
+	WaitSeconds int `json:"waitSeconds,omitempty"`
+	// LastState is the state the caller last saw. Defaults to the state when the request arrives.
+	LastState ReadyState `json:"lastState,omitempty"`
 }
 
-func (h *readyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ready, err := h.handle(w, r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-	} else {
-		fmt.Fprintf(w, "%v", ready)
+// ReadyResponse is the body of a structured ready API response.
+type ReadyResponse struct {
+	APIVersion string     `json:"apiVersion"`
+	State      ReadyState `json:"state"`
+	Reason     string     `json:"reason,omitempty"`
+	Message    string     `json:"message,omitempty"`
+	// CurrentJob is the name of the running migration Job, if it is for the target image.
+	CurrentJob string `json:"currentJob,omitempty"`
+	// Attempt is how many migration Jobs have been started for the target image, as far back as the
+	// Migrator's history goes.
+	Attempt         int          `json:"attempt,omitempty"`
+	LastAttemptTime *metav1.Time `json:"lastAttemptTime,omitempty"`
+	// LastSuccess is the newest successful migration, for any image.
+	LastSuccess *migrationsv1.MigrationRecord `json:"lastSuccess,omitempty"`
+}
+
+// StatusCode returns the HTTP status code for the response.
+func (r *ReadyResponse) StatusCode() int {
+	switch r.State {
+	case ReadyStateReady:
+		return http.StatusOK
+	case ReadyStateNotFound:
+		return http.StatusNotFound
+	case ReadyStateFailed:
+		return http.StatusFailedDependency
+	case ReadyStateError:
+		return http.StatusInternalServerError
+	default:
+		return http.StatusServiceUnavailable
+	}
+}
+
+// NotFoundStatus is the state of migrations when the Migrator doesn't exist.
+func NotFoundStatus(namespace, name string) *ReadyResponse {
+	return &ReadyResponse{
+		APIVersion: READY_API_VERSION,
+		State:      ReadyStateNotFound,
+		Reason:     "MigratorNotFound",
+		Message:    fmt.Sprintf("Migrator %s/%s does not exist", namespace, name),
+	}
+}
+
+// ReadyStatus works out the state of migrations for an image from a Migrator.
+func ReadyStatus(migrator *migrationsv1.Migrator, targetImage string) *ReadyResponse {
+	status := &migrator.Status
+	resp := &ReadyResponse{
+		APIVersion:      READY_API_VERSION,
+		LastAttemptTime: status.LastAttemptTime,
+		LastSuccess:     status.LastSuccessfulRecord(),
+	}
+	var newest *migrationsv1.MigrationRecord
+	for i := range status.History {
+		if status.History[i].Image == targetImage {
+			if newest == nil {
+				newest = &status.History[i]
+			}
+			resp.Attempt++
+		}
+	}
+	running := status.CurrentJob != "" && status.CurrentTarget == targetImage
+	if running {
+		resp.Attempt++
+		resp.CurrentJob = status.CurrentJob
+	}
+
+	migrationsReady := conditions.FindStatusCondition(status.Conditions, migrationsv1.ConditionMigrationsReady)
+	suspended := conditions.FindStatusCondition(status.Conditions, migrationsv1.ConditionSuspended)
+	useCondition := func(state ReadyState, condition *conditions.Condition) {
+		resp.State = state
+		if condition != nil {
+			resp.Reason = condition.Reason
+			resp.Message = condition.Message
+		}
+	}
+	switch {
+	case targetImage != "" && status.LastSuccessfulMigration() == targetImage:
+		resp.State = ReadyStateReady
+		resp.Reason = migrationsv1.ReasonMigrationsSucceeded
+		resp.Message = fmt.Sprintf("Migrations for %s succeeded", targetImage)
+	case migrator.Spec.Suspend || (suspended != nil && suspended.Status == metav1.ConditionTrue):
+		useCondition(ReadyStateSuspended, suspended)
+		if resp.Reason == "" {
+			resp.Reason = migrationsv1.ReasonSuspended
+			resp.Message = "Migrator is suspended"
+		}
+	case running:
+		useCondition(ReadyStateRunning, migrationsReady)
+	case newest != nil && newest.Result == migrationsv1.MigrationResultFailed:
+		resp.State = ReadyStateFailed
+		resp.Reason = migrationsv1.ReasonMigrationsFailed
+		resp.Message = fmt.Sprintf("Migration job %s using image %s failed", newest.JobName, targetImage)
+	default:
+		useCondition(ReadyStatePending, migrationsReady)
+		if resp.Reason == "" {
+			resp.Reason = "MigrationsPending"
+			resp.Message = fmt.Sprintf("Waiting for a migration job for %s to start", targetImage)
+		}
 	}
+	return resp
 }
 
-func (h *readyHandler) handle(w http.ResponseWriter, r *http.Request) (bool, error) {
-	// Parse args.
-	var args ReadyArgs
-	err := json.NewDecoder(r.Body).Decode(&args)
+func parseReadyArgs(r *http.Request) (*ReadyArgs, error) {
+	args := &ReadyArgs{}
+	err := json.NewDecoder(r.Body).Decode(args)
 	if err != nil {
-		return false, err
+		return nil, badRequestError{errors.Wrap(err, "error parsing request")}
 	}
+	return args, nil
+}
 
+// lookupReady finds the state of the requested Migrator.
+func lookupReady(ctx context.Context, c client.Client, args *ReadyArgs) (*ReadyResponse, error) {
 	// Try to find the migrator object.
-	migrator := &migrationsv1beta1.Migrator{}
-	err = h.client.Get(r.Context(), types.NamespacedName{Name: args.MigratorName, Namespace: args.MigratorNamespace}, migrator)
+	migrator := &migrationsv1.Migrator{}
+	err := c.Get(ctx, types.NamespacedName{Name: args.MigratorName, Namespace: args.MigratorNamespace}, migrator)
 	if err != nil {
 		if kerrors.IsNotFound(err) {
-			return false, nil
+			return NotFoundStatus(args.MigratorNamespace, args.MigratorName), nil
+		}
+		return nil, errors.Wrapf(err, "error getting Migrator %s/%s", args.MigratorNamespace, args.MigratorName)
+	}
+
+	return ReadyStatus(migrator, args.TargetImage), nil
+}
+
+// readyHandler serves the original plaintext ready API, which answers "true", "false" or "suspended".
+type readyHandler struct {
+	client client.Client
+	auth   *authenticator
+}
+
+func (h *readyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	args, err := parseReadyArgs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = h.auth.authorizeReady(r, args.MigratorNamespace)
+	if err != nil {
+		if authErr, ok := err.(*authError); ok {
+			http.Error(w, authErr.msg, authErr.code)
 		} else {
-			return false, err
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	resp, err := lookupReady(r.Context(), h.client, args)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch resp.State {
+	case ReadyStateReady:
+		fmt.Fprint(w, "true")
+	case ReadyStateSuspended:
+		fmt.Fprint(w, READY_SUSPENDED)
+	default:
+		fmt.Fprint(w, "false")
+	}
+}
+
+// readyV1Handler serves the structured ready API.
+type readyV1Handler struct {
+	client  client.Client
+	watcher *migratorWatcher
+	auth    *authenticator
+}
+
+func (h *readyV1Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	resp, err := h.handle(r)
+	if err != nil {
+		resp = &ReadyResponse{APIVersion: READY_API_VERSION, State: ReadyStateError, Reason: "InternalError", Message: err.Error()}
+		if _, ok := err.(badRequestError); ok {
+			resp.Reason = "BadRequest"
+			writeReady(w, http.StatusBadRequest, resp)
+			return
 		}
+		if authErr, ok := err.(*authError); ok {
+			resp.Reason = http.StatusText(authErr.code)
+			writeReady(w, authErr.code, resp)
+			return
+		}
+	}
+	writeReady(w, resp.StatusCode(), resp)
+}
+
+func (h *readyV1Handler) handle(r *http.Request) (*ReadyResponse, error) {
+	args, err := parseReadyArgs(r)
+	if err != nil {
+		return nil, err
+	}
+	err = h.auth.authorizeReady(r, args.MigratorNamespace)
+	if err != nil {
+		return nil, err
+	}
+	var changed <-chan struct{}
+	var release func()
+	if args.WaitSeconds > 0 && h.watcher != nil {
+		changed, release = h.watcher.changed(args.MigratorNamespace, args.MigratorName)
+		// release is replaced along with changed, so this always gives up the current watch.
+		defer func() { release() }()
+	}
+	resp, err := lookupReady(r.Context(), h.client, args)
+	if err != nil || changed == nil || resp.State == ReadyStateReady {
+		return resp, err
 	}
 
-	// Check if the version matches.
-	return migrator.Status.LastSuccessfulMigration == args.TargetImage, nil
+	// Long-poll until the state changes, re-reading the Migrator from the cache each time it is updated.
+	lastState := args.LastState
+	if lastState == "" {
+		lastState = resp.State
+	}
+	wait := time.Duration(args.WaitSeconds) * time.Second
+	if wait > MAX_READY_WAIT {
+		wait = MAX_READY_WAIT
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for resp.State == lastState {
+		select {
+		case <-changed:
+			release()
+			changed, release = h.watcher.changed(args.MigratorNamespace, args.MigratorName)
+			resp, err = lookupReady(r.Context(), h.client, args)
+			if err != nil {
+				return nil, err
+			}
+		case <-timer.C:
+			return resp, nil
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+	}
+	return resp, nil
+}
+
+func writeReady(w http.ResponseWriter, code int, resp *ReadyResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	if code == http.StatusServiceUnavailable {
+		w.Header().Set("Retry-After", "5")
+	}
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Error(err, "error writing ready response")
+	}
 }
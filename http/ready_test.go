@@ -21,23 +21,26 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+	"time"
 
 	cu "github.com/coderanger/controller-utils"
+	"github.com/coderanger/controller-utils/conditions"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/webhook"
 )
 
 var _ = Describe("Ready API", func() {
 	var helper *cu.FunctionalHelper
-	var obj *migrationsv1beta1.Migrator
+	var obj *migrationsv1.Migrator
 
 	BeforeEach(func() {
-		obj = &migrationsv1beta1.Migrator{
+		obj = &migrationsv1.Migrator{
 			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
-			Spec: migrationsv1beta1.MigratorSpec{
+			Spec: migrationsv1.MigratorSpec{
 				Selector: &metav1.LabelSelector{
 					MatchLabels: map[string]string{
 						"app": "testing",
@@ -45,7 +48,7 @@ var _ = Describe("Ready API", func() {
 				},
 			},
 		}
-		helper = suiteHelper.MustStart(APIServer)
+		helper = suiteHelper.MustStart(APIServer, webhook.MigratorDefaulter, webhook.MigratorValidator)
 		helper.TestClient.Create(obj)
 	})
 
@@ -54,7 +57,7 @@ var _ = Describe("Ready API", func() {
 		helper = nil
 	})
 
-	post := func(image, name string) bool {
+	post := func(image, name string) string {
 		args := &ReadyArgs{TargetImage: image, MigratorNamespace: helper.Namespace, MigratorName: name}
 		data, err := json.Marshal(args)
 		Expect(err).ToNot(HaveOccurred())
@@ -64,25 +67,168 @@ var _ = Describe("Ready API", func() {
 		defer resp.Body.Close()
 		body, err := io.ReadAll(resp.Body)
 		Expect(err).ToNot(HaveOccurred())
-		return string(body) == "true"
+		return string(body)
 	}
 
 	It("returns false with no Migrator", func() {
 		ready := post("myapp:latest", "other")
-		Expect(ready).To(BeFalse())
+		Expect(ready).To(Equal("false"))
 	})
 
 	It("returns true with a valid Migrator", func() {
-		obj.Status.LastSuccessfulMigration = "myapp:latest"
+		obj.Status.History = []migrationsv1.MigrationRecord{{Image: "myapp:latest", Result: migrationsv1.MigrationResultSucceeded}}
 		helper.TestClient.Status().Update(obj)
 		ready := post("myapp:latest", "testing")
-		Expect(ready).To(BeTrue())
+		Expect(ready).To(Equal("true"))
 	})
 
 	It("returns false with a Migrator on the wrong version", func() {
-		obj.Status.LastSuccessfulMigration = "myapp:latest"
+		obj.Status.History = []migrationsv1.MigrationRecord{{Image: "myapp:latest", Result: migrationsv1.MigrationResultSucceeded}}
 		helper.TestClient.Status().Update(obj)
 		ready := post("myapp:v2", "testing")
-		Expect(ready).To(BeFalse())
+		Expect(ready).To(Equal("false"))
+	})
+
+	It("returns suspended with a suspended Migrator on the wrong version", func() {
+		obj.Spec.Suspend = true
+		helper.TestClient.Update(obj)
+		ready := post("myapp:v2", "testing")
+		Expect(ready).To(Equal(READY_SUSPENDED))
+	})
+
+	postV1Args := func(args *ReadyArgs) (int, *ReadyResponse) {
+		args.MigratorNamespace = helper.Namespace
+		data, err := json.Marshal(args)
+		Expect(err).ToNot(HaveOccurred())
+		resp, err := http.Post(url+"api/v1/ready", "application/json", bytes.NewBuffer(data))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		ready := &ReadyResponse{}
+		Expect(json.NewDecoder(resp.Body).Decode(ready)).To(Succeed())
+		Expect(ready.APIVersion).To(Equal(READY_API_VERSION))
+		return resp.StatusCode, ready
+	}
+
+	postV1 := func(image, name string) (int, *ReadyResponse) {
+		return postV1Args(&ReadyArgs{TargetImage: image, MigratorName: name})
+	}
+
+	It("returns NotFound from the v1 API with no Migrator", func() {
+		code, ready := postV1("myapp:latest", "other")
+		Expect(code).To(Equal(404))
+		Expect(ready.State).To(Equal(ReadyStateNotFound))
+	})
+
+	It("returns Ready from the v1 API with a valid Migrator", func() {
+		obj.Status.History = []migrationsv1.MigrationRecord{{Image: "myapp:latest", Result: migrationsv1.MigrationResultSucceeded, JobName: "testing-migrations"}}
+		helper.TestClient.Status().Update(obj)
+		code, ready := postV1("myapp:latest", "testing")
+		Expect(code).To(Equal(200))
+		Expect(ready.State).To(Equal(ReadyStateReady))
+		Expect(ready.LastSuccess).ToNot(BeNil())
+		Expect(ready.LastSuccess.Image).To(Equal("myapp:latest"))
+	})
+
+	It("returns Running from the v1 API while a job is running", func() {
+		obj.Status.CurrentTarget = "myapp:v2"
+		obj.Status.CurrentJob = "testing-migrations"
+		helper.TestClient.Status().Update(obj)
+		code, ready := postV1("myapp:v2", "testing")
+		Expect(code).To(Equal(503))
+		Expect(ready.State).To(Equal(ReadyStateRunning))
+		Expect(ready.CurrentJob).To(Equal("testing-migrations"))
+		Expect(ready.Attempt).To(Equal(1))
+	})
+
+	It("waits for the state to change in the v1 API", func() {
+		go func() {
+			defer GinkgoRecover()
+			time.Sleep(time.Second)
+			obj.Status.History = []migrationsv1.MigrationRecord{{Image: "myapp:v2", Result: migrationsv1.MigrationResultSucceeded}}
+			helper.TestClient.Status().Update(obj)
+		}()
+		start := time.Now()
+		code, ready := postV1Args(&ReadyArgs{TargetImage: "myapp:v2", MigratorName: "testing", WaitSeconds: 30, LastState: ReadyStatePending})
+		Expect(code).To(Equal(200))
+		Expect(ready.State).To(Equal(ReadyStateReady))
+		Expect(time.Since(start)).To(BeNumerically("<", 30*time.Second))
+	})
+
+	It("returns the same state once the wait runs out in the v1 API", func() {
+		start := time.Now()
+		code, ready := postV1Args(&ReadyArgs{TargetImage: "myapp:v2", MigratorName: "testing", WaitSeconds: 1})
+		Expect(code).To(Equal(503))
+		Expect(ready.State).To(Equal(ReadyStatePending))
+		Expect(time.Since(start)).To(BeNumerically(">=", time.Second))
+	})
+
+	It("returns straight away from the v1 API if the state already changed", func() {
+		start := time.Now()
+		_, ready := postV1Args(&ReadyArgs{TargetImage: "myapp:v2", MigratorName: "testing", WaitSeconds: 30, LastState: ReadyStateRunning})
+		Expect(ready.State).To(Equal(ReadyStatePending))
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+	})
+
+	It("returns an error from the v1 API on a bad request", func() {
+		resp, err := http.Post(url+"api/v1/ready", "application/json", bytes.NewBufferString("{"))
+		Expect(err).ToNot(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(400))
+		ready := &ReadyResponse{}
+		Expect(json.NewDecoder(resp.Body).Decode(ready)).To(Succeed())
+		Expect(ready.State).To(Equal(ReadyStateError))
+	})
+})
+
+var _ = Describe("ReadyStatus", func() {
+	var obj *migrationsv1.Migrator
+
+	BeforeEach(func() {
+		obj = &migrationsv1.Migrator{}
+	})
+
+	It("is pending with no history", func() {
+		ready := ReadyStatus(obj, "myapp:v1")
+		Expect(ready.State).To(Equal(ReadyStatePending))
+		Expect(ready.Attempt).To(Equal(0))
+	})
+
+	It("is ready once the image has succeeded", func() {
+		obj.Status.History = []migrationsv1.MigrationRecord{{Image: "myapp:v1", Result: migrationsv1.MigrationResultSucceeded}}
+		Expect(ReadyStatus(obj, "myapp:v1").State).To(Equal(ReadyStateReady))
+	})
+
+	It("is failed when the newest job for the image failed", func() {
+		obj.Status.History = []migrationsv1.MigrationRecord{
+			{Image: "myapp:v2", Result: migrationsv1.MigrationResultFailed, JobName: "testing-migrations"},
+			{Image: "myapp:v1", Result: migrationsv1.MigrationResultSucceeded, JobName: "testing-migrations"},
+		}
+		ready := ReadyStatus(obj, "myapp:v2")
+		Expect(ready.State).To(Equal(ReadyStateFailed))
+		Expect(ready.Reason).To(Equal(migrationsv1.ReasonMigrationsFailed))
+		Expect(ready.Attempt).To(Equal(1))
+		Expect(ready.LastSuccess.Image).To(Equal("myapp:v1"))
+	})
+
+	It("is running when a retry is in progress", func() {
+		obj.Status.History = []migrationsv1.MigrationRecord{{Image: "myapp:v2", Result: migrationsv1.MigrationResultFailed}}
+		obj.Status.CurrentTarget = "myapp:v2"
+		obj.Status.CurrentJob = "testing-migrations"
+		ready := ReadyStatus(obj, "myapp:v2")
+		Expect(ready.State).To(Equal(ReadyStateRunning))
+		Expect(ready.Attempt).To(Equal(2))
+	})
+
+	It("is suspended while globally frozen", func() {
+		obj.Status.Conditions = []conditions.Condition{{
+			Type:    migrationsv1.ConditionSuspended,
+			Status:  metav1.ConditionTrue,
+			Reason:  migrationsv1.ReasonGloballyFrozen,
+			Message: "All migrations are frozen (frozenBy alice): testing",
+		}}
+		ready := ReadyStatus(obj, "myapp:v2")
+		Expect(ready.State).To(Equal(ReadyStateSuspended))
+		Expect(ready.Reason).To(Equal(migrationsv1.ReasonGloballyFrozen))
 	})
 })
@@ -0,0 +1,473 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/webhook"
+)
+
+// The OpenAPI document for everything under /api/v1.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// MigratorSummary is the current state of a Migrator.
+type MigratorSummary struct {
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// State, Reason and Message are the same as the ready API's, for the Target image.
+	State   ReadyState `json:"state"`
+	Reason  string     `json:"reason,omitempty"`
+	Message string     `json:"message,omitempty"`
+	// Target is the image being migrated, or if nothing is running the most recently migrated image.
+	Target          string                        `json:"target,omitempty"`
+	CurrentJob      string                        `json:"currentJob,omitempty"`
+	LastAttemptTime *metav1.Time                  `json:"lastAttemptTime,omitempty"`
+	LastSuccess     *migrationsv1.MigrationRecord `json:"lastSuccess,omitempty"`
+	BlockedPods     int32                         `json:"blockedPods"`
+}
+
+// MigratorList is a list of Migrator summaries.
+type MigratorList struct {
+	APIVersion string            `json:"apiVersion"`
+	Items      []MigratorSummary `json:"items"`
+}
+
+// MigratorDetail is a Migrator's summary along with its history, newest first.
+type MigratorDetail struct {
+	APIVersion string `json:"apiVersion"`
+	MigratorSummary
+	History []migrationsv1.MigrationRecord `json:"history"`
+}
+
+// BlockedPod is a pod held back by the waiter for a Migrator.
+type BlockedPod struct {
+	Name              string      `json:"name"`
+	CreationTimestamp metav1.Time `json:"creationTimestamp"`
+	TargetImage       string      `json:"targetImage"`
+	// State and Message are what the ready API says about the pod's target image.
+	State   ReadyState `json:"state"`
+	Message string     `json:"message,omitempty"`
+	// WaiterRestarts counts how many times the waiter has exited with an error.
+	WaiterRestarts int32 `json:"waiterRestarts,omitempty"`
+	// WaiterMessage is the last termination message from the waiter, such as why it gave up.
+	WaiterMessage string `json:"waiterMessage,omitempty"`
+}
+
+// BlockedPodList is the pods held back by one Migrator.
+type BlockedPodList struct {
+	APIVersion string       `json:"apiVersion"`
+	Namespace  string       `json:"namespace"`
+	Migrator   string       `json:"migrator"`
+	Items      []BlockedPod `json:"items"`
+}
+
+// PodExplanation says why a pod was or wasn't gated by migration waiters.
+type PodExplanation struct {
+	APIVersion string `json:"apiVersion"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	// Gated is true if any waiters were injected into the pod.
+	Gated   bool   `json:"gated"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+	// Migrators has an entry for each Migrator in the namespace, and for any waiter whose Migrator is gone.
+	Migrators []MigratorMatch `json:"migrators"`
+}
+
+// MigratorMatch is how one Migrator relates to a pod.
+type MigratorMatch struct {
+	Name           string     `json:"name"`
+	Matches        bool       `json:"matches"`
+	WaiterInjected bool       `json:"waiterInjected"`
+	WaiterDone     bool       `json:"waiterDone"`
+	TargetImage    string     `json:"targetImage,omitempty"`
+	State          ReadyState `json:"state,omitempty"`
+	Reason         string     `json:"reason"`
+	Message        string     `json:"message"`
+}
+
+// ErrorResponse is the body of an error from the REST API.
+type ErrorResponse struct {
+	APIVersion string `json:"apiVersion"`
+	Reason     string `json:"reason"`
+	Message    string `json:"message"`
+}
+
+// notFoundError is a request for something which doesn't exist.
+type notFoundError struct {
+	error
+}
+
+// restHandler serves the read-only REST API for tooling. Everything is read from the manager's cache.
+type restHandler struct {
+	client client.Client
+	auth   *authenticator
+}
+
+func (h *restHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeJSON(w, http.StatusMethodNotAllowed, &ErrorResponse{APIVersion: READY_API_VERSION, Reason: "MethodNotAllowed", Message: "the API is read-only"})
+		return
+	}
+	resp, err := h.route(r)
+	if err != nil {
+		writeAPIError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// route dispatches a request by path:
+//
+//	/api/v1/migrators
+//	/api/v1/namespaces/{namespace}/migrators
+//	/api/v1/namespaces/{namespace}/migrators/{name}
+//	/api/v1/namespaces/{namespace}/migrators/{name}/pods
+//	/api/v1/namespaces/{namespace}/pods/{name}/explain
+func (h *restHandler) route(r *http.Request) (interface{}, error) {
+	ctx := r.Context()
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+	if len(parts) == 1 && parts[0] == "migrators" {
+		err := h.auth.authorizeResource(r, migratorAttributes("", "list"))
+		if err != nil {
+			return nil, err
+		}
+		items, err := ListMigrators(ctx, h.client, "")
+		if err != nil {
+			return nil, err
+		}
+		return &MigratorList{APIVersion: READY_API_VERSION, Items: items}, nil
+	}
+	if len(parts) < 3 || parts[0] != "namespaces" || parts[1] == "" {
+		return nil, notFoundError{errors.Errorf("unknown API path %s", r.URL.Path)}
+	}
+	namespace := parts[1]
+	switch {
+	case len(parts) == 3 && parts[2] == "migrators":
+		err := h.auth.authorizeResource(r, migratorAttributes(namespace, "list"))
+		if err != nil {
+			return nil, err
+		}
+		items, err := ListMigrators(ctx, h.client, namespace)
+		if err != nil {
+			return nil, err
+		}
+		return &MigratorList{APIVersion: READY_API_VERSION, Items: items}, nil
+	case len(parts) == 4 && parts[2] == "migrators":
+		err := h.auth.authorizeResource(r, migratorAttributes(namespace, "get"))
+		if err != nil {
+			return nil, err
+		}
+		migrator, err := getMigrator(ctx, h.client, namespace, parts[3])
+		if err != nil {
+			return nil, err
+		}
+		return &MigratorDetail{APIVersion: READY_API_VERSION, MigratorSummary: SummarizeMigrator(migrator), History: migrator.Status.History}, nil
+	case len(parts) == 5 && parts[2] == "migrators" && parts[4] == "pods":
+		err := h.auth.authorizeResource(r, podAttributes(namespace, "list"))
+		if err != nil {
+			return nil, err
+		}
+		migrator, err := getMigrator(ctx, h.client, namespace, parts[3])
+		if err != nil {
+			return nil, err
+		}
+		items, err := ListBlockedPods(ctx, h.client, migrator)
+		if err != nil {
+			return nil, err
+		}
+		return &BlockedPodList{APIVersion: READY_API_VERSION, Namespace: namespace, Migrator: migrator.Name, Items: items}, nil
+	case len(parts) == 5 && parts[2] == "pods" && parts[4] == "explain":
+		err := h.auth.authorizeResource(r, podAttributes(namespace, "get"))
+		if err != nil {
+			return nil, err
+		}
+		return ExplainPod(ctx, h.client, namespace, parts[3])
+	}
+	return nil, notFoundError{errors.Errorf("unknown API path %s", r.URL.Path)}
+}
+
+func migratorAttributes(namespace, verb string) *authorizationv1.ResourceAttributes {
+	return &authorizationv1.ResourceAttributes{Namespace: namespace, Verb: verb, Group: migrationsv1.GroupVersion.Group, Resource: "migrators"}
+}
+
+func podAttributes(namespace, verb string) *authorizationv1.ResourceAttributes {
+	return &authorizationv1.ResourceAttributes{Namespace: namespace, Verb: verb, Resource: "pods"}
+}
+
+func getMigrator(ctx context.Context, c client.Client, namespace, name string) (*migrationsv1.Migrator, error) {
+	migrator := &migrationsv1.Migrator{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, migrator)
+	if kerrors.IsNotFound(err) {
+		return nil, notFoundError{errors.Errorf("Migrator %s/%s does not exist", namespace, name)}
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error getting Migrator %s/%s", namespace, name)
+	}
+	return migrator, nil
+}
+
+// ListMigrators summarizes the Migrators in a namespace, or in all namespaces if it is empty, sorted by
+// namespace and name.
+func ListMigrators(ctx context.Context, c client.Client, namespace string) ([]MigratorSummary, error) {
+	migrators := &migrationsv1.MigratorList{}
+	err := c.List(ctx, migrators, client.InNamespace(namespace))
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing Migrators")
+	}
+	items := []MigratorSummary{}
+	for i := range migrators.Items {
+		items = append(items, SummarizeMigrator(&migrators.Items[i]))
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Namespace != items[j].Namespace {
+			return items[i].Namespace < items[j].Namespace
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items, nil
+}
+
+// SummarizeMigrator works out the current state of a Migrator, using the same rules as the ready API for
+// whichever image it is working on.
+func SummarizeMigrator(migrator *migrationsv1.Migrator) MigratorSummary {
+	target := migrator.Status.CurrentTarget
+	if target == "" && len(migrator.Status.History) != 0 {
+		target = migrator.Status.History[0].Image
+	}
+	ready := ReadyStatus(migrator, target)
+	if target == "" && ready.State == ReadyStatePending && ready.Reason == "MigrationsPending" {
+		ready.Message = "No migration jobs have run yet"
+	}
+	return MigratorSummary{
+		Namespace:       migrator.Namespace,
+		Name:            migrator.Name,
+		State:           ready.State,
+		Reason:          ready.Reason,
+		Message:         ready.Message,
+		Target:          target,
+		CurrentJob:      migrator.Status.CurrentJob,
+		LastAttemptTime: migrator.Status.LastAttemptTime,
+		LastSuccess:     ready.LastSuccess,
+		BlockedPods:     migrator.Status.BlockedPods,
+	}
+}
+
+// ListBlockedPods finds the pods currently held back by a Migrator's waiter, oldest first.
+func ListBlockedPods(ctx context.Context, c client.Client, migrator *migrationsv1.Migrator) ([]BlockedPod, error) {
+	pods := &corev1.PodList{}
+	err := c.List(ctx, pods, client.InNamespace(migrator.Namespace))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing pods in namespace %s", migrator.Namespace)
+	}
+	return blockedPods(migrator, pods.Items), nil
+}
+
+// blockedPods picks out the pods held back by a Migrator's waiter from all the pods in its namespace.
+func blockedPods(migrator *migrationsv1.Migrator, pods []corev1.Pod) []BlockedPod {
+	waiterName := webhook.WAITER_PREFIX + migrator.Name
+	items := []BlockedPod{}
+	for i := range pods {
+		pod := &pods[i]
+		if !webhook.IsBlocked(pod, migrator.Name) {
+			continue
+		}
+		image := webhook.TargetImage(migrator, pod)
+		ready := ReadyStatus(migrator, image)
+		blocked := BlockedPod{
+			Name:              pod.Name,
+			CreationTimestamp: pod.CreationTimestamp,
+			TargetImage:       image,
+			State:             ready.State,
+			Message:           ready.Message,
+		}
+		for _, status := range pod.Status.InitContainerStatuses {
+			if status.Name == waiterName {
+				blocked.WaiterRestarts = status.RestartCount
+				if status.LastTerminationState.Terminated != nil {
+					blocked.WaiterMessage = status.LastTerminationState.Terminated.Message
+				}
+			}
+		}
+		items = append(items, blocked)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].CreationTimestamp.Equal(&items[j].CreationTimestamp) {
+			return items[i].CreationTimestamp.Before(&items[j].CreationTimestamp)
+		}
+		return items[i].Name < items[j].Name
+	})
+	return items
+}
+
+// ExplainPod works out why a pod was or wasn't gated, following the same rules as the injector webhook.
+// This uses the Migrators as they are now, which may not be how they were when the pod was created.
+func ExplainPod(ctx context.Context, c client.Client, namespace, name string) (*PodExplanation, error) {
+	pod := &corev1.Pod{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, pod)
+	if kerrors.IsNotFound(err) {
+		return nil, notFoundError{errors.Errorf("Pod %s/%s does not exist", namespace, name)}
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "error getting Pod %s/%s", namespace, name)
+	}
+	migrators := &migrationsv1.MigratorList{}
+	err = c.List(ctx, migrators, client.InNamespace(namespace))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing Migrators in namespace %s", namespace)
+	}
+
+	exp := &PodExplanation{APIVersion: READY_API_VERSION, Namespace: namespace, Name: name, Migrators: []MigratorMatch{}}
+	podLabels := labels.Set(pod.Labels)
+	known := map[string]bool{}
+	var matched, waiting []string
+	for i := range migrators.Items {
+		m := &migrators.Items[i]
+		known[m.Name] = true
+		match := MigratorMatch{Name: m.Name}
+		selector, err := metav1.LabelSelectorAsSelector(m.Spec.Selector)
+		switch {
+		case err != nil:
+			match.Reason = "InvalidSelector"
+			match.Message = fmt.Sprintf("Migrator has an invalid selector: %v", err)
+		case selector.Empty():
+			match.Reason = "EmptySelector"
+			match.Message = "Migrator has no selector, so it matches no pods"
+		case !selector.Matches(podLabels):
+			match.Reason = "SelectorMismatch"
+			match.Message = fmt.Sprintf("Pod labels don't match the selector %s", selector)
+		default:
+			matched = append(matched, m.Name)
+			match.Matches = true
+			match.WaiterInjected, match.WaiterDone = webhook.WaiterStatus(pod, m.Name)
+			match.TargetImage = webhook.TargetImage(m, pod)
+			ready := ReadyStatus(m, match.TargetImage)
+			match.State = ready.State
+			switch {
+			case !match.WaiterInjected:
+				match.Reason = "WaiterMissing"
+				match.Message = "Pod matches but has no waiter, it was probably created before the Migrator or while the webhook was unavailable"
+			case match.WaiterDone:
+				match.Reason = "WaiterFinished"
+				match.Message = fmt.Sprintf("Waiter finished, migrations for %s were ready", match.TargetImage)
+			default:
+				waiting = append(waiting, m.Name)
+				match.Reason = "Waiting"
+				match.Message = fmt.Sprintf("Waiting for migrations for %s: %s", match.TargetImage, ready.Message)
+			}
+		}
+		exp.Migrators = append(exp.Migrators, match)
+	}
+	// Waiters can outlive their Migrator, in which case they wait for it to come back.
+	for _, container := range pod.Spec.InitContainers {
+		if !strings.HasPrefix(container.Name, webhook.WAITER_PREFIX) {
+			continue
+		}
+		migratorName := strings.TrimPrefix(container.Name, webhook.WAITER_PREFIX)
+		if known[migratorName] {
+			continue
+		}
+		match := MigratorMatch{Name: migratorName, WaiterInjected: true, State: ReadyStateNotFound, Reason: "MigratorMissing"}
+		_, match.WaiterDone = webhook.WaiterStatus(pod, migratorName)
+		if match.WaiterDone {
+			match.Message = "Waiter finished, but the Migrator has since been deleted"
+		} else {
+			waiting = append(waiting, migratorName)
+			match.Message = "Waiter is waiting for a Migrator which doesn't exist"
+		}
+		exp.Migrators = append(exp.Migrators, match)
+	}
+
+	for _, match := range exp.Migrators {
+		if match.WaiterInjected {
+			exp.Gated = true
+		}
+	}
+	switch {
+	case pod.Annotations[webhook.NOWAIT_MIGRATOR_ANNOTATION] == "true" && !exp.Gated:
+		exp.Reason = "NoWaitAnnotation"
+		exp.Message = fmt.Sprintf("Pod has the %s annotation, so no waiters were injected", webhook.NOWAIT_MIGRATOR_ANNOTATION)
+	case len(waiting) != 0:
+		exp.Reason = "Blocked"
+		exp.Message = fmt.Sprintf("Pod is waiting for migrations from %s", strings.Join(waiting, ", "))
+	case exp.Gated:
+		exp.Reason = "Released"
+		exp.Message = "All of the pod's waiters have finished"
+	case len(matched) != 0:
+		exp.Reason = "WaiterMissing"
+		exp.Message = fmt.Sprintf("Pod matches %s but no waiters were injected", strings.Join(matched, ", "))
+	default:
+		exp.Reason = "NoMatchingMigrators"
+		exp.Message = fmt.Sprintf("No Migrators in namespace %s match the pod", namespace)
+	}
+	return exp, nil
+}
+
+// openAPIHandler serves the OpenAPI document for the API.
+type openAPIHandler struct{}
+
+func (_ *openAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, err := w.Write(openAPIDocument)
+	if err != nil {
+		log.Error(err, "error writing OpenAPI document")
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, err error) {
+	resp := &ErrorResponse{APIVersion: READY_API_VERSION, Reason: "InternalError", Message: err.Error()}
+	code := http.StatusInternalServerError
+	switch e := err.(type) {
+	case *authError:
+		code = e.code
+		resp.Reason = http.StatusText(code)
+	case notFoundError:
+		code = http.StatusNotFound
+		resp.Reason = "NotFound"
+	case badRequestError:
+		code = http.StatusBadRequest
+		resp.Reason = "BadRequest"
+	}
+	writeJSON(w, code, resp)
+}
+
+func writeJSON(w http.ResponseWriter, code int, resp interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Error(err, "error writing API response")
+	}
+}
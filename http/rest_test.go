@@ -0,0 +1,252 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/coderanger/controller-utils/conditions"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/webhook"
+)
+
+var _ = Describe("REST API", func() {
+	var objs []runtime.Object
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		objs = []runtime.Object{
+			&migrationsv1.Migrator{
+				ObjectMeta: metav1.ObjectMeta{Name: "testing", Namespace: "default"},
+				Spec: migrationsv1.MigratorSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "testing"}},
+				},
+				Status: migrationsv1.MigratorStatus{
+					CurrentTarget: "myapp:v2",
+					CurrentJob:    "testing-migrations",
+					BlockedPods:   1,
+					History: []migrationsv1.MigrationRecord{
+						{Image: "myapp:v1", Result: migrationsv1.MigrationResultSucceeded, JobName: "testing-migrations"},
+					},
+					Conditions: []conditions.Condition{
+						{Type: migrationsv1.ConditionMigrationsReady, Status: metav1.ConditionFalse, Reason: migrationsv1.ReasonMigrationsRunning, Message: "Started migration job"},
+					},
+				},
+			},
+			&migrationsv1.Migrator{
+				ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"},
+				Spec: migrationsv1.MigratorSpec{
+					Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "other"}},
+				},
+				Status: migrationsv1.MigratorStatus{
+					History: []migrationsv1.MigrationRecord{
+						{Image: "other:v1", Result: migrationsv1.MigrationResultFailed, JobName: "other-migrations"},
+					},
+				},
+			},
+			&migrationsv1.Migrator{
+				ObjectMeta: metav1.ObjectMeta{Name: "elsewhere", Namespace: "kube-public"},
+			},
+		}
+		server = nil
+	})
+
+	AfterEach(func() {
+		if server != nil {
+			server.Close()
+		}
+	})
+
+	waitingPod := func(name string, labels map[string]string, created time.Time) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", Labels: labels, CreationTimestamp: metav1.NewTime(created)},
+			Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: webhook.WAITER_PREFIX + "testing", Image: "waiter"}},
+				Containers:     []corev1.Container{{Name: "main", Image: "myapp:v2"}},
+			},
+			Status: corev1.PodStatus{
+				Phase: corev1.PodPending,
+				InitContainerStatuses: []corev1.ContainerStatus{{
+					Name:                 webhook.WAITER_PREFIX + "testing",
+					RestartCount:         1,
+					State:                corev1.ContainerState{Running: &corev1.ContainerStateRunning{}},
+					LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 1, Message: "Timed out"}},
+				}},
+			},
+		}
+	}
+
+	get := func(path string, resp interface{}) int {
+		if server == nil {
+			scheme := runtime.NewScheme()
+			Expect(clientgoscheme.AddToScheme(scheme)).To(Succeed())
+			Expect(migrationsv1.AddToScheme(scheme)).To(Succeed())
+			c := fake.NewClientBuilder().WithScheme(scheme).WithRuntimeObjects(objs...).Build()
+			mux := http.NewServeMux()
+			mux.Handle("/api/v1/openapi.json", &openAPIHandler{})
+			mux.Handle("/api/v1/", &restHandler{client: c})
+			server = httptest.NewServer(mux)
+		}
+		httpResp, err := http.Get(server.URL + path)
+		Expect(err).ToNot(HaveOccurred())
+		defer httpResp.Body.Close()
+		Expect(httpResp.Header.Get("Content-Type")).To(Equal("application/json"))
+		Expect(json.NewDecoder(httpResp.Body).Decode(resp)).To(Succeed())
+		return httpResp.StatusCode
+	}
+
+	It("lists Migrators in all namespaces", func() {
+		list := &MigratorList{}
+		Expect(get("/api/v1/migrators", list)).To(Equal(200))
+		Expect(list.Items).To(HaveLen(3))
+		Expect(list.Items[0].Namespace).To(Equal("default"))
+		Expect(list.Items[0].Name).To(Equal("other"))
+		Expect(list.Items[2].Namespace).To(Equal("kube-public"))
+	})
+
+	It("lists Migrators in a namespace with their state", func() {
+		list := &MigratorList{}
+		Expect(get("/api/v1/namespaces/default/migrators", list)).To(Equal(200))
+		Expect(list.Items).To(HaveLen(2))
+		Expect(list.Items[0].State).To(Equal(ReadyStateFailed))
+		Expect(list.Items[0].Target).To(Equal("other:v1"))
+		Expect(list.Items[1].State).To(Equal(ReadyStateRunning))
+		Expect(list.Items[1].Target).To(Equal("myapp:v2"))
+		Expect(list.Items[1].CurrentJob).To(Equal("testing-migrations"))
+		Expect(list.Items[1].BlockedPods).To(Equal(int32(1)))
+		Expect(list.Items[1].LastSuccess.Image).To(Equal("myapp:v1"))
+	})
+
+	It("says when nothing has run yet", func() {
+		list := &MigratorList{}
+		Expect(get("/api/v1/namespaces/kube-public/migrators", list)).To(Equal(200))
+		Expect(list.Items[0].State).To(Equal(ReadyStatePending))
+		Expect(list.Items[0].Message).To(Equal("No migration jobs have run yet"))
+	})
+
+	It("gets a Migrator with its history", func() {
+		detail := &MigratorDetail{}
+		Expect(get("/api/v1/namespaces/default/migrators/testing", detail)).To(Equal(200))
+		Expect(detail.APIVersion).To(Equal("v1"))
+		Expect(detail.Name).To(Equal("testing"))
+		Expect(detail.State).To(Equal(ReadyStateRunning))
+		Expect(detail.History).To(HaveLen(1))
+		Expect(detail.History[0].Image).To(Equal("myapp:v1"))
+	})
+
+	It("returns 404 for a missing Migrator", func() {
+		errResp := &ErrorResponse{}
+		Expect(get("/api/v1/namespaces/default/migrators/missing", errResp)).To(Equal(404))
+		Expect(errResp.Reason).To(Equal("NotFound"))
+		Expect(errResp.Message).To(Equal("Migrator default/missing does not exist"))
+	})
+
+	It("returns 404 for an unknown path", func() {
+		Expect(get("/api/v1/namespaces/default/widgets", &ErrorResponse{})).To(Equal(404))
+	})
+
+	It("lists blocked pods", func() {
+		now := time.Now()
+		objs = append(objs,
+			waitingPod("newer", map[string]string{"app": "testing"}, now),
+			waitingPod("older", map[string]string{"app": "testing"}, now.Add(-time.Minute)),
+		)
+		done := waitingPod("done", map[string]string{"app": "testing"}, now)
+		done.Status.InitContainerStatuses[0].State = corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: 0}}
+		objs = append(objs, done)
+
+		list := &BlockedPodList{}
+		Expect(get("/api/v1/namespaces/default/migrators/testing/pods", list)).To(Equal(200))
+		Expect(list.Migrator).To(Equal("testing"))
+		Expect(list.Items).To(HaveLen(2))
+		Expect(list.Items[0].Name).To(Equal("older"))
+		Expect(list.Items[0].TargetImage).To(Equal("myapp:v2"))
+		Expect(list.Items[0].State).To(Equal(ReadyStateRunning))
+		Expect(list.Items[0].WaiterRestarts).To(Equal(int32(1)))
+		Expect(list.Items[0].WaiterMessage).To(Equal("Timed out"))
+		Expect(list.Items[1].Name).To(Equal("newer"))
+	})
+
+	It("explains a blocked pod", func() {
+		objs = append(objs, waitingPod("web", map[string]string{"app": "testing"}, time.Now()))
+		exp := &PodExplanation{}
+		Expect(get("/api/v1/namespaces/default/pods/web/explain", exp)).To(Equal(200))
+		Expect(exp.Gated).To(BeTrue())
+		Expect(exp.Reason).To(Equal("Blocked"))
+		Expect(exp.Migrators).To(HaveLen(2))
+		Expect(exp.Migrators[0].Name).To(Equal("other"))
+		Expect(exp.Migrators[0].Reason).To(Equal("SelectorMismatch"))
+		Expect(exp.Migrators[1].Name).To(Equal("testing"))
+		Expect(exp.Migrators[1].Reason).To(Equal("Waiting"))
+		Expect(exp.Migrators[1].TargetImage).To(Equal("myapp:v2"))
+		Expect(exp.Migrators[1].State).To(Equal(ReadyStateRunning))
+	})
+
+	It("explains a pod created before its Migrator", func() {
+		pod := waitingPod("web", map[string]string{"app": "other"}, time.Now())
+		pod.Spec.InitContainers = nil
+		pod.Status.InitContainerStatuses = nil
+		objs = append(objs, pod)
+		exp := &PodExplanation{}
+		Expect(get("/api/v1/namespaces/default/pods/web/explain", exp)).To(Equal(200))
+		Expect(exp.Gated).To(BeFalse())
+		Expect(exp.Reason).To(Equal("WaiterMissing"))
+	})
+
+	It("explains a pod with the no-wait annotation", func() {
+		pod := waitingPod("web", map[string]string{"app": "testing"}, time.Now())
+		pod.Annotations = map[string]string{webhook.NOWAIT_MIGRATOR_ANNOTATION: "true"}
+		pod.Spec.InitContainers = nil
+		pod.Status.InitContainerStatuses = nil
+		objs = append(objs, pod)
+		exp := &PodExplanation{}
+		Expect(get("/api/v1/namespaces/default/pods/web/explain", exp)).To(Equal(200))
+		Expect(exp.Gated).To(BeFalse())
+		Expect(exp.Reason).To(Equal("NoWaitAnnotation"))
+	})
+
+	It("explains a waiter whose Migrator is gone", func() {
+		pod := waitingPod("web", map[string]string{"app": "web"}, time.Now())
+		pod.Spec.InitContainers[0].Name = webhook.WAITER_PREFIX + "deleted"
+		pod.Status.InitContainerStatuses[0].Name = webhook.WAITER_PREFIX + "deleted"
+		objs = append(objs, pod)
+		exp := &PodExplanation{}
+		Expect(get("/api/v1/namespaces/default/pods/web/explain", exp)).To(Equal(200))
+		Expect(exp.Gated).To(BeTrue())
+		Expect(exp.Reason).To(Equal("Blocked"))
+		Expect(exp.Migrators[2].Name).To(Equal("deleted"))
+		Expect(exp.Migrators[2].Reason).To(Equal("MigratorMissing"))
+	})
+
+	It("serves the OpenAPI document", func() {
+		doc := map[string]interface{}{}
+		Expect(get("/api/v1/openapi.json", &doc)).To(Equal(200))
+		Expect(doc).To(HaveKeyWithValue("openapi", "3.0.3"))
+		Expect(doc["paths"]).To(HaveKey("/api/v1/namespaces/{namespace}/pods/{name}/explain"))
+	})
+})
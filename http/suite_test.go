@@ -29,7 +29,7 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 )
 
 var suiteHelper *cu.FunctionalSuiteHelper
@@ -50,10 +50,12 @@ var _ = BeforeSuite(func(done Done) {
 	port := 40000 + rand.Intn(10000)
 	os.Setenv("API_LISTEN", fmt.Sprintf("localhost:%d", port))
 	url = fmt.Sprintf("http://localhost:%d/", port)
+	// Most tests don't send tokens, the auth tests turn this back on.
+	os.Setenv("API_AUTH", string(AuthModeDisabled))
 
 	By("bootstrapping test environment")
 	suiteHelper = cu.Functional().
-		API(migrationsv1beta1.AddToScheme).
+		API(migrationsv1.AddToScheme).
 		MustBuild()
 
 	close(done)
@@ -0,0 +1,144 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cu "github.com/coderanger/controller-utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeSelfSignedCert generates a self-signed certificate for localhost into dir, returning the PEM-encoded
+// certificate.
+func writeSelfSignedCert(dir string, serial int64) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	Expect(os.WriteFile(filepath.Join(dir, "tls.key"), keyPEM, 0600)).To(Succeed())
+	Expect(os.WriteFile(filepath.Join(dir, "tls.crt"), certPEM, 0600)).To(Succeed())
+	return certPEM
+}
+
+var _ = Describe("API server TLS", func() {
+	var helper *cu.FunctionalHelper
+	var certDir string
+	var certPEM []byte
+	var httpsUrl string
+
+	BeforeEach(func() {
+		var err error
+		certDir, err = os.MkdirTemp("", "migrations-operator-tls")
+		Expect(err).ToNot(HaveOccurred())
+		certPEM = writeSelfSignedCert(certDir, 1)
+		os.Setenv("API_CERT_DIR", certDir)
+		httpsUrl = strings.Replace(url, "http://", "https://", 1)
+		helper = suiteHelper.MustStart(APIServer)
+	})
+
+	AfterEach(func() {
+		helper.MustStop()
+		helper = nil
+		os.Unsetenv("API_CERT_DIR")
+		os.RemoveAll(certDir)
+	})
+
+	clientFor := func(caPEM []byte) *http.Client {
+		pool := x509.NewCertPool()
+		Expect(pool.AppendCertsFromPEM(caPEM)).To(BeTrue())
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	}
+
+	post := func(c *http.Client) (*http.Response, error) {
+		args := &ReadyArgs{TargetImage: "myapp:latest", MigratorNamespace: helper.Namespace, MigratorName: "other"}
+		data, err := json.Marshal(args)
+		Expect(err).ToNot(HaveOccurred())
+		return c.Post(httpsUrl+"api/v1/ready", "application/json", bytes.NewBuffer(data))
+	}
+
+	It("serves HTTPS with the mounted certificate", func() {
+		var resp *http.Response
+		Eventually(func() error {
+			var err error
+			resp, err = post(clientFor(certPEM))
+			return err
+		}).Should(Succeed())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(404))
+	})
+
+	It("rejects clients which don't trust the certificate", func() {
+		other, err := os.MkdirTemp("", "migrations-operator-tls")
+		Expect(err).ToNot(HaveOccurred())
+		defer os.RemoveAll(other)
+		otherPEM := writeSelfSignedCert(other, 2)
+		Eventually(func() error {
+			_, err := post(clientFor(certPEM))
+			return err
+		}).Should(Succeed())
+		_, err = post(clientFor(otherPEM))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("reloads a rotated certificate", func() {
+		Eventually(func() error {
+			_, err := post(clientFor(certPEM))
+			return err
+		}).Should(Succeed())
+		newPEM := writeSelfSignedCert(certDir, 3)
+		Eventually(func() error {
+			resp, err := post(clientFor(newPEM))
+			if err == nil {
+				resp.Body.Close()
+			}
+			return err
+		}, 10*time.Second).Should(Succeed())
+	})
+})
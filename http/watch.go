@@ -0,0 +1,116 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+	toolscache "k8s.io/client-go/tools/cache"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+// migratorWatcher tracks changes to Migrators from the manager's informer, so long-polling requests can
+// wait for a change without repeatedly getting the object.
+type migratorWatcher struct {
+	mu sync.Mutex
+	// watches only holds Migrators someone is waiting on, so asking about any number of names can't grow it.
+	watches map[string]*migratorWatch
+	// anyChannel is closed on a change to any Migrator.
+	anyChannel chan struct{}
+	// generation counts changes to any Migrator.
+	generation uint64
+}
+
+// migratorWatch is the channel for the next change to one Migrator, and how many requests are waiting on it.
+type migratorWatch struct {
+	channel chan struct{}
+	waiters int
+}
+
+func newMigratorWatcher(mgr ctrl.Manager) (*migratorWatcher, error) {
+	w := &migratorWatcher{watches: map[string]*migratorWatch{}}
+	informer, err := mgr.GetCache().GetInformer(context.Background(), &migrationsv1.Migrator{})
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting Migrator informer")
+	}
+	informer.AddEventHandler(toolscache.ResourceEventHandlerFuncs{
+		AddFunc:    w.notify,
+		UpdateFunc: func(_, obj interface{}) { w.notify(obj) },
+		DeleteFunc: w.notify,
+	})
+	return w, nil
+}
+
+// changed returns a channel which is closed the next time the named Migrator changes, and a function to call
+// exactly once when done waiting on it. Get the channel before reading the Migrator so a change in between
+// isn't missed.
+func (w *migratorWatcher) changed(namespace, name string) (<-chan struct{}, func()) {
+	key := namespace + "/" + name
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	watch, ok := w.watches[key]
+	if !ok {
+		watch = &migratorWatch{channel: make(chan struct{})}
+		w.watches[key] = watch
+	}
+	watch.waiters++
+	release := func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		watch.waiters--
+		// The watch is gone already if the Migrator changed.
+		if watch.waiters == 0 && w.watches[key] == watch {
+			delete(w.watches, key)
+		}
+	}
+	return watch.channel, release
+}
+
+// anyChanged returns a channel which is closed the next time any Migrator changes, and the current
+// generation, which goes up with each change.
+func (w *migratorWatcher) anyChanged() (<-chan struct{}, uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.anyChannel == nil {
+		w.anyChannel = make(chan struct{})
+	}
+	return w.anyChannel, w.generation
+}
+
+func (w *migratorWatcher) notify(obj interface{}) {
+	key, err := toolscache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		log.Error(err, "error getting key for Migrator")
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.generation++
+	watch, ok := w.watches[key]
+	if ok {
+		close(watch.channel)
+		delete(w.watches, key)
+	}
+	if w.anyChannel != nil {
+		close(w.anyChannel)
+		w.anyChannel = nil
+	}
+}
@@ -0,0 +1,61 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package http
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+var _ = Describe("migratorWatcher", func() {
+	var watcher *migratorWatcher
+
+	BeforeEach(func() {
+		watcher = &migratorWatcher{watches: map[string]*migratorWatch{}}
+	})
+
+	It("forgets a Migrator once nobody is waiting on it", func() {
+		_, release1 := watcher.changed("default", "testing")
+		_, release2 := watcher.changed("default", "testing")
+		Expect(watcher.watches).To(HaveLen(1))
+		release1()
+		Expect(watcher.watches).To(HaveLen(1))
+		release2()
+		Expect(watcher.watches).To(BeEmpty())
+	})
+
+	It("closes the channel when the Migrator changes", func() {
+		changed, release := watcher.changed("default", "testing")
+		anyChanged, generation := watcher.anyChanged()
+		watcher.notify(&migrationsv1.Migrator{ObjectMeta: metav1.ObjectMeta{Name: "testing", Namespace: "default"}})
+		Expect(changed).To(BeClosed())
+		Expect(anyChanged).To(BeClosed())
+		Expect(watcher.watches).To(BeEmpty())
+		_, newGeneration := watcher.anyChanged()
+		Expect(newGeneration).To(Equal(generation + 1))
+
+		// A new waiter gets a new channel, which the old one releasing doesn't touch.
+		_, release2 := watcher.changed("default", "testing")
+		release()
+		Expect(watcher.watches).To(HaveLen(1))
+		release2()
+		Expect(watcher.watches).To(BeEmpty())
+	})
+})
@@ -31,7 +31,7 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/intstr"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 	"github.com/coderanger/migrations-operator/controllers"
 	"github.com/coderanger/migrations-operator/http"
 	"github.com/coderanger/migrations-operator/webhook"
@@ -52,6 +52,8 @@ var _ = Describe("Integration", func() {
 		helper = suiteHelper.MustStart(
 			controllers.Migrator,
 			webhook.InitInjector,
+			webhook.MigratorDefaulter,
+			webhook.MigratorValidator,
 			http.APIServer,
 		)
 	})
@@ -113,15 +115,17 @@ var _ = Describe("Integration", func() {
 		}
 		c.Create(postgresService)
 
-		migrator := &migrationsv1beta1.Migrator{
+		migrator := &migrationsv1.Migrator{
 			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
-			Spec: migrationsv1beta1.MigratorSpec{
+			Spec: migrationsv1.MigratorSpec{
 				Selector: &metav1.LabelSelector{
 					MatchLabels: map[string]string{
 						"app": "testing",
 					},
 				},
-				Command: &[]string{"python", "manage.py", "migrate"},
+				Job: migrationsv1.MigrationJobSpec{
+					Command: []string{"python", "manage.py", "migrate"},
+				},
 			},
 		}
 		c.Create(migrator)
@@ -27,7 +27,7 @@ import (
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 )
 
 var suiteHelper *cu.FunctionalSuiteHelper
@@ -54,7 +54,7 @@ var _ = BeforeSuite(func(done Done) {
 
 	By("bootstrapping test environment")
 	suiteHelper = cu.Functional().
-		API(migrationsv1beta1.AddToScheme).
+		API(migrationsv1.AddToScheme).
 		UseExistingCluster(os.Getenv("INTEGRATION_EXTERNAL_NAME")).
 		MustBuild()
 
@@ -22,12 +22,14 @@ import (
 	"reflect"
 	goruntime "runtime"
 
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
 	"github.com/coderanger/migrations-operator/controllers"
 	"github.com/coderanger/migrations-operator/http"
@@ -45,6 +47,8 @@ func init() {
 	_ = clientgoscheme.AddToScheme(scheme)
 
 	_ = argoprojstubv1alpha1.AddToScheme(scheme)
+	_ = apiextensionsv1.AddToScheme(scheme)
+	_ = migrationsv1.AddToScheme(scheme)
 	_ = migrationsv1beta1.AddToScheme(scheme)
 	// +kubebuilder:scaffold:scheme
 }
@@ -74,7 +78,11 @@ func main() {
 
 	controllers := []func(ctrl.Manager) error{
 		controllers.Migrator,
+		controllers.StorageVersionMigrator,
 		webhook.InitInjector,
+		webhook.MigratorConversion,
+		webhook.MigratorDefaulter,
+		webhook.MigratorValidator,
 		http.APIServer,
 	}
 
@@ -18,28 +18,38 @@ package utils
 
 import (
 	"context"
+	"regexp"
+	"strings"
 
 	"github.com/pkg/errors"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 )
 
-func ListMatchingMigrators(ctx context.Context, c client.Client, pod metav1.Object) ([]*migrationsv1beta1.Migrator, error) {
+// The name of the container running the migrations in a migration Job.
+const MIGRATION_CONTAINER = "migrations"
+
+// The namespace annotation setting the waiter mode for Migrators which don't set one themselves.
+const WAITER_MODE_ANNOTATION = "migrations.coderanger.net/waiter-mode"
+
+func ListMatchingMigrators(ctx context.Context, c client.Client, pod metav1.Object) ([]*migrationsv1.Migrator, error) {
 	// Find any Migrator objects that match this pod.
-	allMigrators := &migrationsv1beta1.MigratorList{}
+	allMigrators := &migrationsv1.MigratorList{}
 	err := c.List(ctx, allMigrators, &client.ListOptions{Namespace: pod.GetNamespace()})
 	if err != nil {
 		return nil, errors.Wrapf(err, "error listing migrators in %s", pod.GetNamespace())
 	}
-	migrators := []*migrationsv1beta1.Migrator{}
+	migrators := []*migrationsv1.Migrator{}
 	podLabels := labels.Set(pod.GetLabels())
 	for _, m := range allMigrators.Items {
+		// Invalid and empty selectors are rejected by the validating webhook, this only skips objects which
+		// were created before it was installed.
 		selector, err := metav1.LabelSelectorAsSelector(m.Spec.Selector)
-		if err != nil {
-			// Ignore this migrator. Maybe print a warning in the future? This should probably be handled via a validator on Migrator.
+		if err != nil || selector.Empty() {
 			continue
 		}
 		if selector.Matches(podLabels) {
@@ -49,3 +59,68 @@ func ListMatchingMigrators(ctx context.Context, c client.Client, pod metav1.Obje
 	}
 	return migrators, nil
 }
+
+// FindContainer looks up a container by name in a pod spec, checking the normal containers first and
+// then the init containers. Returns nil if no container matches.
+func FindContainer(spec *corev1.PodSpec, name string) *corev1.Container {
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == name {
+			return &spec.Containers[i]
+		}
+	}
+	for i := range spec.InitContainers {
+		if spec.InitContainers[i].Name == name {
+			return &spec.InitContainers[i]
+		}
+	}
+	return nil
+}
+
+// WaiterMode finds the waiter mode for a Migrator. The Migrator's own setting wins, then the annotation on
+// its namespace, and otherwise waiters use the operator's API. The namespace can be nil if it isn't known.
+func WaiterMode(m *migrationsv1.Migrator, namespace *corev1.Namespace) migrationsv1.WaiterMode {
+	if m.Spec.Waiter.Mode != "" {
+		return m.Spec.Waiter.Mode
+	}
+	if namespace != nil && strings.EqualFold(namespace.Annotations[WAITER_MODE_ANNOTATION], string(migrationsv1.WaiterModeDirect)) {
+		return migrationsv1.WaiterModeDirect
+	}
+	return migrationsv1.WaiterModeAPI
+}
+
+// MatchesAny checks if a string matches any of the given glob patterns. A * matches any sequence of
+// characters, including slashes, and ? matches any single character.
+func MatchesAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if globToRegexp(pattern).MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesFilter checks a string against include and exclude glob patterns. If include is empty, everything
+// not excluded matches.
+func MatchesFilter(include, exclude []string, s string) bool {
+	if len(include) != 0 && !MatchesAny(include, s) {
+		return false
+	}
+	return !MatchesAny(exclude, s)
+}
+
+func globToRegexp(pattern string) *regexp.Regexp {
+	quoted := regexp.QuoteMeta(pattern)
+	quoted = strings.ReplaceAll(quoted, `\*`, ".*")
+	quoted = strings.ReplaceAll(quoted, `\?`, ".")
+	return regexp.MustCompile("^" + quoted + "$")
+}
+
+// NewerPod reports if a was created after b, by name if they were created at the same time. Using the newest
+// matching pod as the template follows a rollout to its new revision when the template comes from the pod
+// itself, and always picking the same one keeps the migration Job from changing with the cache's list order.
+func NewerPod(a, b *corev1.Pod) bool {
+	if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+		return b.CreationTimestamp.Before(&a.CreationTimestamp)
+	}
+	return a.Name < b.Name
+}
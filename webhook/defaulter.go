@@ -0,0 +1,172 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/pkg/errors"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/utils"
+)
+
+// The annotation kubectl uses to pick a pod's default container.
+const DEFAULT_CONTAINER_ANNOTATION = "kubectl.kubernetes.io/default-container"
+
+// +kubebuilder:webhook:path=/mutate-migrations-coderanger-net-v1-migrator,mutating=true,failurePolicy=fail,sideEffects=None,groups=migrations.coderanger.net,resources=migrators,verbs=create;update,versions=v1,name=mmigrator.migrations.coderanger.net,admissionReviewVersions=v1
+
+// migratorDefaulter fills in defaults for Migrator objects.
+type migratorDefaulter struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+func MigratorDefaulter(mgr ctrl.Manager) error {
+	hookServer := mgr.GetWebhookServer()
+	hookServer.Register("/mutate-migrations-coderanger-net-v1-migrator", &webhook.Admission{Handler: &migratorDefaulter{Client: mgr.GetClient()}})
+	return nil
+}
+
+// migratorDefaulter writes the effective configuration into the Migrator spec.
+func (hook *migratorDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	resp, err := hook.handleInner(ctx, req)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return *resp
+}
+
+func (hook *migratorDefaulter) handleInner(ctx context.Context, req admission.Request) (*admission.Response, error) {
+	migrator := &migrationsv1.Migrator{}
+	err := hook.decoder.Decode(req, migrator)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding request")
+	}
+	if migrator.Namespace == "" {
+		migrator.Namespace = req.Namespace
+	}
+
+	// Leave updates which don't touch the spec alone, otherwise the operator's own metadata updates would
+	// change the spec of objects created before this webhook.
+	if req.Operation == admissionv1.Update {
+		oldMigrator := &migrationsv1.Migrator{}
+		err = hook.decoder.DecodeRaw(req.OldObject, oldMigrator)
+		if err != nil {
+			return nil, errors.Wrap(err, "error decoding old object")
+		}
+		if equality.Semantic.DeepEqual(migrator.Spec, oldMigrator.Spec) {
+			resp := admission.Allowed("spec unchanged")
+			return &resp, nil
+		}
+	}
+
+	migrator.Default()
+
+	// Fill in the container from the template pod, if there is one yet. Resources are left unset so they
+	// follow the template container's as it changes, rather than whatever it had at admission.
+	if migrator.Spec.Container == "" {
+		templatePod, err := hook.findTemplatePod(ctx, migrator)
+		if err != nil {
+			return nil, err
+		}
+		if templatePod != nil {
+			container := defaultContainer(templatePod, migrator.Spec.Container)
+			if container != nil {
+				migrator.Spec.Container = container.Name
+			}
+		}
+	}
+
+	marshaled, err := json.Marshal(migrator)
+	if err != nil {
+		return nil, errors.Wrap(err, "error encoding defaulted migrator")
+	}
+	resp := admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+	return &resp, nil
+}
+
+// findTemplatePod finds the pod the controller would currently use as a template. Invalid selectors are
+// left for the validating webhook to reject.
+func (hook *migratorDefaulter) findTemplatePod(ctx context.Context, migrator *migrationsv1.Migrator) (*corev1.Pod, error) {
+	if migrator.Spec.Selector == nil || migrator.Spec.TemplateSelector == nil {
+		return nil, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(migrator.Spec.Selector)
+	if err != nil || selector.Empty() {
+		return nil, nil
+	}
+	templateSelector, err := metav1.LabelSelectorAsSelector(migrator.Spec.TemplateSelector)
+	if err != nil {
+		return nil, nil
+	}
+
+	pods := &corev1.PodList{}
+	err = hook.Client.List(ctx, pods, &client.ListOptions{Namespace: migrator.Namespace})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing pods in namespace %s", migrator.Namespace)
+	}
+	var templatePod *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		labelSet := labels.Set(pod.Labels)
+		if pod.Labels["migrations"] == migrator.Name {
+			continue
+		}
+		if selector.Matches(labelSet) && templateSelector.Matches(labelSet) && (templatePod == nil || utils.NewerPod(pod, templatePod)) {
+			templatePod = pod
+		}
+	}
+	return templatePod, nil
+}
+
+// defaultContainer picks the named container, or the pod's default container the same way kubectl does.
+func defaultContainer(pod *corev1.Pod, name string) *corev1.Container {
+	if name == "" {
+		name = pod.Annotations[DEFAULT_CONTAINER_ANNOTATION]
+	}
+	if name != "" {
+		container := utils.FindContainer(&pod.Spec, name)
+		if container != nil {
+			return container
+		}
+	}
+	if len(pod.Spec.Containers) == 0 {
+		return nil
+	}
+	return &pod.Spec.Containers[0]
+}
+
+// migratorDefaulter implements admission.DecoderInjector.
+// A decoder will be automatically injected.
+
+// InjectDecoder injects the decoder.
+func (hook *migratorDefaulter) InjectDecoder(d *admission.Decoder) error {
+	hook.decoder = d
+	return nil
+}
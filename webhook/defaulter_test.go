@@ -0,0 +1,111 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	cu "github.com/coderanger/controller-utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+var _ = Describe("MigratorDefaulter", func() {
+	var helper *cu.FunctionalHelper
+	var migrator *migrationsv1.Migrator
+
+	BeforeEach(func() {
+		helper = suiteHelper.MustStart(MigratorDefaulter, MigratorValidator)
+		migrator = &migrationsv1.Migrator{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "testing"}},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		helper.MustStop()
+		helper = nil
+	})
+
+	It("fills in static defaults without a template pod", func() {
+		c := helper.TestClient
+		c.Create(migrator)
+
+		c.EventuallyGetName("testing", migrator)
+		Expect(migrator.Spec.TemplateSelector).To(Equal(migrator.Spec.Selector))
+		Expect(migrator.Spec.Job.Sidecars.Mode).To(Equal(migrationsv1.SidecarModeNative))
+		Expect(migrator.Spec.Job.SuccessfulJobRetention).To(Equal(migrationsv1.JobRetentionDelete))
+		Expect(migrator.Spec.Job.SpecChangePolicy).To(Equal(migrationsv1.SpecChangePolicyIgnore))
+		Expect(migrator.Spec.Waiter.FailurePolicy).To(Equal(migrationsv1.WaiterPolicyWait))
+		Expect(migrator.Spec.Waiter.MissingMigratorPolicy).To(Equal(migrationsv1.WaiterPolicyWait))
+		Expect(migrator.Spec.Container).To(Equal(""))
+		Expect(migrator.Spec.Job.Resources).To(BeNil())
+	})
+
+	It("fills in the container but not the resources from the template pod", func() {
+		c := helper.TestClient
+		resources := corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")},
+		}
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "testing",
+				Labels:      map[string]string{"app": "testing"},
+				Annotations: map[string]string{DEFAULT_CONTAINER_ANNOTATION: "main"},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "proxy", Image: "proxy"},
+					{Name: "main", Image: "fake", Resources: resources},
+				},
+			},
+		}
+		c.Create(pod)
+		c.Create(migrator)
+
+		c.EventuallyGetName("testing", migrator)
+		Expect(migrator.Spec.Container).To(Equal("main"))
+		Expect(migrator.Spec.Job.Resources).To(BeNil())
+	})
+
+	It("keeps explicit values", func() {
+		c := helper.TestClient
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing", Labels: map[string]string{"app": "testing"}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "main", Image: "fake"}},
+			},
+		}
+		c.Create(pod)
+		migrator.Spec.TemplateSelector = &metav1.LabelSelector{MatchLabels: map[string]string{"role": "web"}}
+		migrator.Spec.Job.Sidecars.Mode = migrationsv1.SidecarModeLegacy
+		migrator.Spec.Job.SuccessfulJobRetention = migrationsv1.JobRetentionKeep
+		c.Create(migrator)
+
+		c.EventuallyGetName("testing", migrator)
+		Expect(migrator.Spec.TemplateSelector.MatchLabels).To(Equal(map[string]string{"role": "web"}))
+		Expect(migrator.Spec.Job.Sidecars.Mode).To(Equal(migrationsv1.SidecarModeLegacy))
+		Expect(migrator.Spec.Job.SuccessfulJobRetention).To(Equal(migrationsv1.JobRetentionKeep))
+		// The pod doesn't match the template selector.
+		Expect(migrator.Spec.Container).To(Equal(""))
+	})
+})
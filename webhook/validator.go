@@ -0,0 +1,264 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	admissionv1 "k8s.io/api/admission/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+	"github.com/coderanger/migrations-operator/utils"
+)
+
+// +kubebuilder:webhook:path=/validate-migrations-coderanger-net-v1-migrator,mutating=false,failurePolicy=fail,sideEffects=None,groups=migrations.coderanger.net,resources=migrators,verbs=create;update,versions=v1,name=vmigrator.migrations.coderanger.net,admissionReviewVersions=v1
+
+// migratorValidator checks Migrator objects before they are admitted.
+type migratorValidator struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+func MigratorValidator(mgr ctrl.Manager) error {
+	hookServer := mgr.GetWebhookServer()
+	hookServer.Register("/validate-migrations-coderanger-net-v1-migrator", &webhook.Admission{Handler: &migratorValidator{Client: mgr.GetClient()}})
+	return nil
+}
+
+// migratorValidator rejects Migrators that can't work or would let their author escalate privileges.
+func (hook *migratorValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	resp, err := hook.handleInner(ctx, req)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return *resp
+}
+
+func (hook *migratorValidator) handleInner(ctx context.Context, req admission.Request) (*admission.Response, error) {
+	log := ctrl.Log.WithName("webhooks").WithName("MigratorValidator")
+	migrator := &migrationsv1.Migrator{}
+	err := hook.decoder.Decode(req, migrator)
+	if err != nil {
+		return nil, errors.Wrap(err, "error decoding request")
+	}
+	if migrator.Namespace == "" {
+		migrator.Namespace = req.Namespace
+	}
+
+	// Only check when the spec changes, otherwise the operator's own metadata updates would need the same
+	// access and older objects which don't pass validation could never be cleaned up.
+	specChanged := true
+	if req.Operation == admissionv1.Update {
+		oldMigrator := &migrationsv1.Migrator{}
+		err = hook.decoder.DecodeRaw(req.OldObject, oldMigrator)
+		if err != nil {
+			return nil, errors.Wrap(err, "error decoding old object")
+		}
+		specChanged = !equality.Semantic.DeepEqual(migrator.Spec, oldMigrator.Spec)
+	}
+
+	if !specChanged {
+		resp := admission.Allowed("spec unchanged")
+		return &resp, nil
+	}
+
+	// Reject anything that could never work.
+	errs := validateMigrator(migrator)
+	if len(errs) != 0 {
+		resp := admission.Denied(errs.ToAggregate().Error())
+		return &resp, nil
+	}
+
+	// The migration Job can run as any ServiceAccount in the namespace, either the template's or the
+	// one set in the spec. Kubernetes allows anyone who can create pods in a namespace to use any
+	// ServiceAccount in it, so require the same of the Migrator's author.
+	allowed, reason, err := hook.canAccess(ctx, req, &authorizationv1.ResourceAttributes{Namespace: migrator.Namespace, Verb: "create", Resource: "pods"})
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		serviceAccount := migrator.Spec.Job.ServiceAccountName
+		if serviceAccount == "" {
+			serviceAccount = "the template pod's ServiceAccount"
+		}
+		log.Info("Denying Migrator", "migrator", fmt.Sprintf("%s/%s", migrator.Namespace, migrator.Name), "user", req.UserInfo.Username, "reason", reason)
+		resp := admission.Denied(fmt.Sprintf("user %s cannot create pods in namespace %s, which is required to run migrations as %s", req.UserInfo.Username, migrator.Namespace, serviceAccount))
+		return &resp, nil
+	}
+
+	// A ServiceAccount set in the spec can be a different one to what the author's own workloads run as, so
+	// also require permission to act as that ServiceAccount specifically. The built-in edit and admin
+	// ClusterRoles allow impersonating ServiceAccounts in the namespace.
+	if serviceAccount := migrator.Spec.Job.ServiceAccountName; serviceAccount != "" {
+		allowed, reason, err = hook.canAccess(ctx, req, &authorizationv1.ResourceAttributes{Namespace: migrator.Namespace, Verb: "impersonate", Resource: "serviceaccounts", Name: serviceAccount})
+		if err != nil {
+			return nil, err
+		}
+		if !allowed {
+			log.Info("Denying Migrator", "migrator", fmt.Sprintf("%s/%s", migrator.Namespace, migrator.Name), "user", req.UserInfo.Username, "reason", reason)
+			resp := admission.Denied(fmt.Sprintf("user %s cannot impersonate ServiceAccount %s in namespace %s, which is required to run migrations as it", req.UserInfo.Username, serviceAccount, migrator.Namespace))
+			return &resp, nil
+		}
+	}
+
+	// Warn about other Migrators which might select the same pods, both will inject waiters.
+	warnings, err := hook.overlapWarnings(ctx, migrator)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := admission.Allowed("").WithWarnings(warnings...)
+	return &resp, nil
+}
+
+// validateMigrator checks the spec for values which can never work.
+func validateMigrator(migrator *migrationsv1.Migrator) field.ErrorList {
+	errs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+
+	selectorPath := specPath.Child("selector")
+	if migrator.Spec.Selector == nil || (len(migrator.Spec.Selector.MatchLabels) == 0 && len(migrator.Spec.Selector.MatchExpressions) == 0) {
+		errs = append(errs, field.Required(selectorPath, "selector must not be empty, it would match every pod in the namespace"))
+	} else if _, err := metav1.LabelSelectorAsSelector(migrator.Spec.Selector); err != nil {
+		errs = append(errs, field.Invalid(selectorPath, migrator.Spec.Selector, err.Error()))
+	}
+	if migrator.Spec.TemplateSelector != nil {
+		_, err := metav1.LabelSelectorAsSelector(migrator.Spec.TemplateSelector)
+		if err != nil {
+			errs = append(errs, field.Invalid(specPath.Child("templateSelector"), migrator.Spec.TemplateSelector, err.Error()))
+		}
+	}
+
+	errs = append(errs, validateContainerName(specPath.Child("container"), migrator.Spec.Container)...)
+	seen := map[string]bool{}
+	for i, name := range migrator.Spec.Job.Sidecars.Containers {
+		path := specPath.Child("job", "sidecars", "containers").Index(i)
+		errs = append(errs, validateContainerName(path, name)...)
+		if name == migrator.Spec.Container {
+			errs = append(errs, field.Invalid(path, name, "sidecar cannot also be the migration container"))
+		}
+		if name == utils.MIGRATION_CONTAINER {
+			errs = append(errs, field.Invalid(path, name, fmt.Sprintf("sidecar cannot be named %s", utils.MIGRATION_CONTAINER)))
+		}
+		if seen[name] {
+			errs = append(errs, field.Duplicate(path, name))
+		}
+		seen[name] = true
+	}
+	return errs
+}
+
+// validateContainerName checks a container name could exist in a template pod and wouldn't be removed.
+func validateContainerName(path *field.Path, name string) field.ErrorList {
+	errs := field.ErrorList{}
+	if name == "" {
+		return errs
+	}
+	for _, msg := range validation.IsDNS1123Label(name) {
+		errs = append(errs, field.Invalid(path, name, msg))
+	}
+	if strings.HasPrefix(name, WAITER_PREFIX) {
+		errs = append(errs, field.Invalid(path, name, "migration waiter containers are never copied to the migration job"))
+	}
+	return errs
+}
+
+// overlapWarnings lists other Migrators in the namespace which could select the same pods.
+func (hook *migratorValidator) overlapWarnings(ctx context.Context, migrator *migrationsv1.Migrator) ([]string, error) {
+	others := &migrationsv1.MigratorList{}
+	err := hook.Client.List(ctx, others, &client.ListOptions{Namespace: migrator.Namespace})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error listing migrators in %s", migrator.Namespace)
+	}
+	warnings := []string{}
+	for _, other := range others.Items {
+		if other.Name == migrator.Name || other.Spec.Selector == nil {
+			continue
+		}
+		if selectorsOverlap(migrator.Spec.Selector, other.Spec.Selector) {
+			warnings = append(warnings, fmt.Sprintf("selector may overlap with Migrator %s, pods matching both will wait for both", other.Name))
+		}
+	}
+	return warnings, nil
+}
+
+// selectorsOverlap checks if a pod could match both selectors. This only considers matchLabels, plus
+// whether each selector accepts the combined labels, so it is a best guess rather than a proof.
+func selectorsOverlap(a, b *metav1.LabelSelector) bool {
+	combined := labels.Set{}
+	for _, matchLabels := range []map[string]string{a.MatchLabels, b.MatchLabels} {
+		for k, v := range matchLabels {
+			existing, ok := combined[k]
+			if ok && existing != v {
+				return false
+			}
+			combined[k] = v
+		}
+	}
+	for _, s := range []*metav1.LabelSelector{a, b} {
+		selector, err := metav1.LabelSelectorAsSelector(s)
+		if err != nil || !selector.Matches(combined) {
+			return false
+		}
+	}
+	return true
+}
+
+// canAccess runs a SubjectAccessReview for the requesting user.
+func (hook *migratorValidator) canAccess(ctx context.Context, req admission.Request, attrs *authorizationv1.ResourceAttributes) (bool, string, error) {
+	extra := map[string]authorizationv1.ExtraValue{}
+	for k, v := range req.UserInfo.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	sar := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               req.UserInfo.Username,
+			UID:                req.UserInfo.UID,
+			Groups:             req.UserInfo.Groups,
+			Extra:              extra,
+			ResourceAttributes: attrs,
+		},
+	}
+	err := hook.Client.Create(ctx, sar)
+	if err != nil {
+		return false, "", errors.Wrap(err, "error creating SubjectAccessReview")
+	}
+	return sar.Status.Allowed, sar.Status.Reason, nil
+}
+
+// migratorValidator implements admission.DecoderInjector.
+// A decoder will be automatically injected.
+
+// InjectDecoder injects the decoder.
+func (hook *migratorValidator) InjectDecoder(d *admission.Decoder) error {
+	hook.decoder = d
+	return nil
+}
@@ -0,0 +1,224 @@
+/*
+Copyright 2020 Noah Kantrowitz
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+
+	cu "github.com/coderanger/controller-utils"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
+)
+
+var _ = Describe("MigratorValidator", func() {
+	var helper *cu.FunctionalHelper
+	var hook *migratorValidator
+	var migrator *migrationsv1.Migrator
+
+	BeforeEach(func() {
+		helper = suiteHelper.MustStart(MigratorDefaulter, MigratorValidator)
+		hook = &migratorValidator{Client: helper.UncachedClient}
+		decoder, err := admission.NewDecoder(scheme.Scheme)
+		Expect(err).ToNot(HaveOccurred())
+		hook.InjectDecoder(decoder)
+
+		migrator = &migrationsv1.Migrator{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "migrations.coderanger.net/v1", Kind: "Migrator"},
+			ObjectMeta: metav1.ObjectMeta{Name: "testing", Namespace: helper.Namespace},
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "testing"}},
+				Job:      migrationsv1.MigrationJobSpec{ServiceAccountName: "migrations"},
+			},
+		}
+	})
+
+	AfterEach(func() {
+		helper.MustStop()
+		helper = nil
+	})
+
+	request := func(op admissionv1.Operation, obj, oldObj *migrationsv1.Migrator) admission.Request {
+		raw, err := json.Marshal(obj)
+		Expect(err).ToNot(HaveOccurred())
+		req := admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Operation: op,
+			Namespace: obj.Namespace,
+			Name:      obj.Name,
+			Object:    runtime.RawExtension{Raw: raw},
+			UserInfo:  authenticationv1.UserInfo{Username: "alice", Groups: []string{"system:authenticated"}},
+		}}
+		if oldObj != nil {
+			oldRaw, err := json.Marshal(oldObj)
+			Expect(err).ToNot(HaveOccurred())
+			req.OldObject = runtime.RawExtension{Raw: oldRaw}
+		}
+		return req
+	}
+
+	allowPods := func() {
+		c := helper.TestClient
+		c.Create(&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"create"}}},
+		})
+		c.Create(&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "pods"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "Role", Name: "pods"},
+			Subjects:   []rbacv1.Subject{{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "alice"}},
+		})
+	}
+
+	allowServiceAccount := func(name string) {
+		c := helper.TestClient
+		c.Create(&rbacv1.Role{
+			ObjectMeta: metav1.ObjectMeta{Name: "serviceaccounts"},
+			Rules:      []rbacv1.PolicyRule{{APIGroups: []string{""}, Resources: []string{"serviceaccounts"}, ResourceNames: []string{name}, Verbs: []string{"impersonate"}}},
+		})
+		c.Create(&rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{Name: "serviceaccounts"},
+			RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "Role", Name: "serviceaccounts"},
+			Subjects:   []rbacv1.Subject{{APIGroup: "rbac.authorization.k8s.io", Kind: "User", Name: "alice"}},
+		})
+	}
+
+	It("denies a user who cannot create pods", func() {
+		resp := hook.Handle(context.Background(), request(admissionv1.Create, migrator, nil))
+		Expect(resp.Allowed).To(BeFalse())
+		Expect(resp.Result.Message).To(ContainSubstring("cannot create pods"))
+		Expect(resp.Result.Message).To(ContainSubstring("migrations"))
+	})
+
+	It("denies a user who can create pods but not use the ServiceAccount", func() {
+		allowPods()
+		Eventually(func() string {
+			return hook.Handle(context.Background(), request(admissionv1.Create, migrator, nil)).Result.Message
+		}).Should(ContainSubstring("cannot impersonate ServiceAccount migrations"))
+	})
+
+	It("allows a user who can create pods and use the ServiceAccount", func() {
+		allowPods()
+		allowServiceAccount("migrations")
+		Eventually(func() bool {
+			return hook.Handle(context.Background(), request(admissionv1.Create, migrator, nil)).Allowed
+		}).Should(BeTrue())
+	})
+
+	It("only checks the ServiceAccount named in the spec", func() {
+		allowPods()
+		allowServiceAccount("other")
+		Consistently(func() bool {
+			return hook.Handle(context.Background(), request(admissionv1.Create, migrator, nil)).Allowed
+		}).Should(BeFalse())
+	})
+
+	It("allows a user who can create pods when the template's ServiceAccount is used", func() {
+		allowPods()
+		migrator.Spec.Job.ServiceAccountName = ""
+		Eventually(func() bool {
+			return hook.Handle(context.Background(), request(admissionv1.Create, migrator, nil)).Allowed
+		}).Should(BeTrue())
+	})
+
+	It("skips the check for updates that don't change the spec", func() {
+		updated := migrator.DeepCopy()
+		updated.Labels = map[string]string{"foo": "bar"}
+		resp := hook.Handle(context.Background(), request(admissionv1.Update, updated, migrator))
+		Expect(resp.Allowed).To(BeTrue())
+	})
+
+	It("checks updates that change the spec", func() {
+		updated := migrator.DeepCopy()
+		updated.Spec.Job.ServiceAccountName = "admin"
+		resp := hook.Handle(context.Background(), request(admissionv1.Update, updated, migrator))
+		Expect(resp.Allowed).To(BeFalse())
+	})
+
+	It("rejects an empty selector", func() {
+		migrator.Spec.Selector = &metav1.LabelSelector{}
+		err := helper.Client.Create(context.Background(), migrator)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.selector: Required value"))
+	})
+
+	It("rejects an invalid selector", func() {
+		migrator.Spec.Selector = &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{
+			{Key: "app", Operator: metav1.LabelSelectorOpIn},
+		}}
+		err := helper.Client.Create(context.Background(), migrator)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.selector: Invalid value"))
+	})
+
+	It("rejects impossible container names", func() {
+		migrator.Spec.Container = "migrate-wait-main"
+		migrator.Spec.Job.Sidecars.Containers = []string{"proxy", "migrations", "proxy", "migrate-wait-main"}
+		err := helper.Client.Create(context.Background(), migrator)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.container: Invalid value"))
+		Expect(err.Error()).To(ContainSubstring("spec.job.sidecars.containers[1]: Invalid value: \"migrations\""))
+		Expect(err.Error()).To(ContainSubstring("spec.job.sidecars.containers[2]: Duplicate value"))
+		Expect(err.Error()).To(ContainSubstring("spec.job.sidecars.containers[3]: Invalid value"))
+	})
+
+	It("rejects container names which don't match the CRD schema", func() {
+		migrator.Spec.Container = "Main_Container"
+		migrator.Spec.Job.Sidecars.Mode = "Sometimes"
+		err := helper.Client.Create(context.Background(), migrator)
+		Expect(err).To(HaveOccurred())
+		Expect(err.Error()).To(ContainSubstring("spec.container"))
+		Expect(err.Error()).To(ContainSubstring("spec.job.sidecars.mode"))
+	})
+
+	It("accepts a valid migrator", func() {
+		migrator.Spec.Container = "main"
+		migrator.Spec.Job.Sidecars.Containers = []string{"proxy"}
+		helper.TestClient.Create(migrator)
+	})
+
+	It("warns about overlapping selectors", func() {
+		allowPods()
+		allowServiceAccount("migrations")
+		other := &migrationsv1.Migrator{
+			ObjectMeta: metav1.ObjectMeta{Name: "other"},
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "testing", "component": "web"}},
+			},
+		}
+		helper.TestClient.Create(other)
+		unrelated := &migrationsv1.Migrator{
+			ObjectMeta: metav1.ObjectMeta{Name: "unrelated"},
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "other"}},
+			},
+		}
+		helper.TestClient.Create(unrelated)
+
+		Eventually(func() []string {
+			return hook.Handle(context.Background(), request(admissionv1.Create, migrator, nil)).Warnings
+		}).Should(Equal([]string{"selector may overlap with Migrator other, pods matching both will wait for both"}))
+	})
+})
@@ -21,32 +21,144 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 
 	"github.com/pkg/errors"
 	jsonpatch "gomodules.xyz/jsonpatch/v2"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 	"github.com/coderanger/migrations-operator/utils"
 )
 
 const REQUIRE_MIGRATOR_ANNOTATION = "migrations.coderanger.net/required"
 const NOWAIT_MIGRATOR_ANNOTATION = "migrations.coderanger.net/no-wait"
+const WAITER_PREFIX = "migrate-wait-"
+
+// The projected ServiceAccount token which waiters authenticate to the operator's API with.
+const (
+	WAITER_TOKEN_VOLUME     = "migrations-waiter-token"
+	WAITER_TOKEN_MOUNT_PATH = "/var/run/secrets/migrations.coderanger.net/serviceaccount"
+	WAITER_TOKEN_AUDIENCE   = "migrations.coderanger.net"
+	// Tokens are rotated by the kubelet well before they expire.
+	WAITER_TOKEN_EXPIRATION_SECONDS = 3600
+)
+
+// Where direct mode waiters get the token and cluster CA they watch their Migrator with. Each waiter mounts the
+// token Secret of its Migrator's waiter ServiceAccount from a volume named like the waiter container.
+const WAITER_KUBE_TOKEN_MOUNT_PATH = "/var/run/secrets/migrations.coderanger.net/kubernetes"
+
+// WaiterServiceAccountName is the name of the ServiceAccount direct mode waiters for a Migrator use, and of its
+// token Secret.
+func WaiterServiceAccountName(migratorName string) string {
+	return migratorName + "-migrations-waiter"
+}
+
+// The key in the API_CA_CONFIGMAP ConfigMap holding the CA bundle for the operator's API server.
+const API_CA_KEY = "ca.crt"
+
+// IsWaiterVolume checks if a volume is an injected waiter token volume.
+func IsWaiterVolume(v *corev1.Volume) bool {
+	return v.Name == WAITER_TOKEN_VOLUME || strings.HasPrefix(v.Name, WAITER_PREFIX)
+}
+
+// IsWaiterContainer checks if a container is an injected migration waiter. This checks the command and
+// image as well as the name so waiters are still found if something else renamed them.
+func IsWaiterContainer(c *corev1.Container) bool {
+	if strings.HasPrefix(c.Name, WAITER_PREFIX) {
+		return true
+	}
+	if len(c.Command) != 0 && c.Command[0] == "/waiter" {
+		return true
+	}
+	waiterImage := os.Getenv("WAITER_IMAGE")
+	return waiterImage != "" && c.Image == waiterImage
+}
+
+// WaiterStatus checks whether a pod has the waiter for a Migrator, and if so whether it has finished
+// successfully.
+func WaiterStatus(pod *corev1.Pod, migratorName string) (injected bool, done bool) {
+	waiterName := WAITER_PREFIX + migratorName
+	if utils.FindContainer(&pod.Spec, waiterName) == nil {
+		return false, false
+	}
+	for _, status := range pod.Status.InitContainerStatuses {
+		if status.Name == waiterName && status.State.Terminated != nil && status.State.Terminated.ExitCode == 0 {
+			return true, true
+		}
+	}
+	return true, false
+}
+
+// TargetImage finds the image a pod waits for migrations for. This comes from the container (or init
+// container) named in the Migrator, falling back to the first container if none matches.
+func TargetImage(m *migrationsv1.Migrator, pod *corev1.Pod) string {
+	targetContainer := utils.FindContainer(&pod.Spec, m.Spec.Container)
+	if m.Spec.Container == "" || targetContainer == nil {
+		if len(pod.Spec.Containers) == 0 {
+			return ""
+		}
+		targetContainer = &pod.Spec.Containers[0]
+	}
+	return targetContainer.Image
+}
+
+// IsBlocked checks if a pod is currently held back by the waiter for a Migrator.
+func IsBlocked(pod *corev1.Pod, migratorName string) bool {
+	if pod.DeletionTimestamp != nil {
+		return false
+	}
+	injected, done := WaiterStatus(pod, migratorName)
+	return injected && !done
+}
 
 // +kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create;update,versions=v1,name=mpod.migrations.coderanger.net,admissionReviewVersions=v1beta1
 
 // initInjector injects migration initContainers into Pods
 type initInjector struct {
-	Client  client.Client
-	decoder *admission.Decoder
+	Client client.Client
+	// Reads the API CA bundle ConfigMap, if API_CA_CONFIGMAP is set.
+	CAReader    client.Reader
+	CAConfigMap types.NamespacedName
+	decoder     *admission.Decoder
 }
 
 func InitInjector(mgr ctrl.Manager) error {
+	hook := &initInjector{Client: mgr.GetClient()}
+	if name := os.Getenv("API_CA_CONFIGMAP"); name != "" {
+		namespace := os.Getenv("POD_NAMESPACE")
+		if namespace == "" {
+			return errors.New("POD_NAMESPACE must be set to the operator's namespace to read API_CA_CONFIGMAP")
+		}
+		// Pods are admitted often, so the CA bundle comes from its own cache of just that ConfigMap, which is
+		// all the operator's namespaced Role allows reading anyway.
+		c, err := cache.New(mgr.GetConfig(), cache.Options{
+			Scheme:    mgr.GetScheme(),
+			Mapper:    mgr.GetRESTMapper(),
+			Namespace: namespace,
+			SelectorsByObject: cache.SelectorsByObject{
+				&corev1.ConfigMap{}: {Field: fields.OneTermEqualSelector("metadata.name", name)},
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "error creating API CA bundle cache")
+		}
+		err = mgr.Add(c)
+		if err != nil {
+			return errors.Wrap(err, "error adding API CA bundle cache")
+		}
+		hook.CAReader = c
+		hook.CAConfigMap = types.NamespacedName{Name: name, Namespace: namespace}
+	}
 	hookServer := mgr.GetWebhookServer()
-	hookServer.Register("/mutate-v1-pod", &webhook.Admission{Handler: &initInjector{Client: mgr.GetClient()}})
+	hookServer.Register("/mutate-v1-pod", &webhook.Admission{Handler: hook})
 	return nil
 }
 
@@ -95,6 +207,24 @@ func (hook *initInjector) handleInner(ctx context.Context, req admission.Request
 		return &resp, nil
 	}
 
+	// Without the CA bundle the waiter couldn't reach the API server, so reject the pod rather than admit it
+	// without a waiter. It is retried by whatever created the pod.
+	caBundle, err := hook.apiCABundle(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The namespace can set the default waiter mode for its Migrators.
+	namespace := &corev1.Namespace{}
+	err = hook.Client.Get(ctx, types.NamespacedName{Name: req.Namespace}, namespace)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error getting namespace %s", req.Namespace)
+	}
+	modes := make([]migrationsv1.WaiterMode, len(migrators))
+	for i, m := range migrators {
+		modes[i] = utils.WaiterMode(m, namespace)
+	}
+
 	patches := []jsonpatch.JsonPatchOperation{}
 	// Check that initContainers exists at all.
 	if len(pod.Spec.InitContainers) == 0 {
@@ -106,32 +236,66 @@ func (hook *initInjector) handleInner(ctx context.Context, req admission.Request
 		patches = append(patches, patch)
 	}
 
+	// Add the token volumes for the waiters, unless the pod already has them. API mode waiters share one.
+	volumes := []interface{}{}
+	for i, m := range migrators {
+		name, volume := waiterVolume(m, modes[i])
+		if !hasVolume(pod, name) && !containsVolume(volumes, name) {
+			volumes = append(volumes, volume)
+		}
+	}
+	if len(volumes) != 0 && len(pod.Spec.Volumes) == 0 {
+		patches = append(patches, jsonpatch.JsonPatchOperation{
+			Operation: "add",
+			Path:      "/spec/volumes",
+			Value:     volumes,
+		})
+	} else {
+		for _, volume := range volumes {
+			patches = append(patches, jsonpatch.JsonPatchOperation{
+				Operation: "add",
+				Path:      "/spec/volumes/-",
+				Value:     volume,
+			})
+		}
+	}
+
 	// For each migrator, inject an initContainer.
-	for _, m := range migrators {
-		// Look for the container named in the migrator and pull the image from that. If no container
-		// matches, fall back to using the first container.
-		podIdx := 0
-		for i, p := range pod.Spec.Containers {
-			if p.Name == m.Spec.Container {
-				podIdx = i
+	for i, m := range migrators {
+		volumeName, _ := waiterVolume(m, modes[i])
+		mountPath := WAITER_TOKEN_MOUNT_PATH
+		if modes[i] == migrationsv1.WaiterModeDirect {
+			mountPath = WAITER_KUBE_TOKEN_MOUNT_PATH
+		}
+		waiter := map[string]interface{}{
+			"name":    WAITER_PREFIX + m.Name,
+			"image":   os.Getenv("WAITER_IMAGE"),
+			"command": waiterCommand(m, TargetImage(m, pod), modes[i]),
+			"volumeMounts": []interface{}{
+				map[string]interface{}{
+					"name":      volumeName,
+					"mountPath": mountPath,
+					"readOnly":  true,
+				},
+			},
+			"resources": map[string]interface{}{
+				"requests": map[string]string{
+					"memory": "16M",
+					"cpu":    "10m",
+				},
+			},
+		}
+		if caBundle != "" && modes[i] == migrationsv1.WaiterModeAPI {
+			waiter["env"] = []interface{}{
+				map[string]interface{}{"name": "WAITER_CA_BUNDLE", "value": caBundle},
 			}
 		}
 		patch := jsonpatch.JsonPatchOperation{
 			Operation: "add",
 			Path:      "/spec/initContainers/-",
-			Value: map[string]interface{}{
-				"name":    fmt.Sprintf("migrate-wait-%s", m.Name),
-				"image":   os.Getenv("WAITER_IMAGE"),
-				"command": []string{"/waiter", pod.Spec.Containers[podIdx].Image, m.Namespace, m.Name, os.Getenv("API_HOSTNAME")},
-				"resources": map[string]interface{}{
-					"requests": map[string]string{
-						"memory": "16M",
-						"cpu":    "10m",
-					},
-				},
-			},
+			Value:     waiter,
 		}
-		log.Info("Injecting init container", "pod", fmt.Sprintf("%s/%s", req.Namespace, req.Name), "migrator", fmt.Sprintf("%s/%s", m.Namespace, m.Name))
+		log.Info("Injecting init container", "pod", fmt.Sprintf("%s/%s", req.Namespace, req.Name), "migrator", fmt.Sprintf("%s/%s", m.Namespace, m.Name), "mode", modes[i])
 		patches = append(patches, patch)
 	}
 
@@ -139,6 +303,102 @@ func (hook *initInjector) handleInner(ctx context.Context, req admission.Request
 	return &resp, nil
 }
 
+// apiCABundle reads the CA bundle for the operator's API server from the ConfigMap named by API_CA_CONFIGMAP
+// in the operator's namespace. It returns an empty string if the API server isn't using TLS.
+func (hook *initInjector) apiCABundle(ctx context.Context) (string, error) {
+	if hook.CAReader == nil {
+		return "", nil
+	}
+	cm := &corev1.ConfigMap{}
+	err := hook.CAReader.Get(ctx, hook.CAConfigMap, cm)
+	if err != nil {
+		return "", errors.Wrapf(err, "error getting API CA bundle ConfigMap %s", hook.CAConfigMap)
+	}
+	caBundle := cm.Data[API_CA_KEY]
+	if caBundle == "" {
+		return "", errors.Errorf("API CA bundle ConfigMap %s has no %s", hook.CAConfigMap, API_CA_KEY)
+	}
+	return caBundle, nil
+}
+
+// waiterVolume builds the token volume used by a Migrator's waiter in the given mode. API mode waiters get a
+// projected token only the operator's API accepts. Direct mode waiters get the token Secret of the Migrator's
+// waiter ServiceAccount, which can only read that Migrator, and the cluster CA, so the pod's own ServiceAccount
+// token is never mounted.
+func waiterVolume(m *migrationsv1.Migrator, mode migrationsv1.WaiterMode) (string, map[string]interface{}) {
+	if mode == migrationsv1.WaiterModeDirect {
+		name := WAITER_PREFIX + m.Name
+		return name, map[string]interface{}{
+			"name": name,
+			"secret": map[string]interface{}{
+				"secretName": WaiterServiceAccountName(m.Name),
+				"items": []interface{}{
+					map[string]interface{}{"key": "token", "path": "token"},
+					map[string]interface{}{"key": "ca.crt", "path": "ca.crt"},
+				},
+			},
+		}
+	}
+	return WAITER_TOKEN_VOLUME, map[string]interface{}{
+		"name": WAITER_TOKEN_VOLUME,
+		"projected": map[string]interface{}{
+			"sources": []interface{}{
+				map[string]interface{}{
+					"serviceAccountToken": map[string]interface{}{
+						"audience":          WAITER_TOKEN_AUDIENCE,
+						"expirationSeconds": WAITER_TOKEN_EXPIRATION_SECONDS,
+						"path":              "token",
+					},
+				},
+			},
+		},
+	}
+}
+
+func hasVolume(pod *corev1.Pod, name string) bool {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsVolume(volumes []interface{}, name string) bool {
+	for _, v := range volumes {
+		if v.(map[string]interface{})["name"] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// waiterCommand builds the command for a waiter container. Optional flags are only added for non-default
+// settings.
+func waiterCommand(m *migrationsv1.Migrator, image string, mode migrationsv1.WaiterMode) []string {
+	command := []string{
+		"/waiter",
+		"--image=" + image,
+		"--namespace=" + m.Namespace,
+		"--migrator=" + m.Name,
+	}
+	if mode == migrationsv1.WaiterModeDirect {
+		command = append(command, "--mode=direct")
+	} else {
+		command = append(command, "--api="+os.Getenv("API_HOSTNAME"))
+	}
+	if m.Spec.Waiter.FailurePolicy == migrationsv1.WaiterPolicyFail {
+		command = append(command, "--fail-on-failure")
+	}
+	if m.Spec.Waiter.MissingMigratorPolicy == migrationsv1.WaiterPolicyFail {
+		command = append(command, "--fail-on-missing")
+	}
+	if m.Spec.Waiter.Timeout != nil && m.Spec.Waiter.Timeout.Duration > 0 {
+		command = append(command, "--timeout="+m.Spec.Waiter.Timeout.Duration.String())
+	}
+	return command
+}
+
 // initInjector implements admission.DecoderInjector.
 // A decoder will be automatically injected.
 
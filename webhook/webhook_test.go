@@ -19,6 +19,7 @@ package webhook
 import (
 	"context"
 	"os"
+	"time"
 
 	cu "github.com/coderanger/controller-utils"
 	. "github.com/onsi/ginkgo"
@@ -27,8 +28,10 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 
-	migrationsv1beta1 "github.com/coderanger/migrations-operator/api/v1beta1"
+	migrationsv1 "github.com/coderanger/migrations-operator/api/v1"
 )
 
 var _ = Describe("InitInjector", func() {
@@ -37,7 +40,7 @@ var _ = Describe("InitInjector", func() {
 	BeforeEach(func() {
 		os.Setenv("API_HOSTNAME", "migrations-operator.migration-operator.svc")
 		os.Setenv("WAITER_IMAGE", "migrations-operator:latest")
-		helper = suiteHelper.MustStart(InitInjector)
+		helper = suiteHelper.MustStart(InitInjector, MigratorDefaulter, MigratorValidator)
 	})
 
 	AfterEach(func() {
@@ -94,9 +97,9 @@ var _ = Describe("InitInjector", func() {
 	It("injects with a matching migrator", func() {
 		c := helper.TestClient
 
-		migrator := &migrationsv1beta1.Migrator{
+		migrator := &migrationsv1.Migrator{
 			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
-			Spec: migrationsv1beta1.MigratorSpec{
+			Spec: migrationsv1.MigratorSpec{
 				Selector: &metav1.LabelSelector{
 					MatchLabels: map[string]string{"app": "testing"},
 				},
@@ -119,15 +122,96 @@ var _ = Describe("InitInjector", func() {
 
 		c.EventuallyGetName("testing", pod)
 		Expect(pod.Spec.InitContainers).To(HaveLen(1))
-		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "fake", helper.Namespace, "testing", "migrations-operator.migration-operator.svc"}))
+		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "--image=fake", "--namespace=" + helper.Namespace, "--migrator=testing", "--api=migrations-operator.migration-operator.svc"}))
+		Expect(pod.Spec.InitContainers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: WAITER_TOKEN_VOLUME, MountPath: WAITER_TOKEN_MOUNT_PATH, ReadOnly: true}))
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(pod.Spec.Volumes[0].Name).To(Equal(WAITER_TOKEN_VOLUME))
+		Expect(pod.Spec.Volumes[0].Projected).ToNot(BeNil())
+		Expect(pod.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.Audience).To(Equal(WAITER_TOKEN_AUDIENCE))
+	})
+
+	It("passes waiter settings from the migrator", func() {
+		c := helper.TestClient
+
+		migrator := &migrationsv1.Migrator{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "testing"},
+				},
+				Waiter: migrationsv1.WaiterSpec{
+					FailurePolicy:         migrationsv1.WaiterPolicyFail,
+					MissingMigratorPolicy: migrationsv1.WaiterPolicyFail,
+					Timeout:               &metav1.Duration{Duration: 10 * time.Minute},
+				},
+			},
+		}
+		c.Create(migrator)
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing", Labels: map[string]string{"app": "testing"}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:  "main",
+						Image: "fake",
+					},
+				},
+			},
+		}
+		c.Create(pod)
+
+		c.EventuallyGetName("testing", pod)
+		Expect(pod.Spec.InitContainers).To(HaveLen(1))
+		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "--image=fake", "--namespace=" + helper.Namespace, "--migrator=testing", "--api=migrations-operator.migration-operator.svc", "--fail-on-failure", "--fail-on-missing", "--timeout=10m0s"}))
+	})
+
+	It("injects a direct mode waiter", func() {
+		c := helper.TestClient
+
+		migrator := &migrationsv1.Migrator{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "testing"},
+				},
+				Waiter: migrationsv1.WaiterSpec{
+					Mode: migrationsv1.WaiterModeDirect,
+				},
+			},
+		}
+		c.Create(migrator)
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing", Labels: map[string]string{"app": "testing"}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:  "main",
+						Image: "fake",
+					},
+				},
+			},
+		}
+		c.Create(pod)
+
+		c.EventuallyGetName("testing", pod)
+		Expect(pod.Spec.InitContainers).To(HaveLen(1))
+		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "--image=fake", "--namespace=" + helper.Namespace, "--migrator=testing", "--mode=direct"}))
+		Expect(pod.Spec.InitContainers[0].VolumeMounts).To(ContainElement(corev1.VolumeMount{Name: "migrate-wait-testing", MountPath: WAITER_KUBE_TOKEN_MOUNT_PATH, ReadOnly: true}))
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(pod.Spec.Volumes[0].Name).To(Equal("migrate-wait-testing"))
+		Expect(pod.Spec.Volumes[0].Projected).To(BeNil())
+		Expect(pod.Spec.Volumes[0].Secret.SecretName).To(Equal("testing-migrations-waiter"))
+		Expect(pod.Spec.AutomountServiceAccountToken).To(BeNil())
 	})
 
 	It("selects the specified container with a multi-container Pod", func() {
 		c := helper.TestClient
 
-		migrator := &migrationsv1beta1.Migrator{
+		migrator := &migrationsv1.Migrator{
 			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
-			Spec: migrationsv1beta1.MigratorSpec{
+			Spec: migrationsv1.MigratorSpec{
 				Selector: &metav1.LabelSelector{
 					MatchLabels: map[string]string{"app": "testing"},
 				},
@@ -155,15 +239,53 @@ var _ = Describe("InitInjector", func() {
 
 		c.EventuallyGetName("testing", pod)
 		Expect(pod.Spec.InitContainers).To(HaveLen(1))
-		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "foo", helper.Namespace, "testing", "migrations-operator.migration-operator.svc"}))
+		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "--image=foo", "--namespace=" + helper.Namespace, "--migrator=testing", "--api=migrations-operator.migration-operator.svc"}))
+	})
+
+	It("selects the specified init container", func() {
+		c := helper.TestClient
+
+		migrator := &migrationsv1.Migrator{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "testing"},
+				},
+				Container: "db-migrations",
+			},
+		}
+		c.Create(migrator)
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing", Labels: map[string]string{"app": "testing"}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:  "main",
+						Image: "fake",
+					},
+				},
+				InitContainers: []corev1.Container{
+					{
+						Name:  "db-migrations",
+						Image: "migrations",
+					},
+				},
+			},
+		}
+		c.Create(pod)
+
+		c.EventuallyGetName("testing", pod)
+		Expect(pod.Spec.InitContainers).To(HaveLen(2))
+		Expect(pod.Spec.InitContainers[1].Command).To(Equal([]string{"/waiter", "--image=migrations", "--namespace=" + helper.Namespace, "--migrator=testing", "--api=migrations-operator.migration-operator.svc"}))
 	})
 
 	It("falls back to the first container if the specified container doesn't exist", func() {
 		c := helper.TestClient
 
-		migrator := &migrationsv1beta1.Migrator{
+		migrator := &migrationsv1.Migrator{
 			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
-			Spec: migrationsv1beta1.MigratorSpec{
+			Spec: migrationsv1.MigratorSpec{
 				Selector: &metav1.LabelSelector{
 					MatchLabels: map[string]string{"app": "testing"},
 				},
@@ -191,15 +313,15 @@ var _ = Describe("InitInjector", func() {
 
 		c.EventuallyGetName("testing", pod)
 		Expect(pod.Spec.InitContainers).To(HaveLen(1))
-		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "bar", helper.Namespace, "testing", "migrations-operator.migration-operator.svc"}))
+		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "--image=bar", "--namespace=" + helper.Namespace, "--migrator=testing", "--api=migrations-operator.migration-operator.svc"}))
 	})
 
 	It("uses the first container image if no container name is supplied with a multi-container Pod", func() {
 		c := helper.TestClient
 
-		migrator := &migrationsv1beta1.Migrator{
+		migrator := &migrationsv1.Migrator{
 			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
-			Spec: migrationsv1beta1.MigratorSpec{
+			Spec: migrationsv1.MigratorSpec{
 				Selector: &metav1.LabelSelector{
 					MatchLabels: map[string]string{"app": "testing"},
 				},
@@ -226,15 +348,15 @@ var _ = Describe("InitInjector", func() {
 
 		c.EventuallyGetName("testing", pod)
 		Expect(pod.Spec.InitContainers).To(HaveLen(1))
-		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "bar", helper.Namespace, "testing", "migrations-operator.migration-operator.svc"}))
+		Expect(pod.Spec.InitContainers[0].Command).To(Equal([]string{"/waiter", "--image=bar", "--namespace=" + helper.Namespace, "--migrator=testing", "--api=migrations-operator.migration-operator.svc"}))
 	})
 
 	It("doesn't inject with a non-matching migrator", func() {
 		c := helper.TestClient
 
-		migrator := &migrationsv1beta1.Migrator{
+		migrator := &migrationsv1.Migrator{
 			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
-			Spec: migrationsv1beta1.MigratorSpec{
+			Spec: migrationsv1.MigratorSpec{
 				Selector: &metav1.LabelSelector{
 					MatchLabels: map[string]string{"app": "other"},
 				},
@@ -312,3 +434,89 @@ var _ = Describe("InitInjector", func() {
 		Expect(sidecar["restartPolicy"]).To(Equal("Always"))
 	})
 })
+
+var _ = Describe("InitInjector with an API CA bundle", func() {
+	var helper *cu.FunctionalHelper
+
+	BeforeEach(func() {
+		os.Setenv("API_HOSTNAME", "migrations-operator.migration-operator.svc")
+		os.Setenv("WAITER_IMAGE", "migrations-operator:latest")
+		os.Setenv("POD_NAMESPACE", "default")
+		os.Setenv("API_CA_CONFIGMAP", "api-ca")
+		helper = suiteHelper.MustStart(InitInjector, MigratorDefaulter, MigratorValidator)
+	})
+
+	AfterEach(func() {
+		helper.Client.Delete(context.Background(), &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "api-ca", Namespace: "default"}})
+		helper.MustStop()
+		helper = nil
+		os.Unsetenv("POD_NAMESPACE")
+		os.Unsetenv("API_CA_CONFIGMAP")
+	})
+
+	It("passes the API CA bundle to the waiter", func() {
+		c := helper.TestClient
+
+		Expect(helper.Client.Create(context.Background(), &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "api-ca", Namespace: "default"},
+			Data:       map[string]string{API_CA_KEY: "fake bundle"},
+		})).To(Succeed())
+		migrator := &migrationsv1.Migrator{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing"},
+			Spec: migrationsv1.MigratorSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "testing"},
+				},
+			},
+		}
+		c.Create(migrator)
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "testing", Labels: map[string]string{"app": "testing"}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{
+						Name:  "main",
+						Image: "fake",
+					},
+				},
+			},
+		}
+		c.Create(pod)
+
+		c.EventuallyGetName("testing", pod)
+		Expect(pod.Spec.InitContainers).To(HaveLen(1))
+		Expect(pod.Spec.InitContainers[0].Env).To(Equal([]corev1.EnvVar{{Name: "WAITER_CA_BUNDLE", Value: "fake bundle"}}))
+	})
+})
+
+var _ = Describe("apiCABundle", func() {
+	caConfigMap := types.NamespacedName{Name: "api-ca", Namespace: "migrations-operator"}
+
+	It("returns nothing without TLS", func() {
+		hook := &initInjector{}
+		Expect(hook.apiCABundle(context.Background())).To(Equal(""))
+	})
+
+	It("reads the bundle", func() {
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "api-ca", Namespace: "migrations-operator"},
+			Data:       map[string]string{API_CA_KEY: "fake bundle"},
+		}
+		hook := &initInjector{CAReader: fake.NewClientBuilder().WithObjects(cm).Build(), CAConfigMap: caConfigMap}
+		Expect(hook.apiCABundle(context.Background())).To(Equal("fake bundle"))
+	})
+
+	It("fails when the ConfigMap is missing", func() {
+		hook := &initInjector{CAReader: fake.NewClientBuilder().Build(), CAConfigMap: caConfigMap}
+		_, err := hook.apiCABundle(context.Background())
+		Expect(err).To(MatchError(ContainSubstring("error getting API CA bundle ConfigMap migrations-operator/api-ca")))
+	})
+
+	It("fails when the ConfigMap has no bundle", func() {
+		cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "api-ca", Namespace: "migrations-operator"}}
+		hook := &initInjector{CAReader: fake.NewClientBuilder().WithObjects(cm).Build(), CAConfigMap: caConfigMap}
+		_, err := hook.apiCABundle(context.Background())
+		Expect(err).To(MatchError("API CA bundle ConfigMap migrations-operator/api-ca has no ca.crt"))
+	})
+})